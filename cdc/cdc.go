@@ -0,0 +1,168 @@
+// Package cdc writes the stream of applied operations to rotating NDJSON files and lets
+// consumers tail them from a checkpoint.
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpSnapshot marks a record written when a snapshot replaced the store: entries up to
+// its index were not seen one by one.
+const OpSnapshot = "SNAPSHOT"
+
+// Record is one applied log entry. Op, Key and Value are the entry as proposed; Changes
+// are the writes it made, which for conditional operations, transactions, expiries and
+// lease revokes may differ from Key and Value.
+type Record struct {
+	Index     uint64    `json:"index"`
+	Term      uint64    `json:"term"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key,omitempty"`
+	Value     string    `json:"value,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Changes   []Change  `json:"changes,omitempty"`
+}
+
+// Change is one key written by a record: "PUT" or "DELETE".
+type Change struct {
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Version uint64 `json:"version"`
+}
+
+// Writer appends records to files named cdc-<first index>.ndjson, starting a new file
+// once the current one reaches MaxBytes and keeping at most MaxFiles of them (0 keeps all).
+type Writer struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewWriter opens a writer on dir, appending to its newest file.
+func NewWriter(dir string, maxBytes int64, maxFiles int) (*Writer, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("cdc file size limit must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cdc directory: %v", err)
+	}
+	w := &Writer{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles}
+
+	files, err := ListFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cdc file: %v", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		w.file, w.size = f, info.Size()
+	}
+	return w, nil
+}
+
+// Write appends rec as one line. If the line cannot be written whole, the file is cut
+// back to where it was, so writing the record again leaves no partial line behind.
+func (w *Writer) Write(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || w.size >= w.maxBytes {
+		if err := w.rotateLocked(rec.Index); err != nil {
+			return err
+		}
+	}
+	if n, err := w.file.Write(line); err != nil {
+		if n > 0 {
+			w.file.Truncate(w.size)
+		}
+		return err
+	}
+	w.size += int64(len(line))
+	return nil
+}
+
+// rotateLocked closes the current file and starts one named after index. Caller holds w.mu.
+func (w *Writer) rotateLocked(index uint64) error {
+	if w.file != nil {
+		w.file.Sync()
+		w.file.Close()
+		w.file = nil
+	}
+	name := filepath.Join(w.dir, fmt.Sprintf("cdc-%020d.ndjson", index))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create cdc file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	fmt.Printf("🗂️ CDC writing to %s\n", name)
+
+	if w.maxFiles > 0 {
+		files, err := ListFiles(w.dir)
+		if err != nil {
+			return err
+		}
+		for len(files) > w.maxFiles {
+			os.Remove(files[0])
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the current file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	w.file.Sync()
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// ListFiles returns the CDC files in dir, oldest first.
+func ListFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cdc directory: %v", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "cdc-") && strings.HasSuffix(e.Name(), ".ndjson") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	// Names embed zero-padded indexes, so lexical order is index order.
+	sort.Strings(files)
+	return files, nil
+}
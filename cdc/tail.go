@@ -0,0 +1,209 @@
+package cdc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointEvery is how many records a tail delivers between checkpoint saves; it also
+// saves whenever it catches up.
+const checkpointEvery = 100
+
+// Checkpoint is how far a consumer has read: the last record delivered, and where the
+// next one starts.
+type Checkpoint struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Index  uint64 `json:"index"`
+}
+
+// LoadCheckpoint reads a checkpoint, returning the zero checkpoint if there is none.
+func LoadCheckpoint(path string) (Checkpoint, error) {
+	var cp Checkpoint
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	return cp, nil
+}
+
+// Save writes the checkpoint atomically.
+func (cp Checkpoint) Save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Tail delivers the records in dir after the checkpoint stored at checkpointPath, in
+// order, saving the checkpoint as it goes. Records are written at least once, so ones at
+// or below the checkpoint's index are skipped. With follow set, Tail polls for new
+// records every poll instead of returning at the end; it returns when fn fails.
+func Tail(dir, checkpointPath string, follow bool, poll time.Duration, fn func(Record) error) error {
+	cp, err := LoadCheckpoint(checkpointPath)
+	if err != nil {
+		return err
+	}
+	t := &tailer{dir: dir, cp: cp}
+	defer t.close()
+	// cp only moves past records fn has accepted, so a failed record is retried next time.
+	defer func() { cp.Save(checkpointPath) }()
+
+	unsaved := 0
+	for {
+		rec, ok, err := t.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			cp = t.cp
+			if err := cp.Save(checkpointPath); err != nil {
+				return err
+			}
+			unsaved = 0
+			if !follow {
+				return nil
+			}
+			time.Sleep(poll)
+			continue
+		}
+		if rec.Index <= t.cp.Index {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		t.cp.Index = rec.Index
+		cp = t.cp
+		if unsaved++; unsaved >= checkpointEvery {
+			if err := cp.Save(checkpointPath); err != nil {
+				return err
+			}
+			unsaved = 0
+		}
+	}
+}
+
+// tailer reads whole lines across the rotating files.
+type tailer struct {
+	dir  string
+	cp   Checkpoint
+	file *os.File
+	rd   *bufio.Reader
+}
+
+// next returns the next complete record, or false if there is none yet.
+func (t *tailer) next() (Record, bool, error) {
+	for {
+		if t.file == nil {
+			opened, err := t.open()
+			if err != nil || !opened {
+				return Record{}, false, err
+			}
+		}
+
+		line, err := t.rd.ReadBytes('\n')
+		if err == nil {
+			t.cp.Offset += int64(len(line))
+			var rec Record
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return Record{}, false, fmt.Errorf("invalid record in %s: %v", t.cp.File, err)
+			}
+			return rec, true, nil
+		}
+		if err != io.EOF {
+			return Record{}, false, err
+		}
+
+		// A partial line is still being written: read it again from its start later.
+		t.close()
+		next, err := t.nextFile()
+		if err != nil || next == "" {
+			return Record{}, false, err
+		}
+		// The writer closes a file before starting the next one, so once a newer file
+		// exists this one is complete, but it may have grown since we hit its end.
+		if size, err := fileSize(filepath.Join(t.dir, t.cp.File)); err == nil && size > t.cp.Offset {
+			continue
+		}
+		t.cp.File, t.cp.Offset = next, 0
+	}
+}
+
+// open opens the checkpoint's file at its offset, or the oldest file if that one is gone
+// (rotated away) or not yet chosen.
+func (t *tailer) open() (bool, error) {
+	if t.cp.File != "" {
+		f, err := os.Open(filepath.Join(t.dir, t.cp.File))
+		if err == nil {
+			if _, err := f.Seek(t.cp.Offset, io.SeekStart); err != nil {
+				f.Close()
+				return false, err
+			}
+			t.file, t.rd = f, bufio.NewReader(f)
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	files, err := ListFiles(t.dir)
+	if err != nil || len(files) == 0 {
+		return false, err
+	}
+	first := filepath.Base(files[0])
+	if t.cp.File != "" && first <= t.cp.File {
+		return false, fmt.Errorf("cdc file %s vanished", t.cp.File)
+	}
+	if t.cp.File != "" {
+		fmt.Printf("⚠️ %s was rotated away before it was read; continuing from %s\n", t.cp.File, first)
+	}
+	t.cp.File, t.cp.Offset = first, 0
+	return t.open()
+}
+
+// nextFile returns the file after the current one, or "" if there is none yet.
+func (t *tailer) nextFile() (string, error) {
+	files, err := ListFiles(t.dir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if name := filepath.Base(f); name > t.cp.File {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+func (t *tailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file, t.rd = nil, nil
+	}
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kvstore/cdc"
+	"os"
+	"time"
+)
+
+// cdc_tail prints a node's change feed as NDJSON on stdout, resuming from and updating a
+// checkpoint file, e.g.
+//
+//	go run ./cdc_tail -dir node0_data/cdc -checkpoint analytics.checkpoint -follow
+func main() {
+	var dir, checkpoint string
+	var follow bool
+	var poll time.Duration
+
+	flag.StringVar(&dir, "dir", "/data/cdc", "Directory the node writes its CDC files to (CDC_DIR)")
+	flag.StringVar(&checkpoint, "checkpoint", "cdc.checkpoint", "File recording how far this consumer has read")
+	flag.BoolVar(&follow, "follow", false, "Keep waiting for new records instead of exiting at the end")
+	flag.DurationVar(&poll, "poll", 500*time.Millisecond, "How often to look for new records with -follow")
+	flag.Parse()
+
+	enc := json.NewEncoder(os.Stdout)
+	err := cdc.Tail(dir, checkpoint, follow, poll, func(rec cdc.Record) error {
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌ cdc_tail:", err)
+		os.Exit(1)
+	}
+}
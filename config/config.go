@@ -12,36 +12,95 @@ type NodeConfig struct {
 	ID   int
 	IP   string
 	Port string
+	// PeerPort is where the node serves the internal routes other nodes call. If it is
+	// empty, they are served on Port with everything else.
+	PeerPort string
+	// CertFile and KeyFile are the node's TLS certificate and key, if the cluster uses TLS.
+	CertFile string
+	KeyFile  string
 }
 
-// LoadClusterConfig reads the `cluster.conf` file
-func LoadClusterConfig(filePath string) ([]NodeConfig, error) {
-	var nodes []NodeConfig
+// Address returns the node's client address, which also names it in the cluster.
+func (n NodeConfig) Address() string {
+	return n.IP + ":" + n.Port
+}
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config file: %v", err)
+// PeerAddress returns the address the node serves its internal routes on.
+func (n NodeConfig) PeerAddress() string {
+	if n.PeerPort == "" {
+		return n.Address()
 	}
-	defer file.Close()
+	return n.IP + ":" + n.PeerPort
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) != 3 {
-			continue // Ignore invalid lines
+// TLSConfig holds the cluster-wide TLS settings from `cluster.conf`.
+type TLSConfig struct {
+	// CAFile is the CA that signs every node's certificate. TLS is off if it is empty.
+	CAFile string
+}
+
+// Enabled reports whether the cluster uses TLS.
+func (t TLSConfig) Enabled() bool {
+	return t.CAFile != ""
+}
+
+// LoadClusterConfig reads the `cluster.conf` file. Each node's line is its ID, host and
+// client port, then optionally its peer port, then optionally its TLS certificate and key
+// paths.
+func LoadClusterConfig(filePath string) ([]NodeConfig, error) {
+	var nodes []NodeConfig
+	err := scanConfig(filePath, func(fields []string) {
+		if len(fields) < 3 || len(fields) > 6 {
+			return // Ignore invalid lines
 		}
 
 		var node NodeConfig
-		fmt.Sscanf(fields[0], "%d", &node.ID)
+		if _, err := fmt.Sscanf(fields[0], "%d", &node.ID); err != nil {
+			return // Ignore settings
+		}
 		node.IP = fields[1]
 		node.Port = fields[2]
+		if len(fields) == 4 || len(fields) == 6 {
+			node.PeerPort = fields[3]
+		}
+		if len(fields) >= 5 {
+			node.CertFile = fields[len(fields)-2]
+			node.KeyFile = fields[len(fields)-1]
+		}
 
 		nodes = append(nodes, node)
+	})
+	return nodes, err
+}
+
+// LoadTLSConfig reads the TLS settings from the `cluster.conf` file:
+//
+//	tls-ca /app/config/tls/ca.crt
+func LoadTLSConfig(filePath string) (TLSConfig, error) {
+	var cfg TLSConfig
+	err := scanConfig(filePath, func(fields []string) {
+		if len(fields) == 2 && fields[0] == "tls-ca" {
+			cfg.CAFile = fields[1]
+		}
+	})
+	return cfg, err
+}
+
+// scanConfig calls line with the fields of every line of the file.
+func scanConfig(filePath string, line func(fields []string)) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
 	}
+	defer file.Close()
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading config file: %v", err)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line(strings.Fields(scanner.Text()))
 	}
 
-	return nodes, nil
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// BuildTLS loads me's certificate and the cluster CA and returns the configurations for
+// me's listener and for its connections to other nodes.
+//
+// The listener asks for a client certificate but does not require one, so clients without
+// certificates can still connect. A certificate that is presented must be signed by the
+// CA and name one of the hosts in nodes; anything else fails the handshake. Connections
+// to other nodes present me's certificate and check the peer's against the host dialed,
+// which is its cluster.conf host.
+func BuildTLS(cfg TLSConfig, nodes []NodeConfig, me NodeConfig) (server *tls.Config, client *tls.Config, err error) {
+	if me.CertFile == "" || me.KeyFile == "" {
+		return nil, nil, fmt.Errorf("node %d has no TLS certificate and key in cluster.conf", me.ID)
+	}
+	cert, err := tls.LoadX509KeyPair(me.CertFile, me.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read TLS CA: %v", err)
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("no certificates found in TLS CA %s", cfg.CAFile)
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 {
+				return nil // a client without a certificate
+			}
+			return VerifyNodeCertificate(chains[0][0], nodes)
+		},
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
+
+// VerifyNodeCertificate checks that cert names the host of one of nodes.
+func VerifyNodeCertificate(cert *x509.Certificate, nodes []NodeConfig) error {
+	for _, node := range nodes {
+		if cert.VerifyHostname(node.IP) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate for %q does not match any node in cluster.conf", cert.Subject.CommonName)
+}
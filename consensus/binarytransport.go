@@ -0,0 +1,422 @@
+package consensus
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The binary protocol carries peer RPCs as gob frames over one long-lived TCP connection
+// per pair of nodes. Each request carries an ID that its response echoes, so many calls
+// share a connection at once and answers may arrive out of order. Gob sends each type's
+// description once per connection, after which a heartbeat is a few dozen bytes.
+// Snapshot transfers stay on HTTP, which streams them instead of framing them.
+
+// binaryMethod names the RPC a binaryRequest carries.
+type binaryMethod uint8
+
+const (
+	binaryAppendEntries binaryMethod = iota + 1
+	binaryRequestVote
+	binarySetLeader
+	binaryPropose
+	binaryReadIndex
+	binaryLogStatus
+	binaryLogEntries
+	binaryLeader
+	binaryPing
+	binaryStatus
+	binaryWeights
+)
+
+// binaryRequest holds the arguments of every method; gob leaves out the unused ones.
+type binaryRequest struct {
+	ID            uint64
+	Method        binaryMethod
+	AppendEntries AppendEntriesRequest
+	RequestVote   RequestVoteRequest
+	Entry         LogEntry
+	Leader        string
+	Term          uint64
+	Lease         bool
+	From          uint64
+}
+
+// binaryResponse holds the results of every method. Errors travel as text, except the
+// ones callers test for, which travel as a code.
+type binaryResponse struct {
+	ID            uint64
+	Err           string
+	ErrCode       uint8
+	AppendEntries AppendEntriesResponse
+	RequestVote   RequestVoteResponse
+	Batch         AppendEntriesRequest
+	LogStatus     LogStatus
+	Index         uint64
+	Committed     bool
+	Leader        string
+	Status        map[string]bool
+	Weights       map[string]float64
+}
+
+// Error codes for the sentinel errors a binaryResponse can carry.
+const (
+	binaryErrNotLeader uint8 = iota + 1
+	binaryErrSnapshotRequired
+	binaryErrProposalInDoubt
+)
+
+// binaryCallTimeout and binaryTransferTimeout match the HTTP transport's timeouts.
+// binaryRoundTimeout bounds forwarded proposals and read-index checks, which the leader
+// answers only after a whole approval round: up to three append-entries attempts per
+// follower, behind the round ahead of it.
+const (
+	binaryCallTimeout     = 1 * time.Second
+	binaryRoundTimeout    = 5 * time.Second
+	binaryTransferTimeout = 30 * time.Second
+)
+
+// BinaryTransport sends peer RPCs over the binary protocol. Nodes keep their HTTP
+// addresses as their names; addrs maps each to the address ServeBinary listens on.
+type BinaryTransport struct {
+	addrs     map[string]string
+	tls       *tls.Config
+	snapshots *HTTPTransport
+
+	mu    sync.Mutex
+	conns map[string]*binaryConn
+}
+
+// binaryConn is an open connection to one node and the calls waiting on it.
+type binaryConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	w       *bufio.Writer
+	enc     *gob.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan binaryResponse
+	closed  bool
+
+	lastRead atomic.Int64 // UnixNano of the last response read
+}
+
+// NewBinaryTransport returns a transport that reaches each node at addrs[node], dialing
+// on first use and again after a connection fails. Snapshots are sent over HTTP.
+func NewBinaryTransport(addrs map[string]string) *BinaryTransport {
+	return &BinaryTransport{
+		addrs:     addrs,
+		snapshots: NewHTTPTransport(),
+		conns:     make(map[string]*binaryConn),
+	}
+}
+
+// NewBinaryTransportWithTLS is NewBinaryTransport with every connection, and the HTTPS
+// snapshot transfers, secured by cfg. The nodes serving it wrap their listener with
+// tls.NewListener.
+func NewBinaryTransportWithTLS(addrs map[string]string, cfg *tls.Config) *BinaryTransport {
+	t := NewBinaryTransport(addrs)
+	t.tls = cfg
+	t.snapshots = NewHTTPTransportWithTLS(cfg)
+	return t
+}
+
+// UsePeerAddresses sets the HTTP peer addresses that snapshots are sent to, as
+// HTTPTransport.UsePeerAddresses does.
+func (t *BinaryTransport) UsePeerAddresses(addrs map[string]string) {
+	t.snapshots.UsePeerAddresses(addrs)
+}
+
+// connect returns the open connection to node, dialing one if there is none.
+func (t *BinaryTransport) connect(node string) (*binaryConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.conns[node]; ok {
+		return c, nil
+	}
+	addr, ok := t.addrs[node]
+	if !ok {
+		return nil, fmt.Errorf("no binary peer address for %s", node)
+	}
+	dialer := &net.Dialer{Timeout: binaryCallTimeout}
+	var conn net.Conn
+	var err error
+	if t.tls != nil {
+		// Check the certificate against the node's name, which holds its cluster.conf host.
+		cfg := t.tls.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(node)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(conn)
+	c := &binaryConn{conn: conn, w: w, enc: gob.NewEncoder(w), pending: make(map[uint64]chan binaryResponse)}
+	t.conns[node] = c
+	go t.readResponses(node, c)
+	return c, nil
+}
+
+// readResponses hands each response to the call waiting for it until the connection
+// fails, then fails every call still waiting.
+func (t *BinaryTransport) readResponses(node string, c *binaryConn) {
+	dec := gob.NewDecoder(bufio.NewReader(c.conn))
+	var err error
+	for {
+		var resp binaryResponse
+		if err = dec.Decode(&resp); err != nil {
+			break
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+	t.drop(node, c, err)
+}
+
+// drop closes a failed connection so the next call dials a new one.
+func (t *BinaryTransport) drop(node string, c *binaryConn, err error) {
+	t.mu.Lock()
+	if t.conns[node] == c {
+		delete(t.conns, node)
+	}
+	t.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.pending {
+		ch <- binaryResponse{ID: id, Err: fmt.Sprintf("connection to %s lost: %v", node, err)}
+		delete(c.pending, id)
+	}
+}
+
+// call sends req to node and waits up to timeout for the response.
+func (t *BinaryTransport) call(node string, req binaryRequest, timeout time.Duration) (binaryResponse, error) {
+	c, err := t.connect(node)
+	if err != nil {
+		return binaryResponse{}, err
+	}
+
+	ch := make(chan binaryResponse, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return binaryResponse{}, fmt.Errorf("connection to %s lost", node)
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	sent := time.Now()
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(sent.Add(timeout))
+	err = c.enc.Encode(&req)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		t.drop(node, c, err)
+		return binaryResponse{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		switch {
+		case resp.ErrCode == binaryErrNotLeader:
+			return resp, ErrNotLeader
+		case resp.ErrCode == binaryErrSnapshotRequired:
+			return resp, ErrSnapshotRequired
+		case resp.ErrCode == binaryErrProposalInDoubt:
+			return resp, ErrProposalInDoubt
+		case resp.Err != "":
+			return resp, fmt.Errorf("%s", resp.Err)
+		}
+		return resp, nil
+	case <-timer.C:
+		err := fmt.Errorf("binary rpc %d to %s timed out", req.Method, node)
+		if c.lastRead.Load() < sent.UnixNano() {
+			// Nothing at all has come back since this call was sent: the connection may be
+			// half-open. Close it so the next call dials again; calls still waiting on it
+			// fail now instead of timing out.
+			t.drop(node, c, err)
+			return binaryResponse{}, err
+		}
+		// Other answers are arriving, so only this call was slow; keep the connection.
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return binaryResponse{}, err
+	}
+}
+
+func (t *BinaryTransport) AppendEntries(node string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryAppendEntries, AppendEntries: req}, binaryCallTimeout)
+	return resp.AppendEntries, err
+}
+
+func (t *BinaryTransport) RequestVote(node string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryRequestVote, RequestVote: req}, binaryCallTimeout)
+	return resp.RequestVote, err
+}
+
+func (t *BinaryTransport) SetLeader(node, leader string, term uint64) error {
+	_, err := t.call(node, binaryRequest{Method: binarySetLeader, Leader: leader, Term: term}, binaryCallTimeout)
+	return err
+}
+
+func (t *BinaryTransport) Propose(node string, op LogEntry) (uint64, bool, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryPropose, Entry: op}, binaryRoundTimeout)
+	return resp.Index, resp.Committed, err
+}
+
+func (t *BinaryTransport) ReadIndex(node string, lease bool) (uint64, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryReadIndex, Lease: lease}, binaryRoundTimeout)
+	return resp.Index, err
+}
+
+func (t *BinaryTransport) LogStatus(node string) (LogStatus, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryLogStatus}, binaryCallTimeout)
+	return resp.LogStatus, err
+}
+
+func (t *BinaryTransport) LogEntries(node string, from uint64) (AppendEntriesRequest, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryLogEntries, From: from}, binaryTransferTimeout)
+	return resp.Batch, err
+}
+
+func (t *BinaryTransport) InstallSnapshot(node string, req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error) {
+	return t.snapshots.InstallSnapshot(node, req, data)
+}
+
+func (t *BinaryTransport) FetchSnapshot(node string) (*Snapshot, io.ReadCloser, error) {
+	return t.snapshots.FetchSnapshot(node)
+}
+
+func (t *BinaryTransport) Leader(node string) (string, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryLeader}, binaryCallTimeout)
+	return resp.Leader, err
+}
+
+func (t *BinaryTransport) Ping(node string) error {
+	_, err := t.call(node, binaryRequest{Method: binaryPing}, binaryCallTimeout)
+	return err
+}
+
+func (t *BinaryTransport) Status(node string) (map[string]bool, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryStatus}, binaryCallTimeout)
+	return resp.Status, err
+}
+
+func (t *BinaryTransport) Weights(node string) (map[string]float64, error) {
+	resp, err := t.call(node, binaryRequest{Method: binaryWeights}, binaryCallTimeout)
+	return resp.Weights, err
+}
+
+// ServeBinary answers binary-protocol RPCs arriving on l with peer until l is closed.
+func ServeBinary(l net.Listener, peer Peer) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveBinaryConn(conn, peer)
+	}
+}
+
+// serveBinaryConn handles each request on conn in its own goroutine, so a proposal
+// waiting for its quorum does not hold up the heartbeats behind it.
+func serveBinaryConn(conn net.Conn, peer Peer) {
+	defer conn.Close()
+	dec := gob.NewDecoder(bufio.NewReader(conn))
+	w := bufio.NewWriter(conn)
+	enc := gob.NewEncoder(w)
+	var writeMu sync.Mutex
+
+	for {
+		var req binaryRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				fmt.Printf("⚠️ Closing binary peer connection from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		go func() {
+			resp := handleBinary(peer, req)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(binaryTransferTimeout))
+			if err := enc.Encode(&resp); err == nil {
+				w.Flush()
+			}
+		}()
+	}
+}
+
+// handleBinary runs one request against peer.
+func handleBinary(peer Peer, req binaryRequest) binaryResponse {
+	resp := binaryResponse{ID: req.ID}
+	var err error
+	switch req.Method {
+	case binaryAppendEntries:
+		resp.AppendEntries = peer.HandleAppendEntries(req.AppendEntries)
+	case binaryRequestVote:
+		resp.RequestVote = peer.HandleRequestVote(req.RequestVote)
+	case binarySetLeader:
+		if !peer.HandleSetLeader(req.Leader, req.Term) {
+			err = fmt.Errorf("stale term %d", req.Term)
+		}
+	case binaryPropose:
+		resp.Index, resp.Committed, err = peer.HandlePropose(req.Entry)
+	case binaryReadIndex:
+		resp.Index, err = peer.HandleReadIndex(req.Lease)
+	case binaryLogStatus:
+		resp.LogStatus = peer.GetLogStatus()
+	case binaryLogEntries:
+		resp.Batch, err = peer.EntriesFrom(req.From)
+	case binaryLeader:
+		resp.Leader = peer.CurrentLeader()
+	case binaryPing:
+	case binaryStatus:
+		resp.Status = peer.GetNodeStatus()
+	case binaryWeights:
+		resp.Weights = peer.GetCabinetWeights()
+	default:
+		err = fmt.Errorf("unknown binary rpc %d", req.Method)
+	}
+
+	switch err {
+	case nil:
+	case ErrNotLeader:
+		resp.ErrCode = binaryErrNotLeader
+	case ErrSnapshotRequired:
+		resp.ErrCode = binaryErrSnapshotRequired
+	case ErrProposalInDoubt:
+		resp.ErrCode = binaryErrProposalInDoubt
+	default:
+		resp.Err = err.Error()
+	}
+	return resp
+}
@@ -0,0 +1,176 @@
+package consensus
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotCatchupThreshold is how far behind the leader's commit index a follower may fall
+// before it pulls a full snapshot instead of replaying the missing entries.
+const snapshotCatchupThreshold = 1000
+
+// StateMachine is the application driven by the replicated log.
+type StateMachine interface {
+	// WriteSnapshot streams the applied state to w and returns the last index it reflects.
+	WriteSnapshot(w io.Writer) (uint64, error)
+}
+
+// ApplyMsg is handed to the state machine in log order. It carries either one committed
+// entry or, when Snapshot is set, a snapshot that replaces all state up to its index.
+type ApplyMsg struct {
+	Entry    LogEntry
+	Snapshot *Snapshot
+}
+
+// LogStatus describes how far a node's log has progressed.
+type LogStatus struct {
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"`
+	FirstIndex  uint64 `json:"firstIndex"`
+	LastIndex   uint64 `json:"lastIndex"`
+	CommitIndex uint64 `json:"commitIndex"`
+}
+
+// ErrSnapshotRequired means the requested entries are no longer in the leader's log.
+var ErrSnapshotRequired = fmt.Errorf("entries compacted, snapshot required")
+
+// GetLogStatus reports this node's term and log positions.
+func (c *Consensus) GetLogStatus() LogStatus {
+	return LogStatus{
+		Term:        c.State.GetTerm(),
+		Leader:      c.State.GetLeader(),
+		FirstIndex:  c.log.FirstIndex(),
+		LastIndex:   c.log.LastIndex(),
+		CommitIndex: c.CommitIndex(),
+	}
+}
+
+// IsCatchingUp reports whether this node is still pulling entries it missed.
+func (c *Consensus) IsCatchingUp() bool {
+	return c.catchingUp.Load()
+}
+
+// EntriesFrom builds the append-entries batch a lagging follower needs, starting at from.
+// Followers apply it exactly as if the leader had pushed it.
+func (c *Consensus) EntriesFrom(from uint64) (AppendEntriesRequest, error) {
+	if !c.State.IsLeader() {
+		return AppendEntriesRequest{}, fmt.Errorf("not leader")
+	}
+	if from < c.log.FirstIndex() {
+		return AppendEntriesRequest{}, ErrSnapshotRequired
+	}
+	prevTerm, ok := c.log.Term(from - 1)
+	if !ok {
+		return AppendEntriesRequest{}, ErrSnapshotRequired
+	}
+	return AppendEntriesRequest{
+		Term:         c.State.GetTerm(),
+		LeaderID:     c.State.GetMyAddress(),
+		PrevLogIndex: from - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      c.log.Entries(from, c.log.LastIndex(), maxEntriesPerAppend),
+		LeaderCommit: c.CommitIndex(),
+	}, nil
+}
+
+// startCatchUp launches the catch-up loop unless one is already running.
+func (c *Consensus) startCatchUp() {
+	if c.catchingUp.CompareAndSwap(false, true) {
+		go c.catchUp()
+	}
+}
+
+// catchUp pulls whatever this node missed while it was down or partitioned, from the
+// leader's log or, if it is too far behind, a full snapshot. Until it finishes, this
+// node's acknowledgements do not count towards a proposal's quorum.
+func (c *Consensus) catchUp() {
+	defer c.catchingUp.Store(false)
+	fmt.Println("🧗 Catching up with the leader before voting on proposals...")
+
+	for {
+		if c.State.IsLeader() {
+			return
+		}
+
+		leader := c.State.GetLeader()
+		if leader == "" {
+			leader = c.discoverLeader()
+		}
+		if leader == "" {
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		status, err := c.transport.LogStatus(leader)
+		if err != nil {
+			fmt.Printf("⚠️ Catch-up: could not read log status from %s: %v\n", leader, err)
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		if status.Term > c.State.GetTerm() {
+			c.State.SetTerm(status.Term)
+		}
+
+		lastIndex := c.log.LastIndex()
+		if lastIndex >= status.CommitIndex {
+			// Wait for the state machine to apply what we pulled.
+			if c.deliveredIndex() >= status.CommitIndex {
+				fmt.Printf("🏁 Caught up with %s at index %d\n", leader, status.CommitIndex)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		fmt.Printf("📉 %d entries behind %s (have %d, leader committed %d)\n", status.CommitIndex-lastIndex, leader, lastIndex, status.CommitIndex)
+		if status.CommitIndex-lastIndex > snapshotCatchupThreshold || lastIndex+1 < status.FirstIndex {
+			if err := c.pullSnapshot(leader); err != nil {
+				fmt.Printf("⚠️ Catch-up: snapshot from %s failed: %v\n", leader, err)
+				time.Sleep(500 * time.Millisecond)
+			}
+			continue
+		}
+
+		if err := c.pullEntries(leader, lastIndex+1); err != nil {
+			fmt.Printf("⚠️ Catch-up: pulling entries from %s failed: %v\n", leader, err)
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+}
+
+// pullEntries fetches a batch of entries starting at from and appends them through the
+// normal append-entries path, backing up if our log diverged from the leader's.
+func (c *Consensus) pullEntries(leader string, from uint64) error {
+	for from > 0 {
+		batch, err := c.transport.LogEntries(leader, from)
+		if err == ErrSnapshotRequired {
+			return c.pullSnapshot(leader)
+		}
+		if err != nil {
+			return err
+		}
+
+		result := c.HandleAppendEntries(batch)
+		if result.Success {
+			return nil
+		}
+		if result.Term > batch.Term {
+			return fmt.Errorf("%s is no longer leader", leader)
+		}
+		// Our log diverged; step back to the follower's hint and try again.
+		next := result.LastLogIndex + 1
+		if next >= from {
+			next = from - 1
+		}
+		from = next
+	}
+	return fmt.Errorf("could not find a common log prefix with %s", leader)
+}
+
+// deliveredIndex returns the last index handed to the state machine.
+func (c *Consensus) deliveredIndex() uint64 {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+	return c.lastDelivered
+}
@@ -1,14 +1,11 @@
 package consensus
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"math"
-	"net/http"
-	"sort"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,218 +16,202 @@ type Consensus struct {
 	State         *ServerState
 	prioMgr       *PriorityManager
 	nodes         []string
-	httpClient    *http.Client
+	transport     Transport
 	nodeAlive     map[string]bool
 	failureCount  map[string]int
 	aliveStatusMu sync.RWMutex
+
+	// Replicated log and per-follower replication progress, guarded by replMu.
+	log           *ReplicatedLog
+	replMu        sync.Mutex
+	commitIndex   uint64
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	lastDelivered uint64
+	commitNotify  chan struct{}
+	applyCh       chan ApplyMsg
+
+	// Catch-up state for a follower that restarted or rejoined.
+	stateMachine    StateMachine
+	catchingUp      atomic.Bool
+	pendingSnapshot *Snapshot
+
+	// Snapshots of the state machine, used to compact the log and seed lagging followers.
+	snapshots       *SnapshotStore
+	snapshotMu      sync.Mutex
+	sendingSnapshot map[string]bool
+
+	// Read freshness: when the leader last confirmed a weighted quorum, and when a
+	// follower last heard the leader's commit index (contactCommit, guarded by replMu).
+	leaseMu         sync.Mutex
+	leaseStart      time.Time
+	leaseDuration   time.Duration
+	leaseClockDrift time.Duration
+	leaderContact   time.Time
+	contactCommit   uint64
+
+	// Cabinet weights and the threshold a weighted quorum must reach, computed by the
+	// leader after each round and shared with followers. Guarded by weightsMu.
+	weightsMu sync.RWMutex
+	weights   map[string]float64
+	threshold float64
+
+	// Proposal batching and pipelining, see runProposer.
+	proposeCh     chan proposal
+	pipelineMu    sync.Mutex
+	batchWindow   time.Duration
+	pipelineSlots chan struct{}
+}
+
+// NewConsensus initializes consensus with PriorityManager and opens the replicated log in dataDir.
+// Peers are reached over HTTP.
+func NewConsensus(myAddress string, nodes []string, mode string, dataDir string) (*Consensus, error) {
+	return NewConsensusWithTransport(myAddress, nodes, mode, dataDir, NewHTTPTransport())
 }
 
-// NewConsensus initializes consensus with PriorityManager.
-func NewConsensus(myAddress string, nodes []string, mode string) *Consensus {
+// NewConsensusWithTransport is NewConsensus with the given transport for peer RPCs.
+func NewConsensusWithTransport(myAddress string, nodes []string, mode string, dataDir string, transport Transport) (*Consensus, error) {
+	replLog, err := OpenReplicatedLog(filepath.Join(dataDir, "consensus.log"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := OpenSnapshotStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
 	serverState := NewServerState(myAddress)
 	priorityManager := &PriorityManager{}
 	priorityManager.Init(len(nodes), (len(nodes)/2)+1, 1, 0.01, true)
-	if CabinetWeights == nil {
-		CabinetWeights = make(map[string]float64)
-	}
 	cons := &Consensus{
 		Mode:          mode,
 		State:         serverState,
 		prioMgr:       priorityManager,
 		nodes:         nodes,
-		httpClient:    &http.Client{Timeout: 1 * time.Second},
+		transport:     transport,
 		nodeAlive:     make(map[string]bool),
 		failureCount:  make(map[string]int),
 		aliveStatusMu: sync.RWMutex{},
+		log:           replLog,
+		nextIndex:     make(map[string]uint64),
+		matchIndex:    make(map[string]uint64),
+		commitNotify:  make(chan struct{}, 1),
+		// Buffered so entries committed together reach the state machine together.
+		applyCh:         make(chan ApplyMsg, maxEntriesPerAppend),
+		snapshots:       snapshots,
+		sendingSnapshot: make(map[string]bool),
+		leaseDuration:   defaultLeaseDuration,
+		leaseClockDrift: defaultLeaseClockDrift,
+		proposeCh:       make(chan proposal),
+		batchWindow:     defaultProposalBatchWindow,
+		pipelineSlots:   make(chan struct{}, defaultPipelineDepth),
+		weights:         make(map[string]float64),
+	}
+	if latest := snapshots.Latest(); latest != nil && len(latest.Weights) > 0 {
+		cons.setCabinetWeights(latest.Weights, latest.Threshold)
 	}
 
 	fmt.Println("Nodes in consensus:", nodes)
 
-	// Start heartbeat monitor only if follower
+	if err := serverState.LoadPersistentState(filepath.Join(dataDir, "election.json")); err != nil {
+		return nil, err
+	}
+	// Never fall behind a term our log has already seen, even if the election state was lost.
+	serverState.SetTerm(replLog.LastTerm())
+
+	// The bootstrap node leads a brand-new cluster; after that, leaders are only elected.
+	if serverState.IsLeader() {
+		serverState.SetLeader("")
+		if serverState.GetTerm() == 0 {
+			term, err := serverState.BecomeCandidate()
+			if err != nil {
+				return nil, fmt.Errorf("failed to persist bootstrap term: %v", err)
+			}
+			serverState.BecomeLeader(term)
+			cons.resetReplicationProgress()
+		} else {
+			fmt.Printf("🔹 Rejoining at term %d as a follower; waiting for an elected leader.\n", serverState.GetTerm())
+		}
+	}
+
+	// Start heartbeat monitor only if follower, and pull anything missed while down
 	if !cons.State.IsLeader() {
+		serverState.UpdateHeartbeat()
 		go cons.monitorHeartbeat()
-
+		cons.startCatchUp()
 	}
+	go cons.runProposer()
 
-	return cons
+	return cons, nil
 }
 
-// ProposeChange handles consensus for both Cabinet and Cabinet++ modes.
-func (c *Consensus) ProposeChange(opType, key, value string) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// ErrProposalInDoubt means a proposal reached the log but did not commit in its round. It
+// may still commit later, so the caller must not assume it failed.
+var ErrProposalInDoubt = fmt.Errorf("proposal outcome unknown: not committed yet, but it may still commit")
 
-	fmt.Printf("🔍 Checking consensus for %s: key=%s, value=%s\n", opType, key, value)
-	fmt.Printf("ℹ️ Initiating proposal from: %s\n", c.State.GetMyAddress())
+// ProposeChange appends an operation to the replicated log and waits for a weighted quorum
+// of followers to hold it. It returns the entry's log index once the entry is committed.
+// In Cabinet++ mode followers forward the proposal so the leader alone orders the log.
+func (c *Consensus) ProposeChange(opType, key, value string) (uint64, error) {
+	return c.Propose(LogEntry{OpType: opType, Key: key, Value: value})
+}
 
-	type responderInfo struct {
-		node     string
-		duration time.Duration
+// Propose is ProposeChange for an arbitrary operation; its Index and Term are assigned by
+// the proposer, which batches and pipelines concurrent proposals (see runProposer).
+func (c *Consensus) Propose(op LogEntry) (uint64, error) {
+	if !c.State.IsLeader() && c.Mode == "cabinet++" {
+		return c.forwardProposal(op)
 	}
 
-	proposer := c.State.GetMyAddress()
-	fullAddr := serverIDFromAddress(proposer) + ":" + portFromAddress(proposer)
-
-	c.aliveStatusMu.RLock()
-	isAlive := c.nodeAlive[fullAddr]
-	c.aliveStatusMu.RUnlock()
-
-	approvalWeight := 0.0
-	var responders []responderInfo
-	var mu sync.Mutex
-	var wg sync.WaitGroup
+	fmt.Printf("🔍 Checking consensus for %s: key=%s, value=%s\n", op.OpType, op.Key, op.Value)
+	p := proposal{entry: op, done: make(chan proposalResult, 1)}
+	c.proposeCh <- p
+	result := <-p.done
+	return result.index, result.err
+}
 
-	// ✅ Leader-only for Cabinet mode
-	if c.Mode == "cabinet" && !c.State.IsLeader() {
-		fmt.Println("❌ Non-leader tried to propose in Cabinet mode")
-		return false
+// forwardProposal hands a Cabinet++ proposal to the leader and then refreshes our view of
+// node liveness and weights, which the leader recalculated for this round.
+func (c *Consensus) forwardProposal(op LogEntry) (uint64, error) {
+	leader := c.State.GetLeader()
+	if leader == "" {
+		fmt.Println("❌ Cannot forward proposal: leader unknown")
+		return 0, fmt.Errorf("leader unknown")
 	}
 
-	// ✅ Count proposer vote if alive
-	if isAlive {
-		if w, ok := CabinetWeights[fullAddr]; ok {
-			approvalWeight += w
-			responders = append(responders, responderInfo{node: fullAddr, duration: 0})
-			fmt.Printf("✅ Proposer %s is alive with weight %.2f\n", fullAddr, w)
-		} else {
-			fmt.Printf("⚠️ Proposer %s is alive but has no Cabinet weight entry\n", fullAddr)
-		}
+	fmt.Printf("🔀 Forwarding %s proposal for key=%s to leader %s\n", op.OpType, op.Key, leader)
+	index, committed, err := c.transport.Propose(leader, op)
+	if err == ErrNotLeader {
+		return 0, err
 	}
-
-	// 📣 Parallelized approval requests
-	for _, node := range c.nodes {
-		if node == proposer {
-			continue
-		}
-
-		wg.Add(1)
-		go func(node string) {
-			defer wg.Done()
-
-			id := serverIDFromAddress(node)
-			port := portFromAddress(node)
-			fullAddr := id + ":" + port
-
-			c.aliveStatusMu.RLock()
-			if !c.nodeAlive[fullAddr] {
-				fmt.Printf("⚠️ Skipping dead node %s during proposal\n", fullAddr)
-				c.aliveStatusMu.RUnlock()
-				return
-			}
-			c.aliveStatusMu.RUnlock()
-
-			start := time.Now()
-			approved := c.requestApproval(node, opType, key, value)
-			elapsed := time.Since(start)
-
-			if approved {
-				sid := c.getServerIDFromAddress(node)
-				if sid == -1 {
-					fmt.Printf("⚠️ Unknown node %s, skipping\n", node)
-					return
-				}
-				w := c.prioMgr.GetNodeWeight(sid)
-
-				mu.Lock()
-				approvalWeight += w
-				responders = append(responders, responderInfo{node: fullAddr, duration: elapsed})
-				mu.Unlock()
-
-				fmt.Printf("✅ %s approved with weight %.2f\n", fullAddr, w)
-			} else {
-				fmt.Printf("🔹 Approval from %s: false\n", node)
-			}
-		}(node)
+	// Any other failure, a timeout included, may have come after the leader appended it.
+	if err != nil {
+		fmt.Printf("❌ Forwarding proposal to %s failed: %v\n", leader, err)
+		return 0, ErrProposalInDoubt
 	}
-
-	wg.Wait()
-
-	fmt.Println("📦 CabinetWeights at time of proposal:")
-	for node, weight := range CabinetWeights {
-		fmt.Printf("🔸 %s → %.2f\n", node, weight)
+	if !committed {
+		fmt.Printf("❌ Leader %s did not commit forwarded proposal\n", leader)
+		return 0, fmt.Errorf("leader %s did not commit the proposal", leader)
 	}
-	fmt.Printf("🧮 Final approvalWeight = %.2f, required = %.2f\n", approvalWeight, CabinetThreshold)
-
-	// ✅ If quorum met, commit change
-	if approvalWeight >= CabinetThreshold {
-		fmt.Println("✅ Consensus REACHED. Committing change.")
-		c.commitChange(opType, key, value)
-
-		// ⚡ Sort responders by responsiveness (fastest first)
-		sort.Slice(responders, func(i, j int) bool {
-			return responders[i].duration < responders[j].duration
-		})
-
-		var ordered []string
-		for _, r := range responders {
-			ordered = append(ordered, r.node)
-		}
-
-		// 🔁 Update Cabinet Weights in both modes (Cabinet & Cabinet++)
-		if !isDummyKey(key) {
-			if c.Mode == "cabinet++" && !c.State.IsLeader() {
-				leader := c.State.GetLeader()
-				if leader != "" {
-					c.SyncNodeAliveAndWeightsFromLeader(leader)
-
-					// 🔄 Wait until enough nodes are alive (at least 3)
-					maxWait := 2 * time.Second
-					checkInterval := 100 * time.Millisecond
-					waited := time.Duration(0)
-
-					for waited < maxWait {
-						c.aliveStatusMu.RLock()
-						aliveCount := 0
-						for _, alive := range c.nodeAlive {
-							if alive {
-								aliveCount++
-							}
-						}
-						c.aliveStatusMu.RUnlock()
-
-						if aliveCount >= 3 {
-							break
-						}
-						time.Sleep(checkInterval)
-						waited += checkInterval
-					}
-				}
-			}
-			c.UpdateCabinetWeights(ordered)
 
-			// 📦 Log new weights
-			fmt.Println("📦 CabinetWeights AFTER update:")
-			for node, weight := range CabinetWeights {
-				fmt.Printf("🔸 %s → %.2f\n", node, weight)
-			}
-		}
-		return true
+	if !isDummyKey(op.Key) {
+		c.SyncNodeAliveAndWeightsFromLeader(leader)
 	}
-
-	fmt.Println("❌ Consensus NOT REACHED. Rejecting request.")
-	return false
+	return index, nil
 }
 
 func (c *Consensus) SyncNodeAliveAndWeightsFromLeader(leader string) {
-	resp, err := c.httpClient.Get("http://" + leader + "/api/status")
-	if err == nil && resp.StatusCode == http.StatusOK {
-		defer resp.Body.Close()
-		var status map[string]bool
-		if err := json.NewDecoder(resp.Body).Decode(&status); err == nil {
-			c.aliveStatusMu.Lock()
-			for k, v := range status {
-				c.nodeAlive[k] = v
-			}
-			c.aliveStatusMu.Unlock()
+	if status, err := c.transport.Status(leader); err == nil {
+		c.aliveStatusMu.Lock()
+		for k, v := range status {
+			c.nodeAlive[k] = v
 		}
+		c.aliveStatusMu.Unlock()
 	}
-	resp2, err2 := c.httpClient.Get("http://" + leader + "/api/weights")
-	if err2 == nil && resp2.StatusCode == http.StatusOK {
-		defer resp2.Body.Close()
-		var weights map[string]float64
-		if err := json.NewDecoder(resp2.Body).Decode(&weights); err == nil {
-			CabinetWeights = weights
-		}
+	if weights, err := c.transport.Weights(leader); err == nil {
+		c.weightsMu.Lock()
+		c.weights = weights
+		c.weightsMu.Unlock()
 	}
 }
 
@@ -261,252 +242,54 @@ func (c *Consensus) getServerIDFromAddress(addr string) serverID {
 	return -1 // invalid or not found
 }
 
-// requestApproval asks followers for approval.
-func (c *Consensus) requestApproval(node, opType, key, value string) bool {
-	reqBody, _ := json.Marshal(map[string]string{
-		"opType": opType,
-		"key":    key,
-		"value":  value,
-	})
-
-	url := fmt.Sprintf("http://%s/api/approve", node)
-	fmt.Printf("🔹 Sending approval request to %s for key=%s\n", url, key)
+// commitChange marks the log committed through index and pushes the new commit index to followers.
+func (c *Consensus) commitChange(index uint64) {
+	c.replMu.Lock()
+	c.setCommitIndexLocked(index)
+	c.replMu.Unlock()
+	fmt.Printf("Consensus reached: committed through index %d\n", index)
 
-	resp, err := c.httpClient.Post(url, "application/json", bytes.NewReader(reqBody))
-	if err != nil {
-		fmt.Printf("Approval request to %s failed: %v\n", url, err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Approval request to %s rejected with status %d\n", url, resp.StatusCode)
-		return false
-	}
-
-	fmt.Printf("Approval granted by %s for key=%s\n", node, key)
-	return true
-}
-
-// commitChange applies the agreed change and followers replicate.
-func (c *Consensus) commitChange(opType, key, value string) {
-	fmt.Printf("Consensus reached: %s %s = %s\n", opType, key, value)
-
-	// Replicate to all followers
 	for _, node := range c.nodes {
 		if node == c.State.GetMyAddress() {
 			continue // skip self
 		}
 
 		go func(target string) {
-			payload := map[string]string{
-				"opType": opType,
-				"key":    key,
-				"value":  value,
-			}
-			data, _ := json.Marshal(payload)
-			_, err := c.httpClient.Post("http://"+target+"/api/replicate", "application/json", bytes.NewReader(data))
-			if err != nil {
-				fmt.Printf("❌ Failed to replicate to %s: %v\n", target, err)
-			} else {
-				fmt.Printf("✅ Replicated to %s\n", target)
+			if _, err := c.replicateTo(target, 1); err != nil {
+				fmt.Printf("❌ Failed to send commit index to %s: %v\n", target, err)
 			}
 		}(node)
 	}
 }
 
-// HandleApproval allows followers to approve leader proposals.
-func (c *Consensus) HandleApproval(w http.ResponseWriter, r *http.Request) {
-	if !c.State.IsFollower() {
-		http.Error(w, "Only followers can approve", http.StatusForbidden)
-		fmt.Println("Leader cannot approve its own requests.")
-		return
-	}
-
-	var req map[string]string
-	json.NewDecoder(r.Body).Decode(&req)
-	opType := req["opType"]
-	key := req["key"]
-	value := req["value"]
-
-	fmt.Printf("Approval granted: %s %s = %s\n", opType, key, value)
-	w.WriteHeader(http.StatusOK)
-}
-
-func (c *Consensus) monitorHeartbeat() {
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		if !c.State.IsFollower() {
-			fmt.Println("🛑 Not a follower anymore. Stopping heartbeat monitor.")
-			return
-		}
-
-		leader := c.State.GetLeader()
-		if leader == "" {
-			// Try asking other nodes who the current leader is
-			for _, node := range c.nodes {
-				if node == c.State.GetMyAddress() {
-					continue
-				}
-				resp, err := c.httpClient.Get("http://" + node + "/api/leader")
-				if err == nil && resp.StatusCode == http.StatusOK {
-					var payload map[string]string
-					if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil {
-						testLeader := payload["leader"]
-						if testLeader != "" {
-							// Verify the leader is reachable
-							testResp, err := c.httpClient.Get("http://" + testLeader + "/api/heartbeat")
-							if err == nil && testResp.StatusCode == http.StatusOK {
-								leader = testLeader
-								c.State.SetLeader(leader)
-								fmt.Printf("📡 Learned and verified leader from %s: %s\n", node, leader)
-								break
-							} else {
-								fmt.Printf("⚠️ Ignored stale leader report from %s: %s is unreachable\n", node, testLeader)
-							}
-						}
-					}
-				}
-			}
-
-			if leader == "" {
-				fmt.Println("🤷 Could not determine leader. Skipping this heartbeat check.")
-				continue
-			}
-		}
-
-		fmt.Printf("⏱️ Checking heartbeat from leader %s...\n", leader)
-		resp, err := c.httpClient.Get("http://" + leader + "/api/heartbeat")
-
-		id := serverIDFromAddress(leader)
-		port := portFromAddress(leader)
-		fullAddr := id + ":" + port
-
-		c.aliveStatusMu.Lock()
-		if err == nil && resp.StatusCode == http.StatusOK {
-			c.State.UpdateHeartbeat()
-			c.failureCount[fullAddr] = 0
-			c.nodeAlive[fullAddr] = true
-			fmt.Println("✅ Heartbeat received from leader.")
-			c.aliveStatusMu.Unlock()
-			continue
-		}
-
-		// Increase failure count
-		c.failureCount[fullAddr]++
-		if c.failureCount[fullAddr] >= 2 {
-			c.nodeAlive[fullAddr] = false
-			fmt.Printf("❌ Leader %s marked dead after %d failures.\n", fullAddr, c.failureCount[fullAddr])
-			c.State.SetLeader("")
-			c.aliveStatusMu.Unlock()
-			fmt.Println("🚨 Leader is unresponsive! Starting election...")
-			c.startElection()
-			return
-		}
-		c.aliveStatusMu.Unlock()
-
-		fmt.Printf("❌ Heartbeat to leader failed (%d fails): %v\n", c.failureCount[fullAddr], err)
-	}
-}
-
-func (c *Consensus) startElection() {
-	fmt.Println("🗳️ Starting election process...")
-
-	myAddr := c.State.GetMyAddress()
-	myWeight := c.GetNodeWeight(myAddr)
-	highestWeight := myWeight
-	isLeader := true
-
-	// Collect other nodes' weights
+// discoverLeader asks the other nodes who the leader is and returns the first
+// reported leader that answers a heartbeat, or "" if none does.
+func (c *Consensus) discoverLeader() string {
 	for _, node := range c.nodes {
-		if node == myAddr {
-			continue
-		}
-
-		resp, err := c.httpClient.Get("http://" + node + "/api/priority")
-		if err != nil || resp.StatusCode != http.StatusOK {
-			continue
-		}
-		defer resp.Body.Close()
-
-		var weight float64
-		if err := json.NewDecoder(resp.Body).Decode(&weight); err != nil {
+		if node == c.State.GetMyAddress() {
 			continue
 		}
-
-		if weight > highestWeight {
-			isLeader = false
-			break
-		}
-	}
-
-	// Before declaring leadership, check again if someone already won
-	for _, node := range c.nodes {
-		if node == myAddr {
+		testLeader, err := c.transport.Leader(node)
+		if err != nil || testLeader == "" {
 			continue
 		}
-
-		resp, err := c.httpClient.Get("http://" + node + "/api/leader")
-		if err == nil && resp.StatusCode == http.StatusOK {
-			defer resp.Body.Close()
-			var payload map[string]string
-			if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil {
-				declaredLeader := payload["leader"]
-				if declaredLeader != "" && declaredLeader != myAddr {
-					// Check if the declared leader is actually alive
-					hbResp, err := c.httpClient.Get("http://" + declaredLeader + "/api/heartbeat")
-					if err == nil && hbResp.StatusCode == http.StatusOK {
-						fmt.Printf("🤷 Election aborted. %s is already leader and alive.\n", declaredLeader)
-						c.State.SetLeader(declaredLeader)
-						return
-					}
-
-					fmt.Printf("❌ Declared leader %s is unreachable. Proceeding with election...\n", declaredLeader)
-				}
-
-			}
+		// Verify the leader is reachable
+		if err := c.transport.Ping(testLeader); err == nil {
+			fmt.Printf("📡 Learned and verified leader from %s: %s\n", node, testLeader)
+			return testLeader
 		}
+		fmt.Printf("⚠️ Ignored stale leader report from %s: %s is unreachable\n", node, testLeader)
 	}
-
-	if isLeader {
-		fmt.Printf("👑 %s becomes the new leader!\n", myAddr)
-		c.State.SetLeader(myAddr)
-		go c.StartHeartbeatBroadcast()
-
-		// Inform others
-		for _, node := range c.nodes {
-			if node == myAddr {
-				continue
-			}
-			go func(n string) {
-				payload := map[string]string{"leader": myAddr}
-				data, _ := json.Marshal(payload)
-				_, err := c.httpClient.Post("http://"+n+"/api/set-leader", "application/json", bytes.NewReader(data))
-				if err != nil {
-					fmt.Printf("❌ Failed to inform %s about new leader: %v\n", n, err)
-				}
-			}(node)
-		}
-		// ✅ Auto-trigger dummy write to recalculate CabinetWeights
-		go func() {
-			time.Sleep(300 * time.Millisecond) // optional small delay
-			fmt.Println("📊 Triggering dummy write to refresh CabinetWeights")
-			c.ProposeChange("put", "__cabinet_dummy__", fmt.Sprintf("refresh-%d", time.Now().UnixNano()))
-
-		}()
-	} else {
-		fmt.Println("🙅 This node did not win the election.")
-		go c.monitorHeartbeat()
-	}
+	return ""
 }
+
 func (c *Consensus) StartHeartbeatBroadcast() {
 	fmt.Println("📡 Starting heartbeat broadcast loop...")
 	fmt.Printf("🔥 Broadcasting heartbeat from Consensus instance: %p\n", c)
 
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
+	leadingSince := time.Now()
 
 	for range ticker.C {
 		if !c.State.IsLeader() {
@@ -514,6 +297,17 @@ func (c *Consensus) StartHeartbeatBroadcast() {
 			return
 		}
 
+		// A leader that has not heard from a weighted quorum for a whole lease may
+		// already have been replaced; stop acting as leader.
+		term := c.State.GetTerm()
+		if time.Since(leadingSince) > c.leaseDuration && !c.LeaseValid() {
+			fmt.Printf("⌛ Leader lease expired: no weighted quorum for %v. Stepping down.\n", c.leaseDuration)
+			if c.State.StepDown(term) {
+				go c.monitorHeartbeat()
+			}
+			return
+		}
+
 		// ✅ Mark the leader itself as alive
 		leaderAddr := c.State.GetMyAddress()
 		id := serverIDFromAddress(leaderAddr)
@@ -525,6 +319,16 @@ func (c *Consensus) StartHeartbeatBroadcast() {
 		fmt.Printf("🧠 Updated nodeAlive[%s] = true. Current map: %+v\n", fullAddr, c.nodeAlive)
 		c.aliveStatusMu.Unlock()
 
+		// Renew the lease, from the start of this round, once a weighted quorum acks it.
+		tickStart := time.Now()
+		weights, threshold := c.quorumWeights()
+		var ackMu sync.Mutex
+		ackWeight := weights[fullAddr]
+		renewed := ackWeight > threshold
+		if renewed {
+			c.renewLease(tickStart)
+		}
+
 		for _, node := range c.nodes {
 			if node == leaderAddr {
 				continue
@@ -533,8 +337,9 @@ func (c *Consensus) StartHeartbeatBroadcast() {
 			n := node // capture loop variable
 
 			go func(n string) {
-				url := "http://" + n + "/api/heartbeat"
-				resp, err := c.httpClient.Get(url)
+				// Heartbeats are empty append-entries, which also carry the commit index
+				// and any entries the follower is still missing.
+				_, err := c.replicateTo(n, 1)
 
 				id := serverIDFromAddress(n)
 				port := portFromAddress(n)
@@ -543,7 +348,7 @@ func (c *Consensus) StartHeartbeatBroadcast() {
 				c.aliveStatusMu.Lock()
 				defer c.aliveStatusMu.Unlock()
 
-				if err != nil || resp.StatusCode != http.StatusOK {
+				if err != nil {
 					c.failureCount[fullAddr]++
 					if c.failureCount[fullAddr] >= 3 {
 						c.nodeAlive[fullAddr] = false
@@ -552,10 +357,20 @@ func (c *Consensus) StartHeartbeatBroadcast() {
 					return
 				}
 
-				defer resp.Body.Close()
 				c.failureCount[fullAddr] = 0
 				c.nodeAlive[fullAddr] = true
 				fmt.Printf("✅ Heartbeat ACK from %s\n", fullAddr)
+
+				if c.State.GetTerm() != term || !c.State.IsLeader() {
+					return
+				}
+				ackMu.Lock()
+				ackWeight += weights[fullAddr]
+				if !renewed && ackWeight > threshold {
+					renewed = true
+					c.renewLease(tickStart)
+				}
+				ackMu.Unlock()
 			}(n)
 		}
 	}
@@ -581,73 +396,63 @@ func (c *Consensus) GetNodeWeight(addr string) float64 {
 	}
 	return 0
 }
+
+// UpdateCabinetWeights reassigns the Cabinet weights after a committed round. Every node
+// in the cluster keeps an entry: the priority scheme's weights go out in order to the
+// responders, fastest first, then to the nodes that did not answer, with dead nodes last
+// so they hold the smallest weights. Because every map hands out the same weights, no
+// floor(n/2) nodes ever hold half the total, and a quorum needs more than half of it.
 func (c *Consensus) UpdateCabinetWeights(responders []string) {
-	newWeights := make(map[string]float64)
-	totalWeight := 0.0
+	ranked := make([]string, 0, len(c.nodes))
+	seen := make(map[string]bool, len(c.nodes))
+	for _, addr := range responders {
+		if !seen[addr] {
+			seen[addr] = true
+			ranked = append(ranked, addr)
+		}
+	}
 
-	// 1. Determine alive nodes
+	var alive, dead []string
 	c.aliveStatusMu.RLock()
-	aliveNodes := make([]string, 0)
 	for _, node := range c.nodes {
-		id := serverIDFromAddress(node)
-		port := portFromAddress(node)
-		fullAddr := id + ":" + port
+		fullAddr := serverIDFromAddress(node) + ":" + portFromAddress(node)
+		if seen[fullAddr] {
+			continue
+		}
+		seen[fullAddr] = true
 		if c.nodeAlive[fullAddr] {
-			aliveNodes = append(aliveNodes, fullAddr)
+			alive = append(alive, fullAddr)
+		} else {
+			dead = append(dead, fullAddr)
 		}
 	}
 	c.aliveStatusMu.RUnlock()
+	ranked = append(append(ranked, alive...), dead...)
 
-	// 2. Assign descending weights to responders
-	r := 1.5
-	a := 1.0
-	n := len(responders)
-	for i, addr := range responders {
-		w := a * math.Pow(r, float64(n-1-i))
-		newWeights[addr] = w
-		totalWeight += w
-	}
-
-	// 3. Fallback: assign small weight to alive non-responders
-	baseWeight := 1.0
-	for _, addr := range aliveNodes {
-		if _, ok := newWeights[addr]; !ok {
-			newWeights[addr] = baseWeight
-			totalWeight += baseWeight
-		}
-	}
-
-	// 4. Normalize weights
-	for addr, weight := range newWeights {
-		newWeights[addr] = weight / totalWeight
+	// Normalize so the weights of all configured nodes sum to 1.
+	total := 0.0
+	for i := range ranked {
+		total += c.prioMgr.GetNodeWeight(serverID(i))
 	}
-
-	// Update global weights
-	CabinetWeights = newWeights
-
-	// Compute threshold as 51% of total weight of ALIVE nodes
-	aliveWeight := 0.0
-	const quorumRatio = 0.51
-	for _, addr := range aliveNodes {
-		if w, ok := newWeights[addr]; ok {
-			aliveWeight += w
-		}
-	}
-	fmt.Printf("📊 Total alive weight before thresholding: %.2f\n", aliveWeight)
-
-	if aliveWeight == 0 {
-		fmt.Println("⚠️ No alive nodes with valid weights — skipping CabinetThreshold update to avoid unsafe quorum.")
+	if total == 0 {
+		fmt.Println("⚠️ No priority weights for the configured nodes — keeping the current Cabinet weights.")
 		return
 	}
+	newWeights := make(map[string]float64, len(ranked))
+	for i, addr := range ranked {
+		newWeights[addr] = c.prioMgr.GetNodeWeight(serverID(i)) / total
+	}
 
-	CabinetThreshold = math.Max(quorumRatio*aliveWeight, 0.51)
-	fmt.Printf("📊 Total alive weight before thresholding: %.2f\n", aliveWeight)
+	c.weightsMu.Lock()
+	defer c.weightsMu.Unlock()
+	c.weights = newWeights
+	c.threshold = 0.5
 
 	fmt.Println("🔁 Updated Cabinet Weights (Normalized):")
-	for node, weight := range CabinetWeights {
+	for node, weight := range newWeights {
 		fmt.Printf("🔸 %s → %.2f\n", node, weight)
 	}
-	fmt.Printf("🎯 New CabinetThreshold = %.2f\n", CabinetThreshold)
+	fmt.Printf("🎯 New CabinetThreshold = %.2f\n", c.threshold)
 }
 
 func (c *Consensus) GetNodeStatus() map[string]bool {
@@ -664,12 +469,28 @@ func (c *Consensus) GetNodeStatus() map[string]bool {
 	return statusCopy
 }
 func (c *Consensus) GetCabinetWeights() map[string]float64 {
+	weights, _ := c.cabinetWeights()
+	return weights
+}
+
+// cabinetWeights returns a copy of the Cabinet weights and the current threshold.
+func (c *Consensus) cabinetWeights() (map[string]float64, float64) {
+	c.weightsMu.RLock()
+	defer c.weightsMu.RUnlock()
 	// Defensive copy to avoid exposing internal map
-	result := make(map[string]float64)
-	for k, v := range CabinetWeights {
+	result := make(map[string]float64, len(c.weights))
+	for k, v := range c.weights {
 		result[k] = v
 	}
-	return result
+	return result, c.threshold
+}
+
+// setCabinetWeights adopts weights and threshold shared by the leader or a snapshot.
+func (c *Consensus) setCabinetWeights(weights map[string]float64, threshold float64) {
+	c.weightsMu.Lock()
+	defer c.weightsMu.Unlock()
+	c.weights = weights
+	c.threshold = threshold
 }
 
 func (c *Consensus) GetAllNodes() []string {
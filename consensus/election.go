@@ -0,0 +1,262 @@
+package consensus
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A follower that hears nothing from a leader for its election timeout stands for
+// election. Timeouts run from electionTimeoutMin for the heaviest node to
+// electionTimeoutMax for a node with no weight, plus up to electionJitter so that nodes
+// of equal weight do not all become candidates at once.
+const (
+	electionTimeoutMin = 1500 * time.Millisecond
+	electionTimeoutMax = 3000 * time.Millisecond
+	electionJitter     = 300 * time.Millisecond
+)
+
+// RequestVoteRequest asks a node to vote for a candidate in a term.
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// RequestVoteResponse carries the voter's term and whether it granted its vote.
+type RequestVoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+// HandleRequestVote grants a vote to a candidate whose term is current and whose log is
+// at least as up to date as ours, at most once per term.
+func (c *Consensus) HandleRequestVote(req RequestVoteRequest) RequestVoteResponse {
+	// Hold replMu so the log cannot change between the up-to-date check and the vote.
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+
+	term := c.State.GetTerm()
+	if req.Term < term {
+		fmt.Printf("🙅 Refusing vote to %s: stale term %d < %d\n", req.CandidateID, req.Term, term)
+		return RequestVoteResponse{Term: term}
+	}
+
+	// While we still hear from a leader, ignore candidates: a node that was only cut off
+	// from us must not drag the whole cluster into a new term.
+	if leader := c.State.GetLeader(); leader != "" && leader != req.CandidateID {
+		if c.State.IsLeader() || !c.State.IsHeartbeatStale(electionTimeoutMin) {
+			fmt.Printf("🙅 Refusing vote to %s: leader %s is still active\n", req.CandidateID, leader)
+			return RequestVoteResponse{Term: term}
+		}
+	}
+
+	if req.Term > term {
+		c.State.SetTerm(req.Term)
+		c.State.SetLeader("")
+		term = req.Term
+	}
+
+	lastIndex, lastTerm := c.log.LastIndex(), c.log.LastTerm()
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < lastIndex) {
+		fmt.Printf("🙅 Refusing vote to %s: its log (%d@%d) is behind ours (%d@%d)\n",
+			req.CandidateID, req.LastLogIndex, req.LastLogTerm, lastIndex, lastTerm)
+		return RequestVoteResponse{Term: term}
+	}
+
+	if !c.State.Vote(term, req.CandidateID) {
+		fmt.Printf("🙅 Refusing vote to %s: already voted for %s in term %d\n", req.CandidateID, c.State.GetVotedFor(), term)
+		return RequestVoteResponse{Term: term}
+	}
+
+	// Granting a vote restarts our own election timer.
+	c.State.UpdateHeartbeat()
+	fmt.Printf("🗳️ Voted for %s in term %d\n", req.CandidateID, term)
+	return RequestVoteResponse{Term: term, VoteGranted: true}
+}
+
+// monitorHeartbeat waits for the leader to go quiet for an election timeout, then starts
+// an election. It returns once this node is leader or has started an election.
+func (c *Consensus) monitorHeartbeat() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	jitter := time.Duration(rand.Int63n(int64(electionJitter)))
+
+	for range ticker.C {
+		if !c.State.IsFollower() {
+			fmt.Println("🛑 Not a follower anymore. Stopping heartbeat monitor.")
+			return
+		}
+		// Weights move with every commit, so re-derive the timeout each time.
+		timeout := c.electionTimeout() + jitter
+		if !c.State.IsHeartbeatStale(timeout) {
+			continue
+		}
+
+		if leader := c.State.GetLeader(); leader != "" {
+			fullAddr := serverIDFromAddress(leader) + ":" + portFromAddress(leader)
+			c.aliveStatusMu.Lock()
+			c.nodeAlive[fullAddr] = false
+			c.aliveStatusMu.Unlock()
+			fmt.Printf("❌ No heartbeat from leader %s for %v; marked dead.\n", fullAddr, timeout)
+			c.State.SetLeader("")
+		}
+
+		fmt.Println("🚨 Leader is unresponsive! Starting election...")
+		go c.startElection()
+		return
+	}
+}
+
+// quorumWeights returns each node's weight in elections and leadership checks, and the
+// threshold a quorum must reach: the Cabinet weights last shared by the leader or, before
+// any were computed, the static priority weights with half their total as the threshold.
+func (c *Consensus) quorumWeights() (map[string]float64, float64) {
+	weights, threshold := c.cabinetWeights()
+	if len(weights) > 0 && threshold > 0 {
+		return weights, threshold
+	}
+
+	weights = make(map[string]float64)
+	total := 0.0
+	for _, node := range c.nodes {
+		w := c.GetNodeWeight(node)
+		weights[serverIDFromAddress(node)+":"+portFromAddress(node)] = w
+		total += w
+	}
+	return weights, total / 2
+}
+
+// electionTimeout scales this node's timeout, before jitter, with its weight, so heavier
+// (faster) nodes notice a dead leader first and tend to win the election.
+func (c *Consensus) electionTimeout() time.Duration {
+	weights, _ := c.quorumWeights()
+	myAddr := c.State.GetMyAddress()
+	mine := weights[serverIDFromAddress(myAddr)+":"+portFromAddress(myAddr)]
+
+	heaviest := 0.0
+	for _, w := range weights {
+		heaviest = math.Max(heaviest, w)
+	}
+	share := 0.0
+	if heaviest > 0 {
+		share = mine / heaviest
+	}
+
+	span := float64(electionTimeoutMax - electionTimeoutMin)
+	return electionTimeoutMin + time.Duration((1-share)*span)
+}
+
+// startElection opens a new term, votes for itself and asks every other node for its
+// vote. Collecting more vote weight than the Cabinet threshold makes this node leader;
+// otherwise it goes back to waiting.
+func (c *Consensus) startElection() {
+	myAddr := c.State.GetMyAddress()
+	term, err := c.State.BecomeCandidate()
+	if err != nil {
+		fmt.Printf("❌ Cannot stand for election, failed to persist term: %v\n", err)
+		go c.monitorHeartbeat()
+		return
+	}
+	fmt.Printf("🗳️ Starting election for term %d...\n", term)
+
+	req := RequestVoteRequest{
+		Term:         term,
+		CandidateID:  myAddr,
+		LastLogIndex: c.log.LastIndex(),
+		LastLogTerm:  c.log.LastTerm(),
+	}
+
+	weights, threshold := c.quorumWeights()
+	voteWeight := weights[serverIDFromAddress(myAddr)+":"+portFromAddress(myAddr)] // our own
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, node := range c.nodes {
+		if node == myAddr {
+			continue
+		}
+		wg.Add(1)
+		go func(n string) {
+			defer wg.Done()
+			resp, err := c.transport.RequestVote(n, req)
+			if err != nil {
+				fmt.Printf("❌ Vote request to %s failed: %v\n", n, err)
+				return
+			}
+			c.markAlive(n)
+			if resp.Term > term {
+				fmt.Printf("⚠️ %s is already in term %d\n", n, resp.Term)
+				c.State.SetTerm(resp.Term)
+				return
+			}
+			if resp.VoteGranted {
+				w := weights[serverIDFromAddress(n)+":"+portFromAddress(n)]
+				mu.Lock()
+				voteWeight += w
+				mu.Unlock()
+				fmt.Printf("✅ %s voted for us in term %d with weight %.2f\n", n, term, w)
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	fmt.Printf("🧮 Election for term %d: vote weight %.2f, required > %.2f\n", term, voteWeight, threshold)
+	if voteWeight <= threshold || !c.State.BecomeLeader(term) {
+		fmt.Println("🙅 This node did not win the election.")
+		go c.monitorHeartbeat()
+		return
+	}
+	c.becomeLeader(term)
+}
+
+// becomeLeader starts leading term: it resets replication progress, begins heartbeats,
+// tells the other nodes and commits an entry of its own term.
+func (c *Consensus) becomeLeader(term uint64) {
+	myAddr := c.State.GetMyAddress()
+	fmt.Printf("👑 %s becomes the new leader for term %d!\n", myAddr, term)
+	c.markAlive(myAddr)
+	c.resetReplicationProgress()
+	go c.StartHeartbeatBroadcast()
+
+	// Inform others
+	for _, node := range c.nodes {
+		if node == myAddr {
+			continue
+		}
+		go func(n string) {
+			if err := c.transport.SetLeader(n, myAddr, term); err != nil {
+				fmt.Printf("❌ Failed to inform %s about new leader: %v\n", n, err)
+			}
+		}(node)
+	}
+
+	// ✅ Auto-trigger dummy write to recalculate CabinetWeights. Committing an entry
+	// from our own term also commits anything earlier leaders left behind.
+	go func() {
+		time.Sleep(300 * time.Millisecond) // optional small delay
+		fmt.Println("📊 Triggering dummy write to refresh CabinetWeights")
+		c.ProposeChange("PUT", "__cabinet_dummy__", fmt.Sprintf("refresh-%d", time.Now().UnixNano()))
+	}()
+}
+
+// HandleSetLeader accepts a leader's announcement if its term is current.
+func (c *Consensus) HandleSetLeader(leader string, term uint64) bool {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+	_, ok := c.acceptLeader(term, leader)
+	return ok
+}
+
+// markAlive records that a node answered us.
+func (c *Consensus) markAlive(node string) {
+	fullAddr := serverIDFromAddress(node) + ":" + portFromAddress(node)
+	c.aliveStatusMu.Lock()
+	c.nodeAlive[fullAddr] = true
+	c.failureCount[fullAddr] = 0
+	c.aliveStatusMu.Unlock()
+}
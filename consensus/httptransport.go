@@ -0,0 +1,222 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPTransport sends peer RPCs as JSON over HTTP to the /api routes the kvstore server
+// registers.
+type HTTPTransport struct {
+	scheme string
+	// addrs maps nodes to the peer addresses they serve the internal routes on; see
+	// UsePeerAddresses.
+	addrs  map[string]string
+	client *http.Client
+	// transfer has a longer timeout: log batches and snapshots can take longer than a
+	// heartbeat to transfer.
+	transfer *http.Client
+}
+
+// NewHTTPTransport returns a transport with a one-second timeout for ordinary RPCs and
+// thirty seconds for log and snapshot transfers.
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{
+		scheme:   "http",
+		client:   &http.Client{Timeout: 1 * time.Second},
+		transfer: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// NewHTTPTransportWithTLS is NewHTTPTransport over HTTPS, presenting and verifying
+// certificates as cfg says.
+func NewHTTPTransportWithTLS(cfg *tls.Config) *HTTPTransport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	return &HTTPTransport{
+		scheme:   "https",
+		client:   &http.Client{Timeout: 1 * time.Second, Transport: tr},
+		transfer: &http.Client{Timeout: 30 * time.Second, Transport: tr},
+	}
+}
+
+// UsePeerAddresses sends each node's RPCs to addrs[node] instead of the node's own
+// address, for nodes that serve their internal routes on a separate peer listener. Call it
+// before the transport is used.
+func (t *HTTPTransport) UsePeerAddresses(addrs map[string]string) {
+	t.addrs = addrs
+}
+
+// url returns the address of path on node.
+func (t *HTTPTransport) url(node, path string) string {
+	if addr, ok := t.addrs[node]; ok {
+		node = addr
+	}
+	return t.scheme + "://" + node + path
+}
+
+// call sends a JSON request, or a GET if in is nil, and decodes the JSON reply into out.
+func (t *HTTPTransport) call(client *http.Client, node, path string, in, out interface{}) error {
+	var resp *http.Response
+	var err error
+	if in == nil {
+		resp, err = client.Get(t.url(node, path))
+	} else {
+		data, _ := json.Marshal(in)
+		resp, err = client.Post(t.url(node, path), "application/json", bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	name, _, _ := strings.Cut(strings.TrimPrefix(path, "/api/"), "?")
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s to %s returned status %d", name, node, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid %s response from %s: %v", name, node, err)
+	}
+	return nil
+}
+
+func (t *HTTPTransport) AppendEntries(node string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	var out AppendEntriesResponse
+	err := t.call(t.client, node, "/api/append-entries", req, &out)
+	return out, err
+}
+
+func (t *HTTPTransport) RequestVote(node string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	var out RequestVoteResponse
+	err := t.call(t.client, node, "/api/request-vote", req, &out)
+	return out, err
+}
+
+func (t *HTTPTransport) SetLeader(node, leader string, term uint64) error {
+	payload := map[string]interface{}{"leader": leader, "term": term}
+	return t.call(t.client, node, "/api/set-leader", payload, nil)
+}
+
+func (t *HTTPTransport) Propose(node string, op LogEntry) (uint64, bool, error) {
+	var result struct {
+		Index     uint64 `json:"index"`
+		Committed bool   `json:"committed"`
+		InDoubt   bool   `json:"inDoubt"`
+	}
+	err := t.call(t.client, node, "/api/propose", op, &result)
+	if err == nil && result.InDoubt {
+		err = ErrProposalInDoubt
+	}
+	return result.Index, result.Committed, err
+}
+
+func (t *HTTPTransport) ReadIndex(node string, lease bool) (uint64, error) {
+	path := "/api/read-index"
+	if lease {
+		path += "?lease=true"
+	}
+	var out struct {
+		ReadIndex uint64 `json:"readIndex"`
+	}
+	err := t.call(t.client, node, path, nil, &out)
+	return out.ReadIndex, err
+}
+
+func (t *HTTPTransport) LogStatus(node string) (LogStatus, error) {
+	var status LogStatus
+	err := t.call(t.client, node, "/api/log-status", nil, &status)
+	return status, err
+}
+
+func (t *HTTPTransport) LogEntries(node string, from uint64) (AppendEntriesRequest, error) {
+	var batch AppendEntriesRequest
+	resp, err := t.transfer.Get(t.url(node, "/api/log-entries?from="+strconv.FormatUint(from, 10)))
+	if err != nil {
+		return batch, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return batch, ErrSnapshotRequired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return batch, fmt.Errorf("log-entries returned status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return batch, fmt.Errorf("invalid log-entries response: %v", err)
+	}
+	return batch, nil
+}
+
+// InstallSnapshot posts the data as the request body, with the metadata in the
+// X-Install-Snapshot header.
+func (t *HTTPTransport) InstallSnapshot(node string, req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error) {
+	var out InstallSnapshotResponse
+	meta, _ := json.Marshal(req)
+	httpReq, err := http.NewRequest(http.MethodPost, t.url(node, "/api/install-snapshot"), data)
+	if err != nil {
+		return out, err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	httpReq.Header.Set("X-Install-Snapshot", string(meta))
+
+	resp, err := t.transfer.Do(httpReq)
+	if err != nil {
+		return out, err
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("install-snapshot to %s returned status %d", node, resp.StatusCode)
+	}
+	return out, nil
+}
+
+// FetchSnapshot reads the metadata from the X-Snapshot header and leaves the body as the
+// data.
+func (t *HTTPTransport) FetchSnapshot(node string) (*Snapshot, io.ReadCloser, error) {
+	resp, err := t.transfer.Get(t.url(node, "/api/snapshot"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("snapshot returned status %d", resp.StatusCode)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Snapshot")), &snap); err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("invalid snapshot metadata: %v", err)
+	}
+	return &snap, resp.Body, nil
+}
+
+func (t *HTTPTransport) Leader(node string) (string, error) {
+	var payload map[string]string
+	err := t.call(t.client, node, "/api/leader", nil, &payload)
+	return payload["leader"], err
+}
+
+func (t *HTTPTransport) Ping(node string) error {
+	return t.call(t.client, node, "/api/heartbeat", nil, nil)
+}
+
+func (t *HTTPTransport) Status(node string) (map[string]bool, error) {
+	var status map[string]bool
+	err := t.call(t.client, node, "/api/status", nil, &status)
+	return status, err
+}
+
+func (t *HTTPTransport) Weights(node string) (map[string]float64, error) {
+	var weights map[string]float64
+	err := t.call(t.client, node, "/api/weights", nil, &weights)
+	return weights, err
+}
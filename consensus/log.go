@@ -0,0 +1,259 @@
+package consensus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// LogEntry is a single replicated operation. Expected is the value a conditional
+// operation compares against when it is applied.
+type LogEntry struct {
+	Index    uint64 `json:"index"`
+	Term     uint64 `json:"term"`
+	OpType   string `json:"opType"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	// ExpiresAt is when a PUT's key expires, in Unix milliseconds; 0 means never.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Lease is the lease a PUT attaches its key to, or the lease a revoke removes.
+	Lease uint64 `json:"lease,omitempty"`
+}
+
+// baseOpType marks the placeholder entry at the head of the log. It records the index and
+// term of the last entry covered by a snapshot (0/0 for a log that was never reset).
+const baseOpType = "BASE"
+
+// ReplicatedLog is the append-only operation log, persisted as one JSON entry per line.
+// entries[0] is always the base placeholder, so entries[i].Index == base + i.
+type ReplicatedLog struct {
+	mu      sync.RWMutex
+	path    string
+	file    *os.File
+	entries []LogEntry
+}
+
+// OpenReplicatedLog loads the log at path, creating it if needed.
+func OpenReplicatedLog(path string) (*ReplicatedLog, error) {
+	l := &ReplicatedLog{path: path, entries: []LogEntry{{OpType: baseOpType}}}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		first := true
+		for scanner.Scan() {
+			var e LogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A torn write at the tail is dropped; the leader will resend it.
+				fmt.Printf("⚠️ Dropping unreadable log tail after index %d: %v\n", l.lastIndexLocked(), err)
+				break
+			}
+			if first && e.OpType == baseOpType {
+				l.entries[0] = e
+				first = false
+				continue
+			}
+			first = false
+			if e.Index != l.lastIndexLocked()+1 {
+				f.Close()
+				return nil, fmt.Errorf("log entry out of order: got index %d, want %d", e.Index, l.lastIndexLocked()+1)
+			}
+			l.entries = append(l.entries, e)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read log: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open log: %v", err)
+	}
+
+	// Rewrite so a dropped tail does not linger in the file.
+	if err := l.rewrite(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("📜 Loaded replicated log from %s (entries %d..%d)\n", path, l.entries[0].Index+1, l.lastIndexLocked())
+	return l, nil
+}
+
+// FirstIndex returns the oldest index still held in the log. Anything earlier
+// is only available through a snapshot.
+func (l *ReplicatedLog) FirstIndex() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entries[0].Index + 1
+}
+
+// LastIndex returns the index of the newest entry, or 0 if the log is empty.
+func (l *ReplicatedLog) LastIndex() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastIndexLocked()
+}
+
+func (l *ReplicatedLog) lastIndexLocked() uint64 {
+	return l.entries[0].Index + uint64(len(l.entries)) - 1
+}
+
+// LastTerm returns the term of the newest entry, or 0 if the log is empty.
+func (l *ReplicatedLog) LastTerm() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entries[len(l.entries)-1].Term
+}
+
+// Term returns the term of the entry at index. The base index reports the term of
+// the snapshot it stands in for; older indexes are unknown.
+func (l *ReplicatedLog) Term(index uint64) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	base := l.entries[0].Index
+	if index < base || index > l.lastIndexLocked() {
+		return 0, false
+	}
+	return l.entries[index-base].Term, true
+}
+
+// Entries returns a copy of the entries in [from, to], capped at max entries when max > 0.
+// Entries older than FirstIndex are not returned.
+func (l *ReplicatedLog) Entries(from, to uint64, max int) []LogEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	base := l.entries[0].Index
+	if from <= base {
+		from = base + 1
+	}
+	if last := l.lastIndexLocked(); to > last {
+		to = last
+	}
+	if from > to {
+		return nil
+	}
+	if max > 0 && to-from+1 > uint64(max) {
+		to = from + uint64(max) - 1
+	}
+	out := make([]LogEntry, to-from+1)
+	copy(out, l.entries[from-base:to-base+1])
+	return out
+}
+
+// Append writes entries to the end of the log and syncs them to disk.
+// Entries must continue the log without gaps.
+func (l *ReplicatedLog) Append(entries ...LogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.lastIndexLocked() + 1
+	for i, e := range entries {
+		if e.Index != next+uint64(i) {
+			return fmt.Errorf("append out of order: got index %d, want %d", e.Index, next+uint64(i))
+		}
+	}
+
+	w := bufio.NewWriter(l.file)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("failed to encode log entry: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write log: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log: %v", err)
+	}
+
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// TruncateFrom removes the entry at index and everything after it.
+// Only uncommitted entries that conflict with the leader are ever truncated.
+func (l *ReplicatedLog) TruncateFrom(index uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	base := l.entries[0].Index
+	if index <= base || index > l.lastIndexLocked() {
+		return nil
+	}
+	fmt.Printf("✂️ Truncating log from index %d (last was %d)\n", index, l.lastIndexLocked())
+	l.entries = l.entries[:index-base]
+	return l.rewrite()
+}
+
+// Compact drops every entry up to and including index, which a snapshot now covers.
+func (l *ReplicatedLog) Compact(index uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	base := l.entries[0].Index
+	if index <= base || index > l.lastIndexLocked() {
+		return nil
+	}
+	fmt.Printf("🗜️ Compacting log through index %d\n", index)
+	kept := make([]LogEntry, 0, l.lastIndexLocked()-index+1)
+	kept = append(kept, LogEntry{Index: index, Term: l.entries[index-base].Term, OpType: baseOpType})
+	kept = append(kept, l.entries[index-base+1:]...)
+	l.entries = kept
+	return l.rewrite()
+}
+
+// Reset discards every entry and restarts the log just after a snapshot at index/term.
+func (l *ReplicatedLog) Reset(index, term uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Printf("♻️ Resetting log to start after snapshot index %d (term %d)\n", index, term)
+	l.entries = []LogEntry{{Index: index, Term: term, OpType: baseOpType}}
+	return l.rewrite()
+}
+
+// rewrite replaces the on-disk log with the in-memory entries. Caller holds l.mu.
+func (l *ReplicatedLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create log: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range l.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to encode log entry: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write log: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync log: %v", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("failed to replace log: %v", err)
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen log: %v", err)
+	}
+	return nil
+}
+
+// Close closes the underlying log file.
+func (l *ReplicatedLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
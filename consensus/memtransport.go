@@ -0,0 +1,263 @@
+package consensus
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects nodes running in one process, so tests can run a cluster without
+// sockets and cut nodes off from one another. Each node has an inbox channel; every RPC is
+// queued there and handled in its own goroutine, as an HTTP server would.
+//
+// Requests and responses are copied so nodes never share entries or weight maps.
+type MemoryNetwork struct {
+	mu      sync.RWMutex
+	inboxes map[string]chan func()
+	peers   map[string]Peer
+	down    map[string]bool
+	split   map[string]bool
+	// Timeout bounds how long an RPC waits for its answer. Snapshot transfers get
+	// transferTimeout instead.
+	Timeout time.Duration
+}
+
+// memoryTransport is one node's view of a MemoryNetwork.
+type memoryTransport struct {
+	net  *MemoryNetwork
+	from string
+}
+
+// transferTimeout bounds snapshot transfers over a MemoryNetwork.
+const transferTimeout = 30 * time.Second
+
+// NewMemoryNetwork returns an empty network with a one-second RPC timeout.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		inboxes: make(map[string]chan func()),
+		peers:   make(map[string]Peer),
+		down:    make(map[string]bool),
+		split:   make(map[string]bool),
+		Timeout: 1 * time.Second,
+	}
+}
+
+// Register makes peer reachable as node and starts delivering its RPCs.
+func (n *MemoryNetwork) Register(node string, peer Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peers[node] = peer
+	if _, ok := n.inboxes[node]; ok {
+		return
+	}
+	inbox := make(chan func())
+	n.inboxes[node] = inbox
+	go func() {
+		for handle := range inbox {
+			go handle()
+		}
+	}()
+}
+
+// Transport returns the transport node uses to reach the others. It can be created before
+// node registers, which NewConsensusWithTransport requires.
+func (n *MemoryNetwork) Transport(node string) Transport {
+	return &memoryTransport{net: n, from: node}
+}
+
+// Disconnect makes every RPC to or from node fail until Reconnect is called.
+func (n *MemoryNetwork) Disconnect(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[node] = true
+}
+
+// Reconnect undoes Disconnect.
+func (n *MemoryNetwork) Reconnect(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.down, node)
+}
+
+// Partition splits nodes off from the rest of the network: they can still reach one
+// another, but no RPC crosses between the two sides until Heal is called.
+func (n *MemoryNetwork) Partition(nodes ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, node := range nodes {
+		n.split[node] = true
+	}
+}
+
+// Heal undoes Partition.
+func (n *MemoryNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clear(n.split)
+}
+
+// route finds the peer and inbox for an RPC from one node to another.
+func (n *MemoryNetwork) route(from, to string) (Peer, chan func(), error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	peer, ok := n.peers[to]
+	if !ok || n.down[from] || n.down[to] || n.split[from] != n.split[to] {
+		return nil, nil, fmt.Errorf("%s is unreachable from %s", to, from)
+	}
+	return peer, n.inboxes[to], nil
+}
+
+// memoryResult carries an RPC's answer back from the node's inbox.
+type memoryResult[T any] struct {
+	value T
+	err   error
+}
+
+// send delivers handle to node's inbox and waits up to timeout for its answer.
+func send[T any](t *memoryTransport, node, rpc string, timeout time.Duration, handle func(Peer) (T, error)) (T, error) {
+	var zero T
+	peer, inbox, err := t.net.route(t.from, node)
+	if err != nil {
+		return zero, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan memoryResult[T], 1)
+	deliver := func() {
+		value, err := handle(peer)
+		done <- memoryResult[T]{value, err}
+	}
+	select {
+	case inbox <- deliver:
+	case <-timer.C:
+		return zero, fmt.Errorf("%s to %s timed out", rpc, node)
+	}
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-timer.C:
+		return zero, fmt.Errorf("%s to %s timed out", rpc, node)
+	}
+}
+
+// copyAppendEntries copies the entries and weights a request or catch-up batch carries.
+func copyAppendEntries(req AppendEntriesRequest) AppendEntriesRequest {
+	req.Entries = slices.Clone(req.Entries)
+	req.Weights = maps.Clone(req.Weights)
+	return req
+}
+
+// copySnapshot copies snapshot metadata without the sender's local path.
+func copySnapshot(snap Snapshot) Snapshot {
+	snap.Weights = maps.Clone(snap.Weights)
+	snap.Path = ""
+	return snap
+}
+
+func (t *memoryTransport) AppendEntries(node string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	req = copyAppendEntries(req)
+	return send(t, node, "append-entries", t.net.Timeout, func(p Peer) (AppendEntriesResponse, error) {
+		return p.HandleAppendEntries(req), nil
+	})
+}
+
+func (t *memoryTransport) RequestVote(node string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	return send(t, node, "request-vote", t.net.Timeout, func(p Peer) (RequestVoteResponse, error) {
+		return p.HandleRequestVote(req), nil
+	})
+}
+
+func (t *memoryTransport) SetLeader(node, leader string, term uint64) error {
+	_, err := send(t, node, "set-leader", t.net.Timeout, func(p Peer) (bool, error) {
+		if !p.HandleSetLeader(leader, term) {
+			return false, fmt.Errorf("stale term %d", term)
+		}
+		return true, nil
+	})
+	return err
+}
+
+func (t *memoryTransport) Propose(node string, op LogEntry) (uint64, bool, error) {
+	type proposed struct {
+		index     uint64
+		committed bool
+	}
+	res, err := send(t, node, "propose", t.net.Timeout, func(p Peer) (proposed, error) {
+		index, committed, err := p.HandlePropose(op)
+		return proposed{index, committed}, err
+	})
+	return res.index, res.committed, err
+}
+
+func (t *memoryTransport) ReadIndex(node string, lease bool) (uint64, error) {
+	return send(t, node, "read-index", t.net.Timeout, func(p Peer) (uint64, error) {
+		return p.HandleReadIndex(lease)
+	})
+}
+
+func (t *memoryTransport) LogStatus(node string) (LogStatus, error) {
+	return send(t, node, "log-status", t.net.Timeout, func(p Peer) (LogStatus, error) {
+		return p.GetLogStatus(), nil
+	})
+}
+
+func (t *memoryTransport) LogEntries(node string, from uint64) (AppendEntriesRequest, error) {
+	return send(t, node, "log-entries", transferTimeout, func(p Peer) (AppendEntriesRequest, error) {
+		batch, err := p.EntriesFrom(from)
+		return copyAppendEntries(batch), err
+	})
+}
+
+func (t *memoryTransport) InstallSnapshot(node string, req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error) {
+	req.Snapshot = copySnapshot(req.Snapshot)
+	return send(t, node, "install-snapshot", transferTimeout, func(p Peer) (InstallSnapshotResponse, error) {
+		return p.HandleInstallSnapshot(req, data)
+	})
+}
+
+func (t *memoryTransport) FetchSnapshot(node string) (*Snapshot, io.ReadCloser, error) {
+	type opened struct {
+		snap Snapshot
+		data io.ReadCloser
+	}
+	res, err := send(t, node, "snapshot", transferTimeout, func(p Peer) (opened, error) {
+		snap, data, err := p.OpenSnapshot()
+		if err != nil {
+			return opened{}, err
+		}
+		return opened{copySnapshot(*snap), data}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &res.snap, res.data, nil
+}
+
+func (t *memoryTransport) Leader(node string) (string, error) {
+	return send(t, node, "leader", t.net.Timeout, func(p Peer) (string, error) {
+		return p.CurrentLeader(), nil
+	})
+}
+
+func (t *memoryTransport) Ping(node string) error {
+	_, err := send(t, node, "heartbeat", t.net.Timeout, func(p Peer) (bool, error) {
+		return true, nil
+	})
+	return err
+}
+
+func (t *memoryTransport) Status(node string) (map[string]bool, error) {
+	return send(t, node, "status", t.net.Timeout, func(p Peer) (map[string]bool, error) {
+		return p.GetNodeStatus(), nil
+	})
+}
+
+func (t *memoryTransport) Weights(node string) (map[string]float64, error) {
+	return send(t, node, "weights", t.net.Timeout, func(p Peer) (map[string]float64, error) {
+		return p.GetCabinetWeights(), nil
+	})
+}
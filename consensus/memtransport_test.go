@@ -0,0 +1,355 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStateMachine applies PUT and DELETE entries to a map and snapshots it as JSON.
+type testStateMachine struct {
+	mu        sync.Mutex
+	data      map[string]string
+	applied   uint64
+	snapshots int
+	err       error
+}
+
+type testSnapshotData struct {
+	Index uint64            `json:"index"`
+	Data  map[string]string `json:"data"`
+}
+
+func (sm *testStateMachine) WriteSnapshot(w io.Writer) (uint64, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.applied, json.NewEncoder(w).Encode(testSnapshotData{Index: sm.applied, Data: sm.data})
+}
+
+// run applies what the node delivers until the channel closes.
+func (sm *testStateMachine) run(applyCh <-chan ApplyMsg) {
+	for msg := range applyCh {
+		sm.mu.Lock()
+		if msg.Snapshot != nil {
+			sm.restoreLocked(msg.Snapshot)
+		} else {
+			switch msg.Entry.OpType {
+			case "PUT":
+				sm.data[msg.Entry.Key] = msg.Entry.Value
+			case "DELETE":
+				delete(sm.data, msg.Entry.Key)
+			}
+			sm.applied = msg.Entry.Index
+		}
+		sm.mu.Unlock()
+	}
+}
+
+func (sm *testStateMachine) restoreLocked(snap *Snapshot) {
+	data, err := snap.Open()
+	if err != nil {
+		sm.err = err
+		return
+	}
+	defer data.Close()
+	var restored testSnapshotData
+	if err := json.NewDecoder(data).Decode(&restored); err != nil {
+		sm.err = fmt.Errorf("invalid snapshot through index %d: %v", snap.LastIndex, err)
+		return
+	}
+	sm.data, sm.applied = restored.Data, snap.LastIndex
+	sm.snapshots++
+}
+
+// has reports whether every key in want is applied with its value.
+func (sm *testStateMachine) has(want map[string]string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for k, v := range want {
+		if sm.data[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// testCluster runs nodes on a MemoryNetwork, each with its own directory and state machine.
+type testCluster struct {
+	t       testing.TB
+	network *MemoryNetwork
+	nodes   []string
+	cons    map[string]*Consensus
+	sms     map[string]*testStateMachine
+}
+
+func newTestCluster(t testing.TB, size int) *testCluster {
+	t.Helper()
+	tc := &testCluster{
+		t:       t,
+		network: NewMemoryNetwork(),
+		cons:    make(map[string]*Consensus),
+		sms:     make(map[string]*testStateMachine),
+	}
+	for i := 0; i < size; i++ {
+		tc.nodes = append(tc.nodes, fmt.Sprintf("node%d:8081", i))
+	}
+	dir, err := os.MkdirTemp("", "consensus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nodes cannot be stopped, so cut them all off before removing their files.
+	t.Cleanup(func() {
+		for _, node := range tc.nodes {
+			tc.network.Disconnect(node)
+		}
+		os.RemoveAll(dir)
+	})
+
+	for _, node := range tc.nodes {
+		nodeDir := filepath.Join(dir, strings.ReplaceAll(node, ":", "-"))
+		if err := os.Mkdir(nodeDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewConsensusWithTransport(node, tc.nodes, "cabinet", nodeDir, tc.network.Transport(node))
+		if err != nil {
+			t.Fatalf("failed to start %s: %v", node, err)
+		}
+		tc.network.Register(node, c)
+		sm := &testStateMachine{data: make(map[string]string)}
+		go sm.run(c.AttachStateMachine(sm, 0))
+		tc.cons[node], tc.sms[node] = c, sm
+	}
+	// As in main, the bootstrap leader's heartbeats are started by hand.
+	go tc.cons[tc.nodes[0]].StartHeartbeatBroadcast()
+	return tc
+}
+
+// leader returns the node, other than those in skip, that believes it leads, or "".
+func (tc *testCluster) leader(skip ...string) string {
+	for _, node := range tc.nodes {
+		if !contains(skip, node) && tc.cons[node].State.IsLeader() {
+			return node
+		}
+	}
+	return ""
+}
+
+// put writes keys through whichever node leads, retrying while leadership settles.
+func (tc *testCluster) put(want map[string]string, skip ...string) {
+	tc.t.Helper()
+	for k, v := range want {
+		waitFor(tc.t, 10*time.Second, "write of "+k, func() bool {
+			leader := tc.leader(skip...)
+			if leader == "" {
+				return false
+			}
+			_, err := tc.cons[leader].ProposeChange("PUT", k, v)
+			return err == nil
+		})
+	}
+}
+
+// converge waits until every node outside skip has applied want.
+func (tc *testCluster) converge(want map[string]string, skip ...string) {
+	tc.t.Helper()
+	for _, node := range tc.nodes {
+		if contains(skip, node) {
+			continue
+		}
+		sm := tc.sms[node]
+		waitFor(tc.t, 15*time.Second, node+" to apply every write", func() bool { return sm.has(want) })
+		sm.mu.Lock()
+		err := sm.err
+		sm.mu.Unlock()
+		if err != nil {
+			tc.t.Fatalf("%s: %v", node, err)
+		}
+	}
+}
+
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func writes(prefix string, n int) map[string]string {
+	want := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		want[fmt.Sprintf("%s-%d", prefix, i)] = fmt.Sprintf("value-%d", i)
+	}
+	return want
+}
+
+func TestMemoryNetworkReplication(t *testing.T) {
+	tc := newTestCluster(t, 5)
+	first := writes("first", 20)
+	tc.put(first)
+	tc.converge(first)
+
+	// A follower that misses writes receives them once it is reachable again.
+	lagging := tc.nodes[4]
+	tc.network.Disconnect(lagging)
+	second := writes("second", 10)
+	tc.put(second, lagging)
+	tc.converge(second, lagging)
+	if tc.sms[lagging].has(second) {
+		t.Fatalf("%s applied writes while disconnected", lagging)
+	}
+	tc.network.Reconnect(lagging)
+	tc.converge(second)
+}
+
+func TestMemoryNetworkElection(t *testing.T) {
+	tc := newTestCluster(t, 5)
+	before := writes("before", 5)
+	tc.put(before)
+	tc.converge(before)
+
+	old := tc.nodes[0]
+	oldTerm := tc.cons[old].State.GetTerm()
+	tc.network.Disconnect(old)
+
+	var leader string
+	waitFor(t, 15*time.Second, "a new leader", func() bool {
+		leader = tc.leader(old)
+		return leader != ""
+	})
+	if term := tc.cons[leader].State.GetTerm(); term <= oldTerm {
+		t.Fatalf("new leader %s is in term %d, not after %d", leader, term, oldTerm)
+	}
+
+	// The new leader keeps what was committed before and can commit on its own.
+	after := writes("after", 5)
+	tc.put(after, old)
+	tc.converge(before, old)
+	tc.converge(after, old)
+
+	// The deposed leader steps down and catches up once it can reach the others.
+	tc.network.Reconnect(old)
+	tc.converge(after)
+	waitFor(t, 15*time.Second, "a single leader", func() bool {
+		leaders := 0
+		for _, node := range tc.nodes {
+			if tc.cons[node].State.IsLeader() {
+				leaders++
+			}
+		}
+		return leaders == 1
+	})
+}
+
+func TestMemoryNetworkPartitionOfFastestNodes(t *testing.T) {
+	tc := newTestCluster(t, 5)
+	before := writes("before", 5)
+	tc.put(before)
+	tc.converge(before)
+
+	// Weights computed while two followers are dead must still count them, or the
+	// remaining two followers could outweigh everyone else.
+	leader := tc.leader()
+	var followers []string
+	for _, node := range tc.nodes {
+		if node != leader {
+			followers = append(followers, node)
+		}
+	}
+	dead := followers[2:]
+	for _, node := range dead {
+		tc.network.Disconnect(node)
+	}
+	waitFor(t, 15*time.Second, "the leader to mark "+strings.Join(dead, ", ")+" dead", func() bool {
+		status := tc.cons[leader].GetNodeStatus()
+		return !status[dead[0]] && !status[dead[1]]
+	})
+	during := writes("during", 5)
+	tc.put(during, dead...)
+	weights := tc.cons[leader].GetCabinetWeights()
+	if len(weights) != len(tc.nodes) {
+		t.Fatalf("leader weighs %d nodes, want all %d: %v", len(weights), len(tc.nodes), weights)
+	}
+
+	// Cut off the two followers the leader weighs highest, which answered its rounds
+	// fastest, and let the others back in.
+	fastest := followers[:2]
+	sort.Slice(followers, func(i, j int) bool { return weights[followers[i]] > weights[followers[j]] })
+	if !contains(fastest, followers[0]) || !contains(fastest, followers[1]) {
+		t.Fatalf("dead followers outweigh live ones: %v", weights)
+	}
+	tc.network.Partition(fastest...)
+	for _, node := range dead {
+		tc.network.Reconnect(node)
+	}
+
+	// Two of five nodes never outweigh the other three, so the cut-off pair cannot
+	// elect a leader while the majority keeps writing.
+	after := writes("after", 5)
+	tc.put(after, fastest...)
+	tc.converge(after, fastest...)
+	deadline := time.Now().Add(3 * electionTimeoutMax)
+	for time.Now().Before(deadline) {
+		for _, node := range fastest {
+			if tc.cons[node].State.IsLeader() {
+				t.Fatalf("%s was elected inside a two-node partition", node)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tc.network.Heal()
+	tc.converge(after)
+}
+
+func TestMemoryNetworkSnapshotCatchUp(t *testing.T) {
+	tc := newTestCluster(t, 5)
+	lagging := tc.nodes[4]
+	tc.network.Disconnect(lagging)
+
+	// Write more than a snapshot keeps in the log, then compact every reachable log so
+	// whichever node leads must send the lagging follower a snapshot.
+	before := writes("before", snapshotTrailingEntries+50)
+	tc.put(before, lagging)
+	tc.converge(before, lagging)
+	for _, node := range tc.nodes[:4] {
+		if _, err := tc.cons[node].TakeSnapshot(); err != nil {
+			t.Fatalf("snapshot on %s: %v", node, err)
+		}
+		if first := tc.cons[node].log.FirstIndex(); first <= tc.cons[lagging].log.LastIndex()+1 {
+			t.Fatalf("%s still holds the entries %s is missing (first index %d)", node, lagging, first)
+		}
+	}
+	after := writes("after", 5)
+	tc.put(after, lagging)
+
+	tc.network.Reconnect(lagging)
+	tc.converge(before)
+	tc.converge(after)
+
+	sm := tc.sms[lagging]
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.snapshots == 0 {
+		t.Fatalf("%s caught up without installing a snapshot", lagging)
+	}
+}
@@ -0,0 +1,283 @@
+package consensus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Proposals that arrive within the batch window of one another share a log append and an
+// approval round, and up to the pipeline depth of rounds are in flight at once.
+const (
+	defaultProposalBatchWindow = 2 * time.Millisecond
+	defaultPipelineDepth       = 4
+	// maxProposalBatch keeps a round's entries within one append-entries call.
+	maxProposalBatch = maxEntriesPerAppend
+)
+
+// proposal is an operation waiting for the proposer to order it.
+type proposal struct {
+	entry LogEntry
+	done  chan proposalResult
+}
+
+// proposalResult is the index a proposal was committed at or, if err is set, why it was
+// not.
+type proposalResult struct {
+	index uint64
+	err   error
+}
+
+// ConfigurePipeline sets how long the proposer waits for more proposals to join a batch
+// (0 batches only what is already queued) and how many approval rounds may run at once.
+func (c *Consensus) ConfigurePipeline(window time.Duration, depth int) error {
+	if window < 0 {
+		return fmt.Errorf("proposal batch window %v must not be negative", window)
+	}
+	if depth < 1 {
+		return fmt.Errorf("pipeline depth %d must be at least 1", depth)
+	}
+	c.pipelineMu.Lock()
+	c.batchWindow = window
+	c.pipelineSlots = make(chan struct{}, depth)
+	c.pipelineMu.Unlock()
+	return nil
+}
+
+// pipelineSettings returns the current batch window and round slots.
+func (c *Consensus) pipelineSettings() (time.Duration, chan struct{}) {
+	c.pipelineMu.Lock()
+	defer c.pipelineMu.Unlock()
+	return c.batchWindow, c.pipelineSlots
+}
+
+// runProposer orders queued proposals into the log. Each batch gets the next indexes and
+// its own approval round; rounds overlap, but each reports only after the one before it,
+// so commits and replies follow log order.
+func (c *Consensus) runProposer() {
+	prev := make(chan struct{})
+	close(prev)
+	for first := range c.proposeCh {
+		window, slots := c.pipelineSettings()
+		slots <- struct{}{}
+		// With no other round in flight there is nothing to wait for, so a lone proposal
+		// goes out at once; otherwise give concurrent ones the window to join it.
+		if len(slots) == 1 {
+			window = 0
+		}
+		batch := c.collectBatch(first, window)
+
+		entries, err := c.appendBatch(batch)
+		if err != nil {
+			<-slots
+			for _, p := range batch {
+				p.done <- proposalResult{err: err}
+			}
+			continue
+		}
+
+		done := make(chan struct{})
+		go func(prev, done chan struct{}) {
+			defer func() { <-slots }()
+			defer close(done)
+			c.runRound(batch, entries, prev)
+		}(prev, done)
+		prev = done
+	}
+}
+
+// collectBatch gathers the proposals already queued behind first and those arriving
+// within window of it, up to maxProposalBatch.
+func (c *Consensus) collectBatch(first proposal, window time.Duration) []proposal {
+	batch := []proposal{first}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < maxProposalBatch {
+		select {
+		case p := <-c.proposeCh:
+			batch = append(batch, p)
+			continue
+		default:
+		}
+		select {
+		case p := <-c.proposeCh:
+			batch = append(batch, p)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// appendBatch assigns the batch the next log indexes in the current term and appends it.
+func (c *Consensus) appendBatch(batch []proposal) ([]LogEntry, error) {
+	// ✅ Only the leader appends to the log
+	if !c.State.IsLeader() {
+		fmt.Println("❌ Non-leader tried to append a proposal to the log")
+		return nil, ErrNotLeader
+	}
+
+	next, term := c.log.LastIndex()+1, c.State.GetTerm()
+	entries := make([]LogEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = p.entry
+		entries[i].Index = next + uint64(i)
+		entries[i].Term = term
+	}
+	if err := c.log.Append(entries...); err != nil {
+		fmt.Printf("❌ Failed to append proposal to log: %v\n", err)
+		return nil, fmt.Errorf("failed to append proposal to log: %v", err)
+	}
+	fmt.Printf("📝 Appended %d entries to log at %d..%d (term %d)\n", len(entries), entries[0].Index, entries[len(entries)-1].Index, term)
+	return entries, nil
+}
+
+// runRound asks every live follower to hold entries and, once the round before it has
+// reported, commits them if the approvals exceed the Cabinet threshold. Approvals are
+// weighed with quorumWeights, as votes are, so every commit quorum intersects every
+// election quorum.
+func (c *Consensus) runRound(batch []proposal, entries []LogEntry, prev chan struct{}) {
+	last := entries[len(entries)-1]
+	fmt.Printf("ℹ️ Initiating proposal from: %s\n", c.State.GetMyAddress())
+
+	type responderInfo struct {
+		node     string
+		duration time.Duration
+	}
+
+	proposer := c.State.GetMyAddress()
+	fullAddr := serverIDFromAddress(proposer) + ":" + portFromAddress(proposer)
+
+	c.aliveStatusMu.RLock()
+	isAlive := c.nodeAlive[fullAddr]
+	c.aliveStatusMu.RUnlock()
+
+	weights, threshold := c.quorumWeights()
+	approvalWeight := 0.0
+	roundStart := time.Now()
+	var responders []responderInfo
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// ✅ Count proposer vote if alive
+	if isAlive {
+		if w, ok := weights[fullAddr]; ok {
+			approvalWeight += w
+			responders = append(responders, responderInfo{node: fullAddr, duration: 0})
+			fmt.Printf("✅ Proposer %s is alive with weight %.2f\n", fullAddr, w)
+		} else {
+			fmt.Printf("⚠️ Proposer %s is alive but has no Cabinet weight entry\n", fullAddr)
+		}
+	}
+
+	// 📣 Parallelized approval requests
+	for _, node := range c.nodes {
+		if node == proposer {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+
+			id := serverIDFromAddress(node)
+			port := portFromAddress(node)
+			fullAddr := id + ":" + port
+
+			c.aliveStatusMu.RLock()
+			if !c.nodeAlive[fullAddr] {
+				fmt.Printf("⚠️ Skipping dead node %s during proposal\n", fullAddr)
+				c.aliveStatusMu.RUnlock()
+				return
+			}
+			c.aliveStatusMu.RUnlock()
+
+			start := time.Now()
+			approved, err := c.replicateTo(node, 3)
+			elapsed := time.Since(start)
+			if err != nil {
+				fmt.Printf("Append-entries to %s failed: %v\n", node, err)
+			}
+
+			if approved {
+				w := weights[fullAddr]
+
+				mu.Lock()
+				approvalWeight += w
+				responders = append(responders, responderInfo{node: fullAddr, duration: elapsed})
+				mu.Unlock()
+
+				fmt.Printf("✅ %s approved with weight %.2f\n", fullAddr, w)
+			} else {
+				fmt.Printf("🔹 Approval from %s: false\n", node)
+			}
+		}(node)
+	}
+
+	wg.Wait()
+	<-prev
+
+	fmt.Println("📦 CabinetWeights at time of proposal:")
+	for node, weight := range weights {
+		fmt.Printf("🔸 %s → %.2f\n", node, weight)
+	}
+	fmt.Printf("🧮 Final approvalWeight = %.2f, required > %.2f\n", approvalWeight, threshold)
+
+	// Neither failure below removes the entries: followers may already hold them, so a
+	// later round or a new leader can still commit them. Their proposers are told the
+	// outcome is in doubt rather than that they failed.
+
+	// A leader deposed mid-round must not commit; the new leader decides these entries' fate.
+	if c.State.GetTerm() != last.Term || !c.State.IsLeader() {
+		fmt.Printf("❌ Lost leadership while proposing index %d..%d. Outcome in doubt.\n", entries[0].Index, last.Index)
+		replyAll(batch, entries, ErrProposalInDoubt)
+		return
+	}
+
+	if approvalWeight <= threshold {
+		fmt.Println("❌ Consensus NOT REACHED. Outcome in doubt.")
+		replyAll(batch, entries, ErrProposalInDoubt)
+		return
+	}
+
+	// ✅ If quorum met, commit change
+	fmt.Println("✅ Consensus REACHED. Committing change.")
+	c.commitChange(last.Index)
+	c.renewLease(roundStart)
+	replyAll(batch, entries, nil)
+
+	// ⚡ Sort responders by responsiveness (fastest first)
+	sort.Slice(responders, func(i, j int) bool {
+		return responders[i].duration < responders[j].duration
+	})
+
+	var ordered []string
+	for _, r := range responders {
+		ordered = append(ordered, r.node)
+	}
+
+	// 🔁 Update Cabinet Weights in both modes (Cabinet & Cabinet++), unless the round
+	// only carried leadership refreshes.
+	for _, e := range entries {
+		if isDummyKey(e.Key) {
+			continue
+		}
+		c.UpdateCabinetWeights(ordered)
+
+		// 📦 Log new weights
+		fmt.Println("📦 CabinetWeights AFTER update:")
+		for node, weight := range c.GetCabinetWeights() {
+			fmt.Printf("🔸 %s → %.2f\n", node, weight)
+		}
+		break
+	}
+}
+
+// replyAll tells every proposal in a round that its entry committed or, with err, that it
+// did not.
+func replyAll(batch []proposal, entries []LogEntry, err error) {
+	for i, p := range batch {
+		p.done <- proposalResult{index: entries[i].Index, err: err}
+	}
+}
@@ -0,0 +1,48 @@
+package consensus
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkPipeline measures committed writes per second on a 5-node MemoryNetwork
+// cluster, for one client and for ten clients writing at once, with one approval round
+// at a time and with the default pipeline depth.
+func BenchmarkPipeline(b *testing.B) {
+	tc := newTestCluster(b, 5)
+	tc.put(writes("warmup", 5))
+	leader := tc.cons[tc.leader()]
+
+	for _, depth := range []int{1, defaultPipelineDepth} {
+		for _, clients := range []int{1, 10} {
+			b.Run(fmt.Sprintf("depth-%d/clients-%d", depth, clients), func(b *testing.B) {
+				if err := leader.ConfigurePipeline(defaultProposalBatchWindow, depth); err != nil {
+					b.Fatal(err)
+				}
+				var next, failed atomic.Int64
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for c := 0; c < clients; c++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := next.Add(1); i <= int64(b.N); i = next.Add(1) {
+							key := fmt.Sprintf("bench-%d-%d-%d-%d", depth, clients, b.N, i)
+							if _, err := leader.ProposeChange("PUT", key, "value"); err != nil {
+								failed.Add(1)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				b.StopTimer()
+				if n := failed.Load(); n > 0 {
+					b.Fatalf("%d of %d writes failed", n, b.N)
+				}
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+			})
+		}
+	}
+}
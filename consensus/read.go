@@ -0,0 +1,198 @@
+package consensus
+
+import (
+	"fmt"
+	"time"
+)
+
+// A leader lease lasts defaultLeaseDuration from the start of the last round in which a
+// weighted quorum acknowledged the leader, less defaultLeaseClockDrift to allow for clocks
+// running at different speeds. Leases must not outlast electionTimeoutMin, before which
+// followers that heard from the leader refuse to vote for anyone else.
+const (
+	defaultLeaseDuration   = 1 * time.Second
+	defaultLeaseClockDrift = 100 * time.Millisecond
+)
+
+// LeaseStatus describes the leader lease as seen by this node.
+type LeaseStatus struct {
+	Holder     string    `json:"holder"`
+	Valid      bool      `json:"valid"`
+	RenewedAt  time.Time `json:"renewedAt"`
+	Remaining  string    `json:"remaining"`
+	Duration   string    `json:"duration"`
+	ClockDrift string    `json:"clockDrift"`
+}
+
+// ConfigureLease sets the lease length and the clock-drift allowance subtracted from it.
+func (c *Consensus) ConfigureLease(duration, drift time.Duration) error {
+	if drift < 0 || duration <= drift {
+		return fmt.Errorf("lease duration %v must exceed clock drift %v", duration, drift)
+	}
+	if duration > electionTimeoutMin {
+		return fmt.Errorf("lease duration %v must not exceed the minimum election timeout %v", duration, electionTimeoutMin)
+	}
+	c.leaseMu.Lock()
+	c.leaseDuration = duration
+	c.leaseClockDrift = drift
+	c.leaseMu.Unlock()
+	return nil
+}
+
+// ErrNotLeader means this node lost leadership while serving a request that needs it.
+var ErrNotLeader = fmt.Errorf("not leader")
+
+// ReadIndex returns the log index a linearizable read must wait for before reading local
+// state. On the leader it is the commit index, confirmed by a heartbeat round in which a
+// weighted quorum still acknowledged this node as leader. Followers ask the leader for it.
+func (c *Consensus) ReadIndex() (uint64, error) {
+	if c.State.IsLeader() {
+		return c.confirmReadIndex()
+	}
+	return c.readIndexFromLeader(false)
+}
+
+// LeaseReadIndex is ReadIndex without the heartbeat round while the leader's lease from
+// its last quorum confirmation holds. Once the lease has lapsed it confirms leadership again.
+func (c *Consensus) LeaseReadIndex() (uint64, error) {
+	if !c.State.IsLeader() {
+		return c.readIndexFromLeader(true)
+	}
+	if c.LeaseValid() {
+		term := c.State.GetTerm()
+		readIndex := c.CommitIndex()
+		if t, _ := c.log.Term(readIndex); t == term {
+			return readIndex, nil
+		}
+	}
+	return c.confirmReadIndex()
+}
+
+// LeaseValid reports whether this node is leader and its lease has not run out.
+func (c *Consensus) LeaseValid() bool {
+	if !c.State.IsLeader() {
+		return false
+	}
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	return c.leaseRemainingLocked() > 0
+}
+
+// leaseRemainingLocked returns how much of the lease is left. Caller holds c.leaseMu.
+func (c *Consensus) leaseRemainingLocked() time.Duration {
+	if c.leaseStart.IsZero() {
+		return 0
+	}
+	return c.leaseDuration - c.leaseClockDrift - time.Since(c.leaseStart)
+}
+
+// GetLeaseStatus reports the lease this node holds, if it is leader.
+func (c *Consensus) GetLeaseStatus() LeaseStatus {
+	isLeader := c.State.IsLeader()
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+
+	status := LeaseStatus{
+		Holder:     c.State.GetLeader(),
+		Remaining:  "0s",
+		Duration:   c.leaseDuration.String(),
+		ClockDrift: c.leaseClockDrift.String(),
+	}
+	if isLeader {
+		status.RenewedAt = c.leaseStart
+		if remaining := c.leaseRemainingLocked(); remaining > 0 {
+			status.Valid = true
+			status.Remaining = remaining.Round(time.Millisecond).String()
+		}
+	}
+	return status
+}
+
+// renewLease extends the lease from the moment a successful quorum round began.
+func (c *Consensus) renewLease(start time.Time) {
+	c.leaseMu.Lock()
+	if start.After(c.leaseStart) {
+		c.leaseStart = start
+	}
+	c.leaseMu.Unlock()
+}
+
+// Freshness returns a commit index this node has fully received and when the cluster was
+// known to be at it: the last quorum confirmation on the leader, or the last leader
+// contact on a follower. The zero time means freshness is unknown.
+func (c *Consensus) Freshness() (uint64, time.Time) {
+	if c.State.IsLeader() {
+		c.leaseMu.Lock()
+		start := c.leaseStart
+		c.leaseMu.Unlock()
+		return c.CommitIndex(), start
+	}
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+	return c.contactCommit, c.leaderContact
+}
+
+// readIndexFromLeader asks the leader for a read index, optionally under its lease.
+func (c *Consensus) readIndexFromLeader(lease bool) (uint64, error) {
+	leader := c.State.GetLeader()
+	if leader == "" {
+		return 0, fmt.Errorf("leader unknown")
+	}
+	index, err := c.transport.ReadIndex(leader, lease)
+	if err != nil {
+		return 0, fmt.Errorf("read index from %s failed: %v", leader, err)
+	}
+	return index, nil
+}
+
+// confirmReadIndex records the leader's commit index and then checks, with one round of
+// heartbeats, that a weighted quorum still follows us. Only then is the index safe to
+// read at: no other leader can have committed anything newer.
+func (c *Consensus) confirmReadIndex() (uint64, error) {
+	term := c.State.GetTerm()
+	readIndex := c.CommitIndex()
+	roundStart := time.Now()
+
+	// A new leader only knows its commit index is current once it has committed an
+	// entry of its own term (the dummy write it issues after winning).
+	if t, _ := c.log.Term(readIndex); t != term {
+		return 0, fmt.Errorf("leader has not committed an entry in term %d yet", term)
+	}
+
+	weights, threshold := c.quorumWeights()
+	myAddr := c.State.GetMyAddress()
+	ackWeight := weights[serverIDFromAddress(myAddr)+":"+portFromAddress(myAddr)]
+
+	// Buffered so heartbeats still in flight when we stop counting do not block.
+	acks := make(chan float64, len(c.nodes))
+	peers := 0
+	for _, node := range c.nodes {
+		if node == myAddr {
+			continue
+		}
+		peers++
+		go func(n string) {
+			// A peer that answers without reporting a newer term still follows us,
+			// even if it is behind on entries.
+			_, err := c.replicateTo(n, 1)
+			if err != nil || c.State.GetTerm() != term || !c.State.IsLeader() {
+				acks <- 0
+				return
+			}
+			acks <- weights[serverIDFromAddress(n)+":"+portFromAddress(n)]
+		}(node)
+	}
+
+	for i := 0; i < peers && ackWeight <= threshold; i++ {
+		ackWeight += <-acks
+	}
+
+	if c.State.GetTerm() != term || !c.State.IsLeader() {
+		return 0, ErrNotLeader
+	}
+	if ackWeight <= threshold {
+		return 0, fmt.Errorf("leadership not confirmed: ack weight %.2f <= %.2f", ackWeight, threshold)
+	}
+	c.renewLease(roundStart)
+	return readIndex, nil
+}
@@ -0,0 +1,330 @@
+package consensus
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxEntriesPerAppend bounds how many entries a single append-entries call carries.
+const maxEntriesPerAppend = 256
+
+// AppendEntriesRequest is sent by the leader to replicate entries and advertise its commit index.
+// An empty Entries slice doubles as a heartbeat. Weights and Threshold carry the leader's
+// current Cabinet weights, which followers need to weigh votes in the next election.
+type AppendEntriesRequest struct {
+	Term         uint64             `json:"term"`
+	LeaderID     string             `json:"leaderId"`
+	PrevLogIndex uint64             `json:"prevLogIndex"`
+	PrevLogTerm  uint64             `json:"prevLogTerm"`
+	Entries      []LogEntry         `json:"entries"`
+	LeaderCommit uint64             `json:"leaderCommit"`
+	Weights      map[string]float64 `json:"weights,omitempty"`
+	Threshold    float64            `json:"threshold,omitempty"`
+}
+
+// AppendEntriesResponse reports whether the follower's log now matches the leader's up to
+// PrevLogIndex+len(Entries). On failure LastLogIndex hints where the leader should retry from.
+type AppendEntriesResponse struct {
+	Term         uint64 `json:"term"`
+	Success      bool   `json:"success"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	CatchingUp   bool   `json:"catchingUp"`
+}
+
+// HandleAppendEntries appends the leader's entries to the local log, in order.
+func (c *Consensus) HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+
+	term, ok := c.acceptLeader(req.Term, req.LeaderID)
+	if !ok {
+		return AppendEntriesResponse{Term: term, Success: false, LastLogIndex: c.log.LastIndex()}
+	}
+	if len(req.Weights) > 0 {
+		c.setCabinetWeights(req.Weights, req.Threshold)
+	}
+
+	// Everything up to our snapshot is committed and so already matches the leader;
+	// trim that part of the batch.
+	if base := c.log.FirstIndex() - 1; req.PrevLogIndex < base {
+		skip := base - req.PrevLogIndex
+		if skip >= uint64(len(req.Entries)) {
+			req.Entries = nil
+		} else {
+			req.Entries = req.Entries[skip:]
+		}
+		req.PrevLogIndex = base
+		req.PrevLogTerm, _ = c.log.Term(base)
+	}
+
+	// Our log must contain the entry the leader's batch follows on from.
+	lastIndex := c.log.LastIndex()
+	if req.PrevLogIndex > lastIndex {
+		// We missed entries (restart or partition); pull them rather than waiting for
+		// the leader to walk back one heartbeat at a time.
+		c.startCatchUp()
+		return AppendEntriesResponse{Term: term, Success: false, LastLogIndex: lastIndex, CatchingUp: true}
+	}
+	if prevTerm, _ := c.log.Term(req.PrevLogIndex); prevTerm != req.PrevLogTerm {
+		fmt.Printf("⚠️ Log mismatch at index %d (term %d, leader has %d)\n", req.PrevLogIndex, prevTerm, req.PrevLogTerm)
+		return AppendEntriesResponse{Term: term, Success: false, LastLogIndex: req.PrevLogIndex - 1}
+	}
+
+	// Skip entries we already hold, drop any conflicting suffix, then append the rest.
+	var toAppend []LogEntry
+	for i, e := range req.Entries {
+		existing, ok := c.log.Term(e.Index)
+		if ok && existing == e.Term {
+			continue
+		}
+		if ok {
+			if err := c.log.TruncateFrom(e.Index); err != nil {
+				fmt.Printf("❌ Failed to truncate log at %d: %v\n", e.Index, err)
+				return AppendEntriesResponse{Term: term, Success: false, LastLogIndex: c.log.LastIndex()}
+			}
+		}
+		toAppend = req.Entries[i:]
+		break
+	}
+	if len(toAppend) > 0 {
+		if err := c.log.Append(toAppend...); err != nil {
+			fmt.Printf("❌ Failed to append %d entries: %v\n", len(toAppend), err)
+			return AppendEntriesResponse{Term: term, Success: false, LastLogIndex: c.log.LastIndex()}
+		}
+		fmt.Printf("📥 Appended entries %d..%d from leader %s\n", toAppend[0].Index, toAppend[len(toAppend)-1].Index, req.LeaderID)
+	}
+
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit > c.commitIndex {
+		c.setCommitIndexLocked(min(req.LeaderCommit, lastNew))
+	}
+	if req.LeaderCommit <= lastNew {
+		// We now hold everything the leader had committed when it sent this.
+		c.leaderContact = time.Now()
+		c.contactCommit = req.LeaderCommit
+	}
+
+	return AppendEntriesResponse{Term: term, Success: true, LastLogIndex: c.log.LastIndex(), CatchingUp: c.IsCatchingUp()}
+}
+
+// acceptLeader checks a leader's term against ours, adopting it and the leader if it is
+// current. It returns our (possibly updated) term and whether the leader is accepted.
+// Caller holds replMu.
+func (c *Consensus) acceptLeader(leaderTerm uint64, leaderID string) (uint64, bool) {
+	term := c.State.GetTerm()
+	if leaderTerm < term {
+		fmt.Printf("⚠️ Rejecting %s: stale term %d < %d\n", leaderID, leaderTerm, term)
+		return term, false
+	}
+	if leaderTerm > term {
+		term = leaderTerm
+	}
+
+	if leaderID != c.State.GetMyAddress() && c.State.StepDown(term) {
+		fmt.Printf("🔻 Stepping down: %s leads term %d\n", leaderID, term)
+		go c.monitorHeartbeat()
+	}
+	if c.State.GetLeader() != leaderID {
+		c.State.SetLeader(leaderID)
+		fmt.Printf("🔄 Leader updated to %s (term %d)\n", leaderID, term)
+	}
+	c.State.UpdateHeartbeat()
+	return term, true
+}
+
+// stepDown adopts a newer term reported by a peer. A leader that sees one gives up
+// leadership and waits for the new leader to contact it.
+func (c *Consensus) stepDown(term uint64) {
+	if c.State.StepDown(term) {
+		fmt.Printf("🔻 Stepping down: term %d has started\n", term)
+		go c.monitorHeartbeat()
+	}
+}
+
+// replicateTo sends the entries a follower is missing, retrying up to maxAttempts times
+// while the follower reports a log mismatch. It returns true once the follower holds
+// everything up to the leader's last index, and an error if the follower was unreachable.
+func (c *Consensus) replicateTo(node string, maxAttempts int) (bool, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		lastIndex := c.log.LastIndex()
+
+		c.replMu.Lock()
+		next := c.nextIndex[node]
+		if next == 0 || next > lastIndex+1 {
+			next = lastIndex + 1
+		}
+		commit := c.commitIndex
+		c.replMu.Unlock()
+
+		// The follower needs entries we compacted away; send the snapshot instead.
+		if next < c.log.FirstIndex() {
+			if _, err := c.sendSnapshot(node); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		prevIndex := next - 1
+		prevTerm, _ := c.log.Term(prevIndex)
+		weights, threshold := c.cabinetWeights()
+		req := AppendEntriesRequest{
+			Term:         c.State.GetTerm(),
+			LeaderID:     c.State.GetMyAddress(),
+			PrevLogIndex: prevIndex,
+			PrevLogTerm:  prevTerm,
+			Entries:      c.log.Entries(next, lastIndex, maxEntriesPerAppend),
+			LeaderCommit: commit,
+			Weights:      weights,
+			Threshold:    threshold,
+		}
+
+		resp, err := c.transport.AppendEntries(node, req)
+		if err != nil {
+			return false, err
+		}
+
+		if resp.Term > req.Term {
+			fmt.Printf("⚠️ %s reports newer term %d (ours %d)\n", node, resp.Term, req.Term)
+			c.stepDown(resp.Term)
+			return false, nil
+		}
+
+		c.replMu.Lock()
+		if resp.Success {
+			match := prevIndex + uint64(len(req.Entries))
+			if match > c.matchIndex[node] {
+				c.matchIndex[node] = match
+			}
+			c.nextIndex[node] = c.matchIndex[node] + 1
+			caughtUp := c.matchIndex[node] >= lastIndex
+			c.replMu.Unlock()
+			if resp.CatchingUp {
+				// Not a voter again until its own catch-up finishes.
+				fmt.Printf("⏳ %s is still catching up; not counting its acknowledgement\n", node)
+				return false, nil
+			}
+			if caughtUp {
+				return true, nil
+			}
+			continue
+		}
+
+		// Back up to just past the follower's hint and try again.
+		retry := resp.LastLogIndex + 1
+		if retry >= next {
+			retry = next - 1
+		}
+		if retry < 1 {
+			retry = 1
+		}
+		c.nextIndex[node] = retry
+		c.replMu.Unlock()
+		if resp.CatchingUp {
+			return false, nil
+		}
+		fmt.Printf("🔁 %s rejected entries from %d, retrying from %d\n", node, next, retry)
+	}
+	return false, nil
+}
+
+// resetReplicationProgress starts every follower's next index just past our log, as a new leader does.
+func (c *Consensus) resetReplicationProgress() {
+	last := c.log.LastIndex()
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+	for _, node := range c.nodes {
+		c.nextIndex[node] = last + 1
+		c.matchIndex[node] = 0
+	}
+}
+
+// setCommitIndexLocked raises the commit index and wakes the apply loop. Caller holds c.replMu.
+func (c *Consensus) setCommitIndexLocked(index uint64) {
+	if index <= c.commitIndex {
+		return
+	}
+	c.commitIndex = index
+	select {
+	case c.commitNotify <- struct{}{}:
+	default:
+	}
+}
+
+// CommitIndex returns the highest log index known to be committed.
+func (c *Consensus) CommitIndex() uint64 {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+	return c.commitIndex
+}
+
+// AttachStateMachine starts delivering committed entries after appliedIndex, in log order.
+// The state machine must apply every message received on the returned channel.
+func (c *Consensus) AttachStateMachine(sm StateMachine, appliedIndex uint64) <-chan ApplyMsg {
+	c.replMu.Lock()
+	c.stateMachine = sm
+	c.lastDelivered = appliedIndex
+	// Anything the state machine already applied was committed before a restart.
+	if appliedIndex > c.commitIndex {
+		c.commitIndex = appliedIndex
+	}
+	// If the log no longer reaches back to the state machine, start from our snapshot.
+	if latest := c.snapshots.Latest(); latest != nil && appliedIndex+1 < c.log.FirstIndex() && latest.LastIndex > appliedIndex {
+		fmt.Printf("📦 State machine is behind the log; restoring local snapshot at %d\n", latest.LastIndex)
+		c.pendingSnapshot = latest
+		if latest.LastIndex > c.commitIndex {
+			c.commitIndex = latest.LastIndex
+		}
+	}
+	c.replMu.Unlock()
+
+	go c.deliverCommitted()
+	go c.snapshotLoop()
+	select {
+	case c.commitNotify <- struct{}{}:
+	default:
+	}
+	return c.applyCh
+}
+
+// deliverCommitted pushes newly committed entries onto applyCh whenever the commit index
+// moves. An installed snapshot is delivered before any entry that follows it.
+func (c *Consensus) deliverCommitted() {
+	for range c.commitNotify {
+		for {
+			c.replMu.Lock()
+			if snap := c.pendingSnapshot; snap != nil {
+				c.pendingSnapshot = nil
+				c.replMu.Unlock()
+				c.applyCh <- ApplyMsg{Snapshot: snap}
+				c.replMu.Lock()
+				if snap.LastIndex > c.lastDelivered {
+					c.lastDelivered = snap.LastIndex
+				}
+			}
+			from, to := c.lastDelivered+1, c.commitIndex
+			c.replMu.Unlock()
+			if from > to {
+				break
+			}
+
+			entries := c.log.Entries(from, to, maxEntriesPerAppend)
+			if len(entries) == 0 || entries[0].Index != from {
+				fmt.Printf("⚠️ Committed entries %d..%d missing from local log\n", from, to)
+				break
+			}
+			for _, e := range entries {
+				c.replMu.Lock()
+				stale := c.pendingSnapshot != nil
+				c.replMu.Unlock()
+				if stale {
+					// A snapshot arrived mid-batch; it supersedes these entries.
+					break
+				}
+				c.applyCh <- ApplyMsg{Entry: e}
+				c.replMu.Lock()
+				c.lastDelivered = e.Index
+				c.replMu.Unlock()
+			}
+		}
+	}
+}
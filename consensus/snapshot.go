@@ -0,0 +1,370 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotCheckInterval is how often the snapshot loop looks at the log's growth.
+	snapshotCheckInterval = 10 * time.Second
+	// snapshotEveryEntries is how many applied entries trigger a new snapshot.
+	snapshotEveryEntries = 1000
+	// snapshotTrailingEntries are kept in the log after compaction so slightly lagging
+	// followers can still catch up without a full snapshot transfer.
+	snapshotTrailingEntries = 100
+)
+
+// Snapshot describes a point-in-time copy of the state machine: the last applied index
+// it covers and the Cabinet weights in effect when it was taken.
+type Snapshot struct {
+	LastIndex uint64             `json:"lastIndex"`
+	LastTerm  uint64             `json:"lastTerm"`
+	Weights   map[string]float64 `json:"weights"`
+	Threshold float64            `json:"threshold"`
+	DataFile  string             `json:"dataFile"`
+
+	// Path is the local location of the state machine's data for this snapshot.
+	Path string `json:"-"`
+}
+
+// Open returns a reader over the snapshot's state machine data.
+func (s *Snapshot) Open() (io.ReadCloser, error) {
+	return os.Open(s.Path)
+}
+
+// SnapshotStore keeps the newest snapshot on disk: snapshot.json names the data file
+// written by the state machine.
+type SnapshotStore struct {
+	mu     sync.Mutex
+	dir    string
+	latest *Snapshot
+}
+
+// OpenSnapshotStore loads the newest snapshot in dir, if there is one.
+func OpenSnapshotStore(dir string) (*SnapshotStore, error) {
+	s := &SnapshotStore{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, "snapshot.json"))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot metadata: %v", err)
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot metadata: %v", err)
+	}
+	snap.Path = filepath.Join(dir, snap.DataFile)
+	s.latest = &snap
+	fmt.Printf("📦 Found snapshot through index %d (term %d)\n", snap.LastIndex, snap.LastTerm)
+	return s, nil
+}
+
+// Latest returns the newest snapshot, or nil if none has been taken.
+func (s *SnapshotStore) Latest() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest
+}
+
+// writeData streams state machine data into a temporary file and returns its path.
+func (s *SnapshotStore) writeData(write func(io.Writer) error) (string, error) {
+	f, err := os.CreateTemp(s.dir, "snapshot-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to sync snapshot: %v", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// commit moves the data file into place, records snap as the newest snapshot and removes
+// the one it replaces.
+func (s *SnapshotStore) commit(snap *Snapshot, tmpPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap.DataFile = fmt.Sprintf("snapshot-%d-%d.data", snap.LastTerm, snap.LastIndex)
+	snap.Path = filepath.Join(s.dir, snap.DataFile)
+	if err := os.Rename(tmpPath, snap.Path); err != nil {
+		return fmt.Errorf("failed to store snapshot data: %v", err)
+	}
+
+	meta, _ := json.Marshal(snap)
+	tmpMeta := filepath.Join(s.dir, "snapshot.json.tmp")
+	if err := os.WriteFile(tmpMeta, meta, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata: %v", err)
+	}
+	if err := os.Rename(tmpMeta, filepath.Join(s.dir, "snapshot.json")); err != nil {
+		return fmt.Errorf("failed to store snapshot metadata: %v", err)
+	}
+
+	// Readers streaming the old file to a follower keep their open handle.
+	if s.latest != nil && s.latest.Path != snap.Path {
+		os.Remove(s.latest.Path)
+	}
+	s.latest = snap
+	return nil
+}
+
+// TakeSnapshot captures the state machine to disk and compacts the log behind it.
+func (c *Consensus) TakeSnapshot() (*Snapshot, error) {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	if c.stateMachine == nil {
+		return nil, fmt.Errorf("state machine not attached")
+	}
+
+	weights, threshold := c.cabinetWeights()
+
+	var lastIndex uint64
+	tmpPath, err := c.snapshots.writeData(func(w io.Writer) error {
+		var err error
+		lastIndex, err = c.stateMachine.WriteSnapshot(w)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	term, ok := c.log.Term(lastIndex)
+	if !ok {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("term for snapshot index %d is no longer in the log", lastIndex)
+	}
+
+	snap := &Snapshot{LastIndex: lastIndex, LastTerm: term, Weights: weights, Threshold: threshold}
+	if err := c.snapshots.commit(snap, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	fmt.Printf("📸 Took snapshot through index %d (term %d)\n", snap.LastIndex, snap.LastTerm)
+
+	if lastIndex > snapshotTrailingEntries {
+		if err := c.log.Compact(lastIndex - snapshotTrailingEntries); err != nil {
+			fmt.Printf("⚠️ Failed to compact log after snapshot: %v\n", err)
+		}
+	}
+	return snap, nil
+}
+
+// snapshotLoop periodically snapshots the state machine once enough entries have been applied.
+func (c *Consensus) snapshotLoop() {
+	ticker := time.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var covered uint64
+		if latest := c.snapshots.Latest(); latest != nil {
+			covered = latest.LastIndex
+		}
+		if c.deliveredIndex() < covered+snapshotEveryEntries {
+			continue
+		}
+		if _, err := c.TakeSnapshot(); err != nil {
+			fmt.Printf("⚠️ Periodic snapshot failed: %v\n", err)
+		}
+	}
+}
+
+// SnapshotForTransfer returns the newest snapshot, taking one first if none exists or the
+// log no longer reaches back to it.
+func (c *Consensus) SnapshotForTransfer() (*Snapshot, error) {
+	latest := c.snapshots.Latest()
+	if latest != nil && latest.LastIndex+1 >= c.log.FirstIndex() {
+		return latest, nil
+	}
+	return c.TakeSnapshot()
+}
+
+// InstallSnapshotRequest carries the leader's identity and the snapshot metadata; the
+// snapshot data itself is streamed alongside it.
+type InstallSnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	LeaderID string   `json:"leaderId"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// InstallSnapshotResponse reports the follower's term so a stale leader can step down.
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// HandleInstallSnapshot stores a snapshot streamed by the leader and restarts the local
+// log and state machine from it.
+func (c *Consensus) HandleInstallSnapshot(req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error) {
+	c.replMu.Lock()
+	term, ok := c.acceptLeader(req.Term, req.LeaderID)
+	c.replMu.Unlock()
+	if !ok {
+		return InstallSnapshotResponse{Term: term}, fmt.Errorf("stale term %d < %d", req.Term, term)
+	}
+
+	snap := req.Snapshot
+	if err := c.receiveSnapshot(&snap, data); err != nil {
+		return InstallSnapshotResponse{Term: term}, err
+	}
+	return InstallSnapshotResponse{Term: term}, nil
+}
+
+// receiveSnapshot writes streamed snapshot data to disk and installs it.
+func (c *Consensus) receiveSnapshot(snap *Snapshot, data io.Reader) error {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	if snap.LastIndex <= c.deliveredIndex() {
+		fmt.Printf("ℹ️ Ignoring snapshot at %d: already applied through %d\n", snap.LastIndex, c.deliveredIndex())
+		io.Copy(io.Discard, data)
+		return nil
+	}
+
+	tmpPath, err := c.snapshots.writeData(func(w io.Writer) error {
+		_, err := io.Copy(w, data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to receive snapshot: %v", err)
+	}
+	if err := c.snapshots.commit(snap, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return c.installSnapshot(snap)
+}
+
+// installSnapshot restarts the local log just after the snapshot, adopts the snapshot's
+// Cabinet weights and queues it for the state machine ahead of later entries. Entries
+// after the snapshot are kept if the log agrees with it at its last index.
+func (c *Consensus) installSnapshot(snap *Snapshot) error {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+
+	if snap.LastIndex <= c.lastDelivered {
+		fmt.Printf("ℹ️ Ignoring snapshot at %d: already applied through %d\n", snap.LastIndex, c.lastDelivered)
+		return nil
+	}
+	if term, ok := c.log.Term(snap.LastIndex); ok && term == snap.LastTerm {
+		if err := c.log.Compact(snap.LastIndex); err != nil {
+			return err
+		}
+	} else if err := c.log.Reset(snap.LastIndex, snap.LastTerm); err != nil {
+		return err
+	}
+	if len(snap.Weights) > 0 {
+		c.setCabinetWeights(snap.Weights, snap.Threshold)
+	}
+	c.pendingSnapshot = snap
+	if snap.LastIndex > c.commitIndex {
+		c.commitIndex = snap.LastIndex
+	}
+	select {
+	case c.commitNotify <- struct{}{}:
+	default:
+	}
+	fmt.Printf("📦 Installed snapshot through index %d (term %d)\n", snap.LastIndex, snap.LastTerm)
+	return nil
+}
+
+// sendSnapshot streams our newest snapshot to a follower whose next entry has been
+// compacted out of the log. Only one transfer per follower runs at a time.
+func (c *Consensus) sendSnapshot(node string) (bool, error) {
+	c.replMu.Lock()
+	if c.sendingSnapshot[node] {
+		c.replMu.Unlock()
+		return false, nil
+	}
+	c.sendingSnapshot[node] = true
+	c.replMu.Unlock()
+	defer func() {
+		c.replMu.Lock()
+		delete(c.sendingSnapshot, node)
+		c.replMu.Unlock()
+	}()
+
+	snap, data, err := c.OpenSnapshot()
+	if err != nil {
+		return false, err
+	}
+	defer data.Close()
+
+	req := InstallSnapshotRequest{
+		Term:     c.State.GetTerm(),
+		LeaderID: c.State.GetMyAddress(),
+		Snapshot: *snap,
+	}
+	fmt.Printf("📤 Streaming snapshot through index %d to %s\n", snap.LastIndex, node)
+	out, err := c.transport.InstallSnapshot(node, req, data)
+	if out.Term > c.State.GetTerm() {
+		c.stepDown(out.Term)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.replMu.Lock()
+	if snap.LastIndex > c.matchIndex[node] {
+		c.matchIndex[node] = snap.LastIndex
+	}
+	c.nextIndex[node] = c.matchIndex[node] + 1
+	c.replMu.Unlock()
+	fmt.Printf("✅ %s installed snapshot through index %d\n", node, snap.LastIndex)
+	return true, nil
+}
+
+// pullSnapshot downloads the leader's snapshot and installs it.
+func (c *Consensus) pullSnapshot(leader string) error {
+	fmt.Printf("📦 Requesting full snapshot from %s\n", leader)
+	snap, data, err := c.transport.FetchSnapshot(leader)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return c.receiveSnapshot(snap, data)
+}
+
+// OpenSnapshot returns the newest snapshot, as SnapshotForTransfer does, with its data
+// opened for reading.
+func (c *Consensus) OpenSnapshot() (*Snapshot, io.ReadCloser, error) {
+	snap, err := c.SnapshotForTransfer()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := snap.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return snap, data, nil
+}
+
+// ServeSnapshot streams the newest snapshot's data to w for a follower that is pulling it.
+// begin is called with the metadata before any data is written, so the caller can frame it.
+func (c *Consensus) ServeSnapshot(w io.Writer, begin func(*Snapshot)) error {
+	snap, data, err := c.OpenSnapshot()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	fmt.Printf("📤 Serving snapshot through index %d\n", snap.LastIndex)
+	begin(snap)
+	_, err = io.Copy(w, data)
+	return err
+}
@@ -1,8 +1,9 @@
 package consensus
 
 import (
+	"encoding/json"
 	"fmt"
-	"math"
+	"os"
 	"sync"
 	"time"
 )
@@ -12,9 +13,19 @@ type ServerState struct {
 	mu            sync.RWMutex
 	myAddress     string
 	leader        string
+	currentTerm   uint64
+	votedFor      string
+	statePath     string
 	lastHeartbeat time.Time
 }
 
+// persistentState is the part of ServerState that must survive a restart, so a node
+// never returns to an older term or votes twice in the same one.
+type persistentState struct {
+	CurrentTerm uint64 `json:"currentTerm"`
+	VotedFor    string `json:"votedFor,omitempty"`
+}
+
 func (s *ServerState) UpdateHeartbeat() {
 	s.mu.Lock()
 	s.lastHeartbeat = time.Now()
@@ -70,38 +81,148 @@ func (s *ServerState) IsFollower() bool {
 	return !s.IsLeader()
 }
 
-// GetMyAddress returns the node's address.
-func (s *ServerState) GetMyAddress() string {
+// GetTerm returns the current term.
+func (s *ServerState) GetTerm() uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.myAddress
+	return s.currentTerm
+}
+
+// SetTerm moves to a newer term, forgetting the vote cast in the old one.
+// Terms never go backwards, so older terms are ignored.
+func (s *ServerState) SetTerm(term uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setTermLocked(term)
 }
 
-var CabinetWeights map[string]float64
-var CabinetThreshold float64
+func (s *ServerState) setTermLocked(term uint64) {
+	if term <= s.currentTerm {
+		return
+	}
+	s.currentTerm = term
+	s.votedFor = ""
+	if err := s.persistLocked(); err != nil {
+		fmt.Printf("❌ Failed to persist term %d: %v\n", term, err)
+	}
+}
 
-func InitCabinetWeights(peers []string) {
-	CabinetWeights = make(map[string]float64)
-	r := 1.5
-	a := 1.0
-	sum := 0.0
+// GetVotedFor returns the candidate this node voted for in the current term, if any.
+func (s *ServerState) GetVotedFor() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.votedFor
+}
 
-	for i := 0; i < len(peers); i++ {
-		id := peers[i]
-		w := a * math.Pow(r, float64(len(peers)-1-i))
-		CabinetWeights[id] = w
-		sum += w
+// Vote records a vote for candidate in term. It fails if term is not the current term,
+// if we already voted for someone else in it, or if the vote cannot be saved.
+func (s *ServerState) Vote(term uint64, candidate string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if term != s.currentTerm {
+		return false
+	}
+	if s.votedFor == candidate {
+		return true
+	}
+	if s.votedFor != "" {
+		return false
+	}
+	s.votedFor = candidate
+	if err := s.persistLocked(); err != nil {
+		fmt.Printf("❌ Failed to persist vote for %s: %v\n", candidate, err)
+		s.votedFor = ""
+		return false
 	}
+	return true
+}
 
-	CabinetThreshold = sum / 2.0
+// BecomeCandidate opens a new term in which this node votes for itself, and restarts
+// the election timer. It returns the new term.
+func (s *ServerState) BecomeCandidate() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentTerm++
+	s.votedFor = s.myAddress
+	s.leader = ""
+	s.lastHeartbeat = time.Now()
+	return s.currentTerm, s.persistLocked()
 }
 
-func HasCabinetQuorum(acks map[string]bool) bool {
-	total := 0.0
-	for id, ack := range acks {
-		if ack {
-			total += CabinetWeights[id]
-		}
+// BecomeLeader makes this node leader of term, unless the term has moved on or another
+// leader has already been accepted for it.
+func (s *ServerState) BecomeLeader(term uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.currentTerm != term || (s.leader != "" && s.leader != s.myAddress) {
+		return false
 	}
-	return total > CabinetThreshold
+	s.leader = s.myAddress
+	return true
+}
+
+// StepDown adopts term if it is newer and gives up leadership. It reports whether this
+// node was leader, so exactly one caller restarts the heartbeat monitor.
+func (s *ServerState) StepDown(term uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setTermLocked(term)
+	if s.leader != s.myAddress {
+		return false
+	}
+	s.leader = ""
+	s.lastHeartbeat = time.Now()
+	return true
+}
+
+// LoadPersistentState restores the term and vote saved at path and saves later changes there.
+func (s *ServerState) LoadPersistentState(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statePath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read election state: %v", err)
+	}
+	var ps persistentState
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return fmt.Errorf("invalid election state in %s: %v", path, err)
+	}
+	s.currentTerm = ps.CurrentTerm
+	s.votedFor = ps.VotedFor
+	return nil
+}
+
+// persistLocked writes the term and vote to disk before they are acted on. Caller holds s.mu.
+func (s *ServerState) persistLocked() error {
+	if s.statePath == "" {
+		return nil
+	}
+	data, _ := json.Marshal(persistentState{CurrentTerm: s.currentTerm, VotedFor: s.votedFor})
+	tmp := s.statePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, s.statePath)
+}
+
+// GetMyAddress returns the node's address.
+func (s *ServerState) GetMyAddress() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.myAddress
 }
@@ -0,0 +1,87 @@
+package consensus
+
+import (
+	"fmt"
+	"io"
+)
+
+// Transport carries the RPCs consensus nodes make to one another. Nodes are named by the
+// addresses Consensus was configured with. NewHTTPTransport speaks the JSON-over-HTTP
+// protocol served by the kvstore server; NewMemoryNetwork connects nodes in one process.
+type Transport interface {
+	AppendEntries(node string, req AppendEntriesRequest) (AppendEntriesResponse, error)
+	RequestVote(node string, req RequestVoteRequest) (RequestVoteResponse, error)
+	// SetLeader announces a newly elected leader.
+	SetLeader(node, leader string, term uint64) error
+	// Propose hands a Cabinet++ follower's operation to the leader and reports the index
+	// it committed at, if it did.
+	Propose(node string, op LogEntry) (uint64, bool, error)
+	// ReadIndex asks the leader for a read index, under its lease if lease is set.
+	ReadIndex(node string, lease bool) (uint64, error)
+	LogStatus(node string) (LogStatus, error)
+	// LogEntries fetches the batch a lagging follower needs from from onwards, or
+	// ErrSnapshotRequired if the leader has compacted those entries.
+	LogEntries(node string, from uint64) (AppendEntriesRequest, error)
+	// InstallSnapshot streams a snapshot's data to a follower. The response is returned
+	// with the error whenever the follower sent one, so a stale leader learns the term.
+	InstallSnapshot(node string, req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error)
+	// FetchSnapshot downloads the leader's newest snapshot. The caller closes the data.
+	FetchSnapshot(node string) (*Snapshot, io.ReadCloser, error)
+	// Leader asks a node who it believes leads, or "" if it does not know.
+	Leader(node string) (string, error)
+	// Ping checks that a node answers.
+	Ping(node string) error
+	// Status and Weights fetch the leader's view of node liveness and Cabinet weights.
+	Status(node string) (map[string]bool, error)
+	Weights(node string) (map[string]float64, error)
+}
+
+// Peer is the receiving end of every Transport RPC. *Consensus implements it.
+type Peer interface {
+	HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse
+	HandleRequestVote(req RequestVoteRequest) RequestVoteResponse
+	HandleSetLeader(leader string, term uint64) bool
+	HandlePropose(op LogEntry) (uint64, bool, error)
+	HandleReadIndex(lease bool) (uint64, error)
+	GetLogStatus() LogStatus
+	EntriesFrom(from uint64) (AppendEntriesRequest, error)
+	HandleInstallSnapshot(req InstallSnapshotRequest, data io.Reader) (InstallSnapshotResponse, error)
+	OpenSnapshot() (*Snapshot, io.ReadCloser, error)
+	CurrentLeader() string
+	GetNodeStatus() map[string]bool
+	GetCabinetWeights() map[string]float64
+}
+
+// HandlePropose runs a proposal forwarded by a Cabinet++ follower. Only the leader orders
+// the log, so any other node refuses it with ErrNotLeader. A proposal whose outcome is
+// unknown returns ErrProposalInDoubt; one that surely failed is reported as not committed.
+func (c *Consensus) HandlePropose(op LogEntry) (uint64, bool, error) {
+	if !c.State.IsLeader() {
+		return 0, false, ErrNotLeader
+	}
+	fmt.Printf("📨 Received forwarded %s proposal for key=%s\n", op.OpType, op.Key)
+	index, err := c.Propose(op)
+	switch err {
+	case nil:
+		return index, true, nil
+	case ErrNotLeader, ErrProposalInDoubt:
+		return 0, false, err
+	}
+	return 0, false, nil
+}
+
+// HandleReadIndex serves a follower's ReadIndex or, with lease set, LeaseReadIndex.
+func (c *Consensus) HandleReadIndex(lease bool) (uint64, error) {
+	if !c.State.IsLeader() {
+		return 0, ErrNotLeader
+	}
+	if lease {
+		return c.LeaseReadIndex()
+	}
+	return c.ReadIndex()
+}
+
+// CurrentLeader returns the leader this node knows of, or "".
+func (c *Consensus) CurrentLeader() string {
+	return c.State.GetLeader()
+}
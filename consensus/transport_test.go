@@ -0,0 +1,197 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchPeer answers AppendEntries and heartbeats; any other RPC panics on the nil Peer.
+type benchPeer struct {
+	Peer
+}
+
+func (benchPeer) HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse {
+	return AppendEntriesResponse{Term: req.Term, Success: true, LastLogIndex: req.PrevLogIndex + uint64(len(req.Entries))}
+}
+
+// serveHTTPPeer serves the routes the benchmark uses as the kvstore server does, and
+// returns the node name that reaches them.
+func serveHTTPPeer(tb testing.TB, peer Peer) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/append-entries", func(w http.ResponseWriter, r *http.Request) {
+		var req AppendEntriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(peer.HandleAppendEntries(req))
+	})
+	mux.HandleFunc("/api/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(mux)
+	tb.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// serveBinaryPeer serves peer over the binary protocol and returns a transport that
+// reaches it as node.
+func serveBinaryPeer(tb testing.TB, peer Peer, node string) *BinaryTransport {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go ServeBinary(l, peer)
+	return NewBinaryTransport(map[string]string{node: l.Addr().String()})
+}
+
+func benchEntries(n int) []LogEntry {
+	entries := make([]LogEntry, n)
+	for i := range entries {
+		entries[i] = LogEntry{Index: uint64(i + 1), Term: 1, OpType: "PUT", Key: fmt.Sprintf("key-%d", i), Value: "value"}
+	}
+	return entries
+}
+
+// BenchmarkTransport compares the HTTP and binary transports on loopback, for a
+// heartbeat and for an AppendEntries carrying a batch of writes.
+func BenchmarkTransport(b *testing.B) {
+	const node = "node1:8081"
+	transports := []struct {
+		name string
+		new  func(b *testing.B) (Transport, string)
+	}{
+		{"http", func(b *testing.B) (Transport, string) {
+			return NewHTTPTransport(), serveHTTPPeer(b, benchPeer{})
+		}},
+		{"binary", func(b *testing.B) (Transport, string) {
+			return serveBinaryPeer(b, benchPeer{}, node), node
+		}},
+	}
+	for _, tr := range transports {
+		b.Run(tr.name+"/heartbeat", func(b *testing.B) {
+			transport, to := tr.new(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := transport.Ping(to); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(tr.name+"/append-entries", func(b *testing.B) {
+			transport, to := tr.new(b)
+			req := AppendEntriesRequest{Term: 1, LeaderID: "node0:8081", Entries: benchEntries(16)}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := transport.AppendEntries(to, req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryTransportRedialsAfterTimeout(t *testing.T) {
+	// A peer that accepts connections but never answers, as one behind a half-open
+	// connection would look.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			defer conn.Close()
+		}
+	}()
+
+	const node = "node1:8081"
+	transport := NewBinaryTransport(map[string]string{node: l.Addr().String()})
+	for i := 0; i < 2; i++ {
+		if err := transport.Ping(node); err == nil {
+			t.Fatalf("ping %d to a silent peer succeeded", i+1)
+		}
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("got %d connections after two timed-out calls, want 2", n)
+	}
+}
+
+// slowStatusPeer answers log-status requests only after delay.
+type slowStatusPeer struct {
+	Peer
+	delay time.Duration
+}
+
+func (p slowStatusPeer) GetLogStatus() LogStatus {
+	time.Sleep(p.delay)
+	return LogStatus{}
+}
+
+func TestBinaryTransportKeepsConnectionAfterSlowCall(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted atomic.Int32
+	peer := slowStatusPeer{delay: 2 * binaryCallTimeout}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go serveBinaryConn(conn, peer)
+		}
+	}()
+
+	const node = "node1:8081"
+	transport := NewBinaryTransport(map[string]string{node: l.Addr().String()})
+	if err := transport.Ping(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// One call outlives its timeout while pings keep being answered on the same connection.
+	done := make(chan error, 1)
+	go func() {
+		_, err := transport.LogStatus(node)
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("log status from a slow peer did not time out")
+			}
+			if err := transport.Ping(node); err != nil {
+				t.Fatal(err)
+			}
+			if n := accepted.Load(); n != 1 {
+				t.Fatalf("got %d connections after one slow call, want 1", n)
+			}
+			return
+		default:
+		}
+		if err := transport.Ping(node); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
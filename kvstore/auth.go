@@ -0,0 +1,510 @@
+package kvstore
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Users, roles and login tokens are ordinary keys under AuthPrefix, so they replicate,
+// snapshot and recover with the rest of the keyspace. Authentication is on while
+// authEnabledKey exists. Only users in RootRole may read or write keys under AuthPrefix;
+// everyone else manages them through the /api/auth routes.
+const (
+	AuthPrefix      = "__auth/"
+	authEnabledKey  = AuthPrefix + "enabled"
+	authUserPrefix  = AuthPrefix + "users/"
+	authRolePrefix  = AuthPrefix + "roles/"
+	authTokenPrefix = AuthPrefix + "tokens/"
+)
+
+// RootRole is built in: its users may access every key and manage users and roles.
+const RootRole = "root"
+
+// TokenTTL is how long a login token lasts. Tokens are keys with a TTL, so they expire on
+// every node at the same log index.
+const TokenTTL = time.Hour
+
+// passwordIterations is the PBKDF2 work factor, about 30ms per check on one core.
+const passwordIterations = 100000
+
+var (
+	ErrUnauthenticated  = fmt.Errorf("invalid credentials")
+	ErrUserNotFound     = fmt.Errorf("user not found")
+	ErrRoleNotFound     = fmt.Errorf("role not found")
+	ErrUnknownRole      = fmt.Errorf("user names a role that does not exist")
+	ErrPasswordRequired = fmt.Errorf("a new user needs a password")
+	ErrNoRootUser       = fmt.Errorf("authentication cannot be enabled without a user in the root role")
+	ErrLastRootUser     = fmt.Errorf("cannot remove the last user in the root role while authentication is enabled")
+)
+
+// AuthUnavailableError means credentials could not be checked at all, for instance because
+// this node could not confirm a token with the leader. Unlike ErrUnauthenticated, the
+// caller may succeed by retrying.
+type AuthUnavailableError struct {
+	Err error
+}
+
+func (e *AuthUnavailableError) Error() string {
+	return fmt.Sprintf("credentials could not be checked: %v", e.Err)
+}
+
+// Access is what an operation needs on a key.
+type Access int
+
+const (
+	AccessRead Access = iota + 1
+	AccessWrite
+)
+
+func (a Access) String() string {
+	if a == AccessWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// Permission grants read, write or both on every key that starts with Prefix. An empty
+// Prefix covers the whole keyspace except AuthPrefix.
+type Permission struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+}
+
+func (p Permission) allows(a Access) bool {
+	if a == AccessWrite {
+		return p.Write
+	}
+	return p.Read
+}
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// User is a login and the roles it holds. Roles that no longer exist grant nothing.
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// userRecord is how a user is stored: the password is kept only as a salted PBKDF2 hash.
+type userRecord struct {
+	User
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+}
+
+// AuthUser is an authenticated caller with the permissions its roles grant. A nil
+// *AuthUser, which is what callers get while authentication is off, may do anything.
+type AuthUser struct {
+	Name        string
+	Roles       []string
+	root        bool
+	permissions []Permission
+}
+
+// Can reports whether u may access key.
+func (u *AuthUser) Can(a Access, key string) bool {
+	if u == nil || u.root {
+		return true
+	}
+	if strings.HasPrefix(key, AuthPrefix) {
+		return false
+	}
+	for _, p := range u.permissions {
+		if p.allows(a) && strings.HasPrefix(key, p.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRange reports whether u may access every key in [start, end), where an empty end
+// leaves the range open. The range must fall under a single permission's prefix.
+func (u *AuthUser) CanRange(a Access, start, end string) bool {
+	if u == nil || u.root {
+		return true
+	}
+	if start < prefixEnd(AuthPrefix) && (end == "" || end > AuthPrefix) {
+		return false
+	}
+	for _, p := range u.permissions {
+		if !p.allows(a) || !strings.HasPrefix(start, p.Prefix) {
+			continue
+		}
+		if pe := prefixEnd(p.Prefix); pe == "" || (end != "" && end <= pe) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRoot reports whether u may manage users and roles.
+func (u *AuthUser) IsRoot() bool {
+	return u == nil || u.root
+}
+
+// ValidateAuthName checks a user or role name, which becomes part of a key.
+func ValidateAuthName(name string) error {
+	if name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("name %q must not contain '/'", name)
+	}
+	return nil
+}
+
+// AuthEnabled reports whether requests must authenticate.
+func (kv *KVStore) AuthEnabled() (bool, error) {
+	_, found, err := kv.readAuthKey(authEnabledKey)
+	return found, err
+}
+
+// EnableAuth turns authentication on. A user in the root role must exist first, so the
+// cluster cannot lock itself out.
+func (kv *KVStore) EnableAuth() error {
+	users, err := kv.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if slices.Contains(u.Roles, RootRole) {
+			return kv.Put(authEnabledKey, "true")
+		}
+	}
+	return ErrNoRootUser
+}
+
+// DisableAuth turns authentication off.
+func (kv *KVStore) DisableAuth() error {
+	return kv.Delete(authEnabledKey)
+}
+
+// Users lists every user.
+func (kv *KVStore) Users() ([]User, error) {
+	users := []User{}
+	err := kv.scanAuth(authUserPrefix, func(value string) error {
+		var rec userRecord
+		if err := json.Unmarshal([]byte(value), &rec); err != nil {
+			return fmt.Errorf("failed to decode user: %v", err)
+		}
+		users = append(users, rec.User)
+		return nil
+	})
+	return users, err
+}
+
+// GetUser reads one user.
+func (kv *KVStore) GetUser(name string) (User, error) {
+	rec, err := kv.readUser(name, false)
+	return rec.User, err
+}
+
+// PutUser creates or updates a user. An empty password keeps an existing user's password.
+func (kv *KVStore) PutUser(name, password string, roles []string) error {
+	for _, role := range roles {
+		if role == RootRole {
+			continue
+		}
+		if _, err := kv.GetRole(role); err == ErrRoleNotFound {
+			return ErrUnknownRole
+		} else if err != nil {
+			return err
+		}
+	}
+
+	rec, err := kv.readUser(name, false)
+	if err == ErrUserNotFound {
+		if password == "" {
+			return ErrPasswordRequired
+		}
+	} else if err != nil {
+		return err
+	} else if slices.Contains(rec.Roles, RootRole) && !slices.Contains(roles, RootRole) {
+		if err := kv.checkOtherRootUser(name); err != nil {
+			return err
+		}
+	}
+
+	rec.User = User{Name: name, Roles: roles}
+	if password != "" {
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		rec.Salt = base64.StdEncoding.EncodeToString(salt)
+		if rec.Hash, err = hashPassword(password, salt); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return kv.Put(authUserPrefix+name, string(data))
+}
+
+// DeleteUser removes a user. Its tokens stop working, since they resolve to no user.
+func (kv *KVStore) DeleteUser(name string) error {
+	rec, err := kv.readUser(name, false)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(rec.Roles, RootRole) {
+		if err := kv.checkOtherRootUser(name); err != nil {
+			return err
+		}
+	}
+	return kv.Delete(authUserPrefix + name)
+}
+
+// checkOtherRootUser returns ErrLastRootUser if authentication is on and name is the only
+// user in the root role.
+func (kv *KVStore) checkOtherRootUser(name string) error {
+	enabled, err := kv.AuthEnabled()
+	if err != nil || !enabled {
+		return err
+	}
+	users, err := kv.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Name != name && slices.Contains(u.Roles, RootRole) {
+			return nil
+		}
+	}
+	return ErrLastRootUser
+}
+
+// Roles lists every role.
+func (kv *KVStore) Roles() ([]Role, error) {
+	roles := []Role{}
+	err := kv.scanAuth(authRolePrefix, func(value string) error {
+		var role Role
+		if err := json.Unmarshal([]byte(value), &role); err != nil {
+			return fmt.Errorf("failed to decode role: %v", err)
+		}
+		roles = append(roles, role)
+		return nil
+	})
+	return roles, err
+}
+
+// GetRole reads one role.
+func (kv *KVStore) GetRole(name string) (Role, error) {
+	var role Role
+	value, found, err := kv.readAuthKey(authRolePrefix + name)
+	if err != nil {
+		return role, err
+	}
+	if !found {
+		return role, ErrRoleNotFound
+	}
+	if err := json.Unmarshal([]byte(value), &role); err != nil {
+		return role, fmt.Errorf("failed to decode role: %v", err)
+	}
+	return role, nil
+}
+
+// PutRole creates or replaces a role.
+func (kv *KVStore) PutRole(role Role) error {
+	if role.Permissions == nil {
+		role.Permissions = []Permission{}
+	}
+	data, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	return kv.Put(authRolePrefix+role.Name, string(data))
+}
+
+// DeleteRole removes a role. Users that hold it keep the name but lose its permissions.
+func (kv *KVStore) DeleteRole(name string) error {
+	if _, err := kv.GetRole(name); err != nil {
+		return err
+	}
+	return kv.Delete(authRolePrefix + name)
+}
+
+// Login checks a password and issues a token that lasts TokenTTL.
+func (kv *KVStore) Login(name, password string) (string, error) {
+	if _, err := kv.AuthenticatePassword(name, password); err != nil {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+	if err := kv.PutWithTTL(tokenKey(token), name, TokenTTL); err != nil {
+		return "", err
+	}
+	fmt.Printf("🔑 User %s logged in\n", name)
+	return token, nil
+}
+
+// Logout revokes a token.
+func (kv *KVStore) Logout(token string) error {
+	return kv.Delete(tokenKey(token))
+}
+
+// AuthenticateToken resolves a login token to its user. It returns ErrUnauthenticated for
+// an unknown token and an *AuthUnavailableError if the token could not be checked.
+func (kv *KVStore) AuthenticateToken(token string) (*AuthUser, error) {
+	name, found, err := kv.readAuthKeyFresh(tokenKey(token))
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+	rec, err := kv.readUser(name, true)
+	if err == ErrUserNotFound {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	user, err := kv.authUser(rec.User)
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	return user, nil
+}
+
+// AuthenticatePassword checks a user's password. Its errors are those of AuthenticateToken.
+func (kv *KVStore) AuthenticatePassword(name, password string) (*AuthUser, error) {
+	rec, err := kv.readUser(name, true)
+	if err == ErrUserNotFound {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	salt, err := base64.StdEncoding.DecodeString(rec.Salt)
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: fmt.Errorf("failed to decode salt of user %s: %v", name, err)}
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(rec.Hash)) != 1 {
+		return nil, ErrUnauthenticated
+	}
+	user, err := kv.authUser(rec.User)
+	if err != nil {
+		return nil, &AuthUnavailableError{Err: err}
+	}
+	return user, nil
+}
+
+// authUser gathers the permissions of u's roles.
+func (kv *KVStore) authUser(u User) (*AuthUser, error) {
+	user := &AuthUser{Name: u.Name, Roles: u.Roles}
+	for _, name := range u.Roles {
+		if name == RootRole {
+			user.root = true
+			continue
+		}
+		role, err := kv.GetRole(name)
+		if err == ErrRoleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		user.permissions = append(user.permissions, role.Permissions...)
+	}
+	return user, nil
+}
+
+// readUser reads a user's record. With fresh set, a user missing locally is looked up
+// again once this node has caught up with the leader.
+func (kv *KVStore) readUser(name string, fresh bool) (userRecord, error) {
+	var rec userRecord
+	read := kv.readAuthKey
+	if fresh {
+		read = kv.readAuthKeyFresh
+	}
+	value, found, err := read(authUserPrefix + name)
+	if err != nil {
+		return rec, err
+	}
+	if !found {
+		return rec, ErrUserNotFound
+	}
+	if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		return rec, fmt.Errorf("failed to decode user: %v", err)
+	}
+	return rec, nil
+}
+
+// readAuthKey reads a key from the local replica, treating an expired key as missing.
+func (kv *KVStore) readAuthKey(key string) (string, bool, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	out, found, err := kv.getKeyLocked(key)
+	return out.Value, found, err
+}
+
+// readAuthKeyFresh is readAuthKey, except that a key missing locally is read again at
+// linearizable consistency. A token issued on another node is then usable here at once,
+// without this node paying for a read index on every request. If this node cannot catch
+// up, the key's absence is unconfirmed and an error is returned.
+func (kv *KVStore) readAuthKeyFresh(key string) (string, bool, error) {
+	value, found, err := kv.readAuthKey(key)
+	if found || err != nil {
+		return value, found, err
+	}
+	if _, err := kv.prepareRead(ReadConsistency{Level: ConsistencyLinearizable}); err != nil {
+		return "", false, fmt.Errorf("failed to catch up with the leader: %v", err)
+	}
+	return kv.readAuthKey(key)
+}
+
+// scanAuth calls fn with the value of every live key under prefix.
+func (kv *KVStore) scanAuth(prefix string, fn func(value string) error) error {
+	kv.mu.RLock()
+	var values []string
+	err := kv.engine.Range(prefix, prefixEnd(prefix), time.Now().UnixMilli(), func(k KeyValue) bool {
+		values = append(values, k.Value)
+		return true
+	})
+	kv.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenKey is where a token is stored. The key holds a hash of the token, so reading the
+// keyspace, a snapshot or the change feed does not reveal a usable token.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return authTokenPrefix + hex.EncodeToString(sum[:])
+}
+
+// hashPassword derives the stored hash of a password.
+func hashPassword(password string, salt []byte) (string, error) {
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,70 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/consensus"
+)
+
+// opBatch replicates many puts and deletes as one log entry, carrying the operations as
+// JSON in the entry's value, and applies them in one write batch.
+const opBatch = "BATCH"
+
+// maxBatchOps bounds the operations in one batch, and so the size of its log entry.
+const maxBatchOps = 10000
+
+// BatchResponse reports the revision a batch was applied at and each operation's outcome,
+// in request order.
+type BatchResponse struct {
+	Revision  uint64        `json:"revision"`
+	Responses []TxnOpResult `json:"responses"`
+}
+
+// validateBatch checks a batch before it is proposed.
+func validateBatch(ops []TxnOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("batch is empty")
+	}
+	if len(ops) > maxBatchOps {
+		return fmt.Errorf("batch has %d operations, more than %d", len(ops), maxBatchOps)
+	}
+	for i, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("operation %d: missing key", i)
+		}
+		if op.Type != "put" && op.Type != "delete" {
+			return fmt.Errorf("operation %d: type must be put or delete, not %q", i, op.Type)
+		}
+	}
+	return nil
+}
+
+// Batch commits puts and deletes with one consensus proposal and one write batch.
+// Operations apply in order, so a later one on the same key wins.
+func (kv *KVStore) Batch(ops []TxnOp) (BatchResponse, error) {
+	if err := validateBatch(ops); err != nil {
+		return BatchResponse{}, err
+	}
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	result, err := kv.proposeForResult(consensus.LogEntry{OpType: opBatch, Value: string(data)})
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	return result.(BatchResponse), nil
+}
+
+// applyBatch applies a batch entry in b.
+func applyBatch(b WriteBatch, entry consensus.LogEntry) (BatchResponse, error) {
+	resp := BatchResponse{Revision: entry.Index, Responses: []TxnOpResult{}}
+	var ops []TxnOp
+	if err := json.Unmarshal([]byte(entry.Value), &ops); err != nil {
+		fmt.Printf("⚠️ Skipping malformed batch at index %d: %v\n", entry.Index, err)
+		return resp, nil
+	}
+	var err error
+	resp.Responses, err = applyOps(b, ops, entry.Index)
+	return resp, err
+}
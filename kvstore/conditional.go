@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"fmt"
+	"kvstore/consensus"
+)
+
+// Conditional operations. Their condition is checked against the value at apply time,
+// in the same batch as the write, so every replica reaches the same outcome.
+const (
+	opCAS         = "CAS"
+	opPutIfAbsent = "PUT_IF_ABSENT"
+	opDeleteIf    = "DELETE_IF"
+)
+
+// resultRetention is how many log indexes back an operation's outcome is kept for the
+// proposer to collect.
+const resultRetention = 1024
+
+// CASResult is the outcome of a conditional write. Value and Exists describe the key
+// after the operation: the new value on success, the current one on failure.
+type CASResult struct {
+	Succeeded bool   `json:"succeeded"`
+	Value     string `json:"value"`
+	Version   uint64 `json:"version,omitempty"`
+	Exists    bool   `json:"exists"`
+}
+
+// CompareAndSwap sets key to value only if its current value is expected.
+func (kv *KVStore) CompareAndSwap(key, expected, value string) (CASResult, error) {
+	return kv.proposeConditional(consensus.LogEntry{OpType: opCAS, Key: key, Expected: expected, Value: value})
+}
+
+// PutIfAbsent sets key to value only if the key does not exist.
+func (kv *KVStore) PutIfAbsent(key, value string) (CASResult, error) {
+	return kv.proposeConditional(consensus.LogEntry{OpType: opPutIfAbsent, Key: key, Value: value})
+}
+
+// DeleteIfValue deletes key only if its current value is expected.
+func (kv *KVStore) DeleteIfValue(key, expected string) (CASResult, error) {
+	return kv.proposeConditional(consensus.LogEntry{OpType: opDeleteIf, Key: key, Expected: expected})
+}
+
+// proposeConditional replicates a conditional operation and returns how it was applied.
+func (kv *KVStore) proposeConditional(op consensus.LogEntry) (CASResult, error) {
+	result, err := kv.proposeForResult(op)
+	if err != nil {
+		return CASResult{}, err
+	}
+	return result.(CASResult), nil
+}
+
+// proposeForResult replicates op, waits for it to be applied and collects the outcome
+// the apply loop recorded for it.
+func (kv *KVStore) proposeForResult(op consensus.LogEntry) (interface{}, error) {
+	index, err := kv.propose(op)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.waitForApplied(index); err != nil {
+		return nil, err
+	}
+
+	kv.applyMu.Lock()
+	defer kv.applyMu.Unlock()
+	result, ok := kv.results[index]
+	if !ok {
+		return nil, fmt.Errorf("outcome of index %d is no longer available", index)
+	}
+	delete(kv.results, index)
+	return result, nil
+}
+
+// applyConditional evaluates and applies a conditional operation in b.
+func applyConditional(b WriteBatch, entry consensus.LogEntry) (CASResult, error) {
+	_, current, err := lastVersion(b, entry.Key)
+	if err != nil {
+		return CASResult{}, err
+	}
+	unchanged := CASResult{}
+	if current != nil {
+		unchanged = CASResult{Value: current.Value, Version: current.Version, Exists: true}
+	}
+
+	switch entry.OpType {
+	case opCAS:
+		if current == nil || current.Value != entry.Expected {
+			return unchanged, nil
+		}
+		kv, err := putKey(b, KeyValue{Key: entry.Key, Value: entry.Value}, entry.Index)
+		return CASResult{Succeeded: true, Value: kv.Value, Version: kv.Version, Exists: true}, err
+	case opPutIfAbsent:
+		if current != nil {
+			return unchanged, nil
+		}
+		kv, err := putKey(b, KeyValue{Key: entry.Key, Value: entry.Value}, entry.Index)
+		return CASResult{Succeeded: true, Value: kv.Value, Version: kv.Version, Exists: true}, err
+	case opDeleteIf:
+		if current == nil || current.Value != entry.Expected {
+			return unchanged, nil
+		}
+		_, err := deleteKey(b, entry.Key, entry.Index)
+		return CASResult{Succeeded: true}, err
+	}
+	return CASResult{}, fmt.Errorf("not a conditional operation: %q", entry.OpType)
+}
+
+// recordResultLocked keeps an operation's outcome for its proposer and forgets old ones.
+// Caller holds kv.applyMu.
+func (kv *KVStore) recordResultLocked(index uint64, result interface{}) {
+	kv.results[index] = result
+	if index <= resultRetention {
+		return
+	}
+	for i := range kv.results {
+		if i <= index-resultRetention {
+			delete(kv.results, i)
+		}
+	}
+}
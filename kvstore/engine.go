@@ -0,0 +1,119 @@
+package kvstore
+
+import "fmt"
+
+// StorageEngine keeps a KVStore's state: the current version of each key, the retained
+// history of every key, the granted leases and the log index the state reflects.
+// Versioning, conditions, expiry and leases are the store's own logic, written against
+// this interface, so an engine only stores records and finds them again.
+//
+// Every write goes through a WriteBatch, which the apply loop commits once per group of
+// entries. The store's lock keeps its readers out while a batch is open, so engines need
+// not isolate the two.
+type StorageEngine interface {
+	Reader
+
+	// Range calls fn with the current keys in [start, end), in key order, until fn
+	// returns false. An empty end leaves the range open. Keys expired at now (Unix
+	// milliseconds) are skipped, unless now is 0.
+	Range(start, end string, now int64, fn func(KeyValue) bool) error
+	// Count returns how many keys in [start, end) have not expired at now.
+	Count(start, end string, now int64) (int, error)
+	// History returns the retained versions of key, oldest first.
+	History(key string) ([]HistoryEntry, error)
+	// Expired returns up to limit keys whose deadline is at or before now, soonest first
+	// and in key order among equal deadlines.
+	Expired(now int64, limit int) ([]KeyValue, error)
+	// Leases returns the TTL, in seconds, of every granted lease by ID.
+	Leases() (map[uint64]int64, error)
+	// AppliedIndex returns the log index the stored state reflects.
+	AppliedIndex() (uint64, error)
+
+	// Begin starts an atomic group of writes.
+	Begin() (WriteBatch, error)
+	// Snapshot calls fn with every record of the state: each current key, then each
+	// retained version, then each lease. Records are the same for every engine, so a
+	// snapshot taken from one engine restores into any other.
+	Snapshot(fn func(SnapshotRecord) error) error
+	// Restore replaces the whole state with the records next returns, until it returns
+	// io.EOF, as of log index index.
+	Restore(index uint64, next func() (SnapshotRecord, error)) error
+	Close() error
+}
+
+// Reader is the lookup side shared by an engine and its write batches; a batch sees its
+// own writes.
+type Reader interface {
+	// Get returns key's current version, expired or not.
+	Get(key string) (KeyValue, bool, error)
+	// LastVersion returns the newest version recorded in key's history, or 0.
+	LastVersion(key string) (uint64, error)
+	// Lease returns a granted lease's TTL in seconds.
+	Lease(id uint64) (int64, bool, error)
+	// LeaseKeys lists the keys attached to a lease, in key order.
+	LeaseKeys(id uint64) ([]string, error)
+	// Changes calls fn with the versions written to keys in [start, end) at revisions
+	// [from, to], in the order they were written.
+	Changes(start, end string, from, to uint64, fn func(WatchEvent) error) error
+}
+
+// WriteBatch is an atomic group of writes. Nothing it writes is visible outside it, or
+// durable, until Commit.
+type WriteBatch interface {
+	Reader
+
+	// Put makes kv the current version of its key.
+	Put(kv KeyValue) error
+	// Delete removes key's current version.
+	Delete(key string) error
+	// AddVersion records a version of key in its history.
+	AddVersion(key string, h HistoryEntry) error
+	// PruneHistory drops the versions last modified at or before rev, except each key's
+	// newest. Keeping a deleted key's tombstone lets LastVersion continue its numbering.
+	PruneHistory(rev uint64) error
+	PutLease(id uint64, ttl int64) error
+	DeleteLease(id uint64) error
+	SetAppliedIndex(index uint64) error
+
+	Commit() error
+	// Rollback discards the batch's writes. After Commit it does nothing.
+	Rollback() error
+}
+
+// SnapshotRecord is one record of a snapshot, and one line of a snapshot's data file: a
+// current key or, with History set, one retained version.
+type SnapshotRecord struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	Version        uint64 `json:"version,omitempty"`
+	CreateRevision uint64 `json:"createRevision,omitempty"`
+	ModRevision    uint64 `json:"modRevision,omitempty"`
+	ExpiresAt      int64  `json:"expiresAt,omitempty"`
+	Lease          uint64 `json:"lease,omitempty"`
+	History        bool   `json:"history,omitempty"`
+	Deleted        bool   `json:"deleted,omitempty"`
+	// LeaseRecord marks a granted lease: Lease is its ID and TTL its length in seconds.
+	LeaseRecord bool  `json:"leaseRecord,omitempty"`
+	TTL         int64 `json:"ttl,omitempty"`
+}
+
+// Storage engines selectable with OpenStorageEngine.
+const (
+	EngineSQLite = "sqlite"
+	EngineMemory = "memory"
+	EngineLog    = "log"
+)
+
+// OpenStorageEngine opens the named engine. path is the SQLite database or the log file;
+// the memory engine ignores it.
+func OpenStorageEngine(name, path string) (StorageEngine, error) {
+	switch name {
+	case EngineSQLite:
+		return NewSQLiteEngine(path)
+	case EngineMemory:
+		return NewMemoryEngine(), nil
+	case EngineLog:
+		return NewLogEngine(path)
+	}
+	return nil, fmt.Errorf("unknown storage engine %q (want %s, %s or %s)", name, EngineSQLite, EngineMemory, EngineLog)
+}
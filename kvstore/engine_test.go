@@ -0,0 +1,378 @@
+package kvstore
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testEngines opens each storage engine in a fresh directory.
+var testEngines = []struct {
+	name string
+	open func(t *testing.T) StorageEngine
+}{
+	{EngineSQLite, func(t *testing.T) StorageEngine {
+		e, err := NewSQLiteEngine(filepath.Join(t.TempDir(), "kv.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}},
+	{EngineMemory, func(t *testing.T) StorageEngine { return NewMemoryEngine() }},
+	{EngineLog, func(t *testing.T) StorageEngine {
+		e, err := NewLogEngine(filepath.Join(t.TempDir(), "kv.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}},
+}
+
+// write runs fn in one write batch and commits it.
+func write(t *testing.T, e StorageEngine, fn func(b WriteBatch)) {
+	t.Helper()
+	b, err := e.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Rollback()
+	fn(b)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPut makes kv the current version of its key at revision rev, and records it.
+func testPut(t *testing.T, b WriteBatch, kv KeyValue, rev uint64) {
+	t.Helper()
+	last, err := b.LastVersion(kv.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Version, kv.ModRevision = last+1, rev
+	if kv.CreateRevision = rev; kv.Version > 1 {
+		if prev, ok, _ := b.Get(kv.Key); ok {
+			kv.CreateRevision = prev.CreateRevision
+		}
+	}
+	if err := b.Put(kv); err != nil {
+		t.Fatal(err)
+	}
+	h := HistoryEntry{Version: kv.Version, Value: kv.Value, CreateRevision: kv.CreateRevision, ModRevision: rev}
+	if err := b.AddVersion(kv.Key, h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testDelete removes key at revision rev and records its tombstone.
+func testDelete(t *testing.T, b WriteBatch, key string, rev uint64) {
+	t.Helper()
+	last, err := b.LastVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddVersion(key, HistoryEntry{Version: last + 1, ModRevision: rev, Deleted: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rangeKeys(t *testing.T, e StorageEngine, start, end string, now int64) []string {
+	t.Helper()
+	keys := []string{}
+	if err := e.Range(start, end, now, func(kv KeyValue) bool {
+		keys = append(keys, kv.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func expiredKeys(t *testing.T, e StorageEngine, now int64, limit int) []string {
+	t.Helper()
+	due, err := e.Expired(now, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, kv := range due {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func leaseKeys(t *testing.T, r Reader, id uint64) []string {
+	t.Helper()
+	keys, err := r.LeaseKeys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]string{}, keys...)
+}
+
+func snapshotRecords(t *testing.T, e StorageEngine) []SnapshotRecord {
+	t.Helper()
+	var recs []SnapshotRecord
+	if err := e.Snapshot(func(rec SnapshotRecord) error {
+		recs = append(recs, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func check[T any](t *testing.T, what string, got, want T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+// TestStorageEngineConformance runs the same checks against every storage engine, so
+// the store behaves the same whichever one a node uses.
+func TestStorageEngineConformance(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, e StorageEngine)
+	}{
+		{"put and delete", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "a", Value: "1"}, 1)
+				testPut(t, b, KeyValue{Key: "b", Value: "2"}, 2)
+				testPut(t, b, KeyValue{Key: "a", Value: "3"}, 3)
+				if kv, _, _ := b.Get("a"); kv.Value != "3" {
+					t.Errorf("batch reads a = %q, want its own write", kv.Value)
+				}
+				testDelete(t, b, "b", 4)
+				if err := b.SetAppliedIndex(4); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			kv, ok, err := e.Get("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, "a", kv, KeyValue{Key: "a", Value: "3", Version: 2, CreateRevision: 1, ModRevision: 3})
+			check(t, "a exists", ok, true)
+			if _, ok, _ := e.Get("b"); ok {
+				t.Error("deleted key b still exists")
+			}
+			last, _ := e.LastVersion("b")
+			check(t, "last version of b", last, uint64(2))
+			applied, _ := e.AppliedIndex()
+			check(t, "applied index", applied, uint64(4))
+
+			// A rolled-back batch leaves no trace, in the keys or their indexes.
+			b, err := e.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testPut(t, b, KeyValue{Key: "c", Value: "4", ExpiresAt: 100, Lease: 9}, 5)
+			testDelete(t, b, "a", 5)
+			b.SetAppliedIndex(5)
+			if err := b.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			check(t, "keys after rollback", rangeKeys(t, e, "", "", 0), []string{"a"})
+			check(t, "expired after rollback", expiredKeys(t, e, 1000, 10), []string{})
+			check(t, "lease keys after rollback", leaseKeys(t, e, 9), []string{})
+			applied, _ = e.AppliedIndex()
+			check(t, "applied index after rollback", applied, uint64(4))
+		}},
+
+		{"range and count with expiry", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "k1", Value: "v"}, 1)
+				testPut(t, b, KeyValue{Key: "k2", Value: "v", ExpiresAt: 100}, 2)
+				testPut(t, b, KeyValue{Key: "k3", Value: "v", ExpiresAt: 300}, 3)
+				testPut(t, b, KeyValue{Key: "l1", Value: "v"}, 4)
+			})
+
+			check(t, "range at 200", rangeKeys(t, e, "k", "l", 200), []string{"k1", "k3"})
+			check(t, "range ignoring expiry", rangeKeys(t, e, "k", "l", 0), []string{"k1", "k2", "k3"})
+			check(t, "open range", rangeKeys(t, e, "k2", "", 200), []string{"k3", "l1"})
+			count, err := e.Count("k", "l", 200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, "count at 200", count, 2)
+			count, _ = e.Count("", "", 0)
+			check(t, "count of every key", count, 4)
+
+			var first []string
+			e.Range("", "", 0, func(kv KeyValue) bool {
+				first = append(first, kv.Key)
+				return false
+			})
+			check(t, "range stopped after one key", first, []string{"k1"})
+		}},
+
+		{"changes", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "a", Value: "1"}, 1)
+				testPut(t, b, KeyValue{Key: "b", Value: "2"}, 2)
+				testPut(t, b, KeyValue{Key: "a", Value: "3"}, 3)
+				testDelete(t, b, "b", 3)
+				testPut(t, b, KeyValue{Key: "c", Value: "4"}, 4)
+			})
+
+			var events []WatchEvent
+			if err := e.Changes("a", "c", 2, 3, func(ev WatchEvent) error {
+				events = append(events, ev)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			check(t, "changes to [a, c) in revisions 2..3", events, []WatchEvent{
+				{Type: "PUT", Key: "b", Value: "2", Version: 1, CreateRevision: 2, ModRevision: 2},
+				{Type: "PUT", Key: "a", Value: "3", Version: 2, CreateRevision: 1, ModRevision: 3},
+				{Type: "DELETE", Key: "b", Version: 2, ModRevision: 3},
+			})
+		}},
+
+		{"prune history", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "x", Value: "1"}, 1)
+				testPut(t, b, KeyValue{Key: "y", Value: "1"}, 1)
+				testPut(t, b, KeyValue{Key: "x", Value: "2"}, 2)
+				testDelete(t, b, "y", 2)
+				testPut(t, b, KeyValue{Key: "x", Value: "3"}, 3)
+				testPut(t, b, KeyValue{Key: "x", Value: "4"}, 5)
+			})
+			write(t, e, func(b WriteBatch) {
+				if err := b.PruneHistory(3); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			history, err := e.History("x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, "history of x", history, []HistoryEntry{
+				{Version: 4, Value: "4", CreateRevision: 1, ModRevision: 5},
+			})
+			// A deleted key keeps its tombstone, its newest version, so numbering goes on.
+			history, _ = e.History("y")
+			check(t, "history of y", history, []HistoryEntry{{Version: 2, ModRevision: 2, Deleted: true}})
+			last, _ := e.LastVersion("y")
+			check(t, "last version of y", last, uint64(2))
+
+			write(t, e, func(b WriteBatch) { testPut(t, b, KeyValue{Key: "z", Value: "1"}, 6) })
+			write(t, e, func(b WriteBatch) { b.PruneHistory(6) })
+			history, _ = e.History("z")
+			check(t, "history of z after pruning its only version", len(history), 1)
+		}},
+
+		{"snapshot and restore", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "a", Value: "1", ExpiresAt: 500}, 1)
+				testPut(t, b, KeyValue{Key: "b", Value: "2", Lease: 7}, 2)
+				testPut(t, b, KeyValue{Key: "a", Value: "3", ExpiresAt: 200}, 3)
+				testPut(t, b, KeyValue{Key: "c", Value: "4"}, 4)
+				testDelete(t, b, "c", 5)
+				b.PutLease(7, 30)
+				b.PutLease(8, 60)
+				b.SetAppliedIndex(5)
+			})
+			recs := snapshotRecords(t, e)
+
+			for _, into := range testEngines {
+				t.Run("into "+into.name, func(t *testing.T) {
+					restored := into.open(t)
+					defer restored.Close()
+					// Restoring replaces whatever the engine held.
+					write(t, restored, func(b WriteBatch) { testPut(t, b, KeyValue{Key: "old", Value: "v", ExpiresAt: 1}, 1) })
+
+					i := 0
+					if err := restored.Restore(9, func() (SnapshotRecord, error) {
+						if i == len(recs) {
+							return SnapshotRecord{}, io.EOF
+						}
+						i++
+						return recs[i-1], nil
+					}); err != nil {
+						t.Fatal(err)
+					}
+					check(t, "records after a round trip", snapshotRecords(t, restored), recs)
+					applied, _ := restored.AppliedIndex()
+					check(t, "applied index", applied, uint64(9))
+					leases, _ := restored.Leases()
+					check(t, "leases", leases, map[uint64]int64{7: 30, 8: 60})
+					check(t, "expired", expiredKeys(t, restored, 1000, 10), []string{"a"})
+					check(t, "lease keys", leaseKeys(t, restored, 7), []string{"b"})
+					last, _ := restored.LastVersion("c")
+					check(t, "last version of deleted c", last, uint64(2))
+				})
+			}
+		}},
+
+		{"expired", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "late", Value: "v", ExpiresAt: 300}, 1)
+				testPut(t, b, KeyValue{Key: "b-soon", Value: "v", ExpiresAt: 100}, 2)
+				testPut(t, b, KeyValue{Key: "a-soon", Value: "v", ExpiresAt: 100}, 3)
+				testPut(t, b, KeyValue{Key: "mid", Value: "v", ExpiresAt: 200}, 4)
+				testPut(t, b, KeyValue{Key: "never", Value: "v"}, 5)
+			})
+
+			check(t, "expired at 250", expiredKeys(t, e, 250, 10), []string{"a-soon", "b-soon", "mid"})
+			check(t, "expired at 250, limit 2", expiredKeys(t, e, 250, 2), []string{"a-soon", "b-soon"})
+			check(t, "expired at 99", expiredKeys(t, e, 99, 10), []string{})
+
+			// A new deadline moves the key; dropping it or the key takes it out.
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "late", Value: "v", ExpiresAt: 150}, 6)
+				testPut(t, b, KeyValue{Key: "mid", Value: "v"}, 6)
+				testDelete(t, b, "a-soon", 6)
+			})
+			check(t, "expired at 250 after updates", expiredKeys(t, e, 250, 10), []string{"b-soon", "late"})
+		}},
+
+		{"lease keys", func(t *testing.T, e StorageEngine) {
+			write(t, e, func(b WriteBatch) {
+				b.PutLease(7, 30)
+				b.PutLease(8, 60)
+				testPut(t, b, KeyValue{Key: "b", Value: "v", Lease: 7}, 1)
+				testPut(t, b, KeyValue{Key: "a", Value: "v", Lease: 7}, 2)
+				testPut(t, b, KeyValue{Key: "c", Value: "v", Lease: 8}, 3)
+				testPut(t, b, KeyValue{Key: "d", Value: "v"}, 4)
+				check(t, "batch lease keys", leaseKeys(t, b, 7), []string{"a", "b"})
+			})
+			check(t, "keys of lease 7", leaseKeys(t, e, 7), []string{"a", "b"})
+			check(t, "keys of lease 8", leaseKeys(t, e, 8), []string{"c"})
+			check(t, "keys of an unknown lease", leaseKeys(t, e, 9), []string{})
+
+			write(t, e, func(b WriteBatch) {
+				testPut(t, b, KeyValue{Key: "b", Value: "v", Lease: 8}, 5)
+				testDelete(t, b, "a", 5)
+				b.DeleteLease(7)
+			})
+			check(t, "keys of lease 7 after moves", leaseKeys(t, e, 7), []string{})
+			check(t, "keys of lease 8 after moves", leaseKeys(t, e, 8), []string{"b", "c"})
+			leases, _ := e.Leases()
+			check(t, "leases", leases, map[uint64]int64{8: 60})
+			if _, ok, _ := e.Lease(7); ok {
+				t.Error("revoked lease 7 still granted")
+			}
+		}},
+	}
+
+	for _, engine := range testEngines {
+		t.Run(engine.name, func(t *testing.T) {
+			for _, c := range checks {
+				t.Run(c.name, func(t *testing.T) {
+					e := engine.open(t)
+					defer e.Close()
+					c.run(t, e)
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package kvstore
+
+import (
+	"fmt"
+	"kvstore/consensus"
+	"strconv"
+	"time"
+)
+
+// Leases own groups of keys. Granting and revoking a lease are replicated: a lease's ID is
+// the log index that granted it, and revoking it deletes every attached key in the same
+// entry. Deadlines are not replicated. Only the leader tracks them, in memory, and clients
+// keep a lease alive by heartbeating the leader. A new leader restarts every deadline at a
+// full TTL, so a lease never expires early because leadership moved; when a deadline
+// passes, the leader proposes the revoke.
+const (
+	opLeaseGrant  = "LEASE_GRANT"
+	opLeaseRevoke = "LEASE_REVOKE"
+)
+
+// ErrLeaseNotFound means the lease was never granted or has already been revoked.
+var ErrLeaseNotFound = fmt.Errorf("lease not found")
+
+// LeaseInfo describes a lease. Remaining is only known to the leader.
+type LeaseInfo struct {
+	ID        uint64   `json:"id"`
+	TTL       int64    `json:"ttl"`
+	Remaining int64    `json:"remaining,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+}
+
+// leaseDeadline is the leader's view of when a lease runs out.
+type leaseDeadline struct {
+	expires  time.Time
+	revoking bool
+}
+
+// GrantLease creates a lease that lives for ttl unless it is kept alive.
+func (kv *KVStore) GrantLease(ttl time.Duration) (LeaseInfo, error) {
+	seconds := int64(ttl / time.Second)
+	if seconds <= 0 {
+		return LeaseInfo{}, fmt.Errorf("lease ttl must be at least one second")
+	}
+	result, err := kv.proposeForResult(consensus.LogEntry{OpType: opLeaseGrant, Value: strconv.FormatInt(seconds, 10)})
+	if err != nil {
+		return LeaseInfo{}, err
+	}
+	info := result.(LeaseInfo)
+	fmt.Printf("🎫 Granted lease %d with ttl %ds\n", info.ID, info.TTL)
+	return info, nil
+}
+
+// RevokeLease deletes a lease and every key attached to it.
+func (kv *KVStore) RevokeLease(id uint64) (LeaseInfo, error) {
+	result, err := kv.proposeForResult(consensus.LogEntry{OpType: opLeaseRevoke, Lease: id})
+	if err != nil {
+		return LeaseInfo{}, err
+	}
+	if err, ok := result.(error); ok {
+		return LeaseInfo{}, err
+	}
+	return result.(LeaseInfo), nil
+}
+
+// PutWithLease stores a key-value pair owned by a lease, which deletes it on expiry.
+func (kv *KVStore) PutWithLease(key, value string, lease uint64) error {
+	result, err := kv.proposeForResult(consensus.LogEntry{OpType: "PUT", Key: key, Value: value, Lease: lease})
+	if err != nil {
+		return err
+	}
+	if err, ok := result.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// KeepAliveLease restarts a lease's deadline. Only the leader tracks deadlines.
+func (kv *KVStore) KeepAliveLease(id uint64) (LeaseInfo, error) {
+	if !kv.consensus.State.IsLeader() {
+		return LeaseInfo{}, consensus.ErrNotLeader
+	}
+	info, err := kv.readLease(id, false)
+	if err != nil {
+		return LeaseInfo{}, err
+	}
+
+	kv.leaseMu.Lock()
+	defer kv.leaseMu.Unlock()
+	if d, ok := kv.leaseDeadlines[id]; ok && d.revoking {
+		return LeaseInfo{}, ErrLeaseNotFound
+	}
+	kv.leaseDeadlines[id] = &leaseDeadline{expires: time.Now().Add(time.Duration(info.TTL) * time.Second)}
+	info.Remaining = info.TTL
+	return info, nil
+}
+
+// LeaseTimeToLive describes a lease and its attached keys, with the time left on it.
+func (kv *KVStore) LeaseTimeToLive(id uint64) (LeaseInfo, error) {
+	if !kv.consensus.State.IsLeader() {
+		return LeaseInfo{}, consensus.ErrNotLeader
+	}
+	info, err := kv.readLease(id, true)
+	if err != nil {
+		return LeaseInfo{}, err
+	}
+
+	kv.leaseMu.Lock()
+	defer kv.leaseMu.Unlock()
+	info.Remaining = info.TTL
+	if d, ok := kv.leaseDeadlines[id]; ok {
+		info.Remaining = remainingTTL(d.expires.UnixMilli(), time.Now())
+	}
+	return info, nil
+}
+
+// readLease reads a lease and, optionally, its keys.
+func (kv *KVStore) readLease(id uint64, withKeys bool) (LeaseInfo, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	info := LeaseInfo{ID: id}
+	ttl, found, err := kv.engine.Lease(id)
+	if err != nil {
+		return info, err
+	}
+	if !found {
+		return info, ErrLeaseNotFound
+	}
+	info.TTL = ttl
+	if withKeys {
+		info.Keys, err = kv.engine.LeaseKeys(id)
+	}
+	return info, err
+}
+
+// expireLeases revokes leases whose deadline has passed. It runs on the leader's expiry
+// ticker; a lease seen for the first time, or for the first time since this node became
+// leader, starts with a full TTL.
+func (kv *KVStore) expireLeases(now time.Time) {
+	kv.mu.RLock()
+	ttls, err := kv.engine.Leases()
+	kv.mu.RUnlock()
+	if err != nil {
+		fmt.Printf("❌ Failed to scan leases: %v\n", err)
+		return
+	}
+
+	var due []uint64
+	kv.leaseMu.Lock()
+	for id := range kv.leaseDeadlines {
+		if _, ok := ttls[id]; !ok {
+			delete(kv.leaseDeadlines, id)
+		}
+	}
+	for id, ttl := range ttls {
+		d, ok := kv.leaseDeadlines[id]
+		if !ok {
+			kv.leaseDeadlines[id] = &leaseDeadline{expires: now.Add(time.Duration(ttl) * time.Second)}
+			continue
+		}
+		if !d.revoking && !now.Before(d.expires) {
+			d.revoking = true
+			due = append(due, id)
+		}
+	}
+	kv.leaseMu.Unlock()
+
+	for _, id := range due {
+		if !kv.consensus.State.IsLeader() {
+			return
+		}
+		info, err := kv.RevokeLease(id)
+		if err != nil && err != ErrLeaseNotFound {
+			fmt.Printf("❌ Failed to revoke expired lease %d: %v\n", id, err)
+			kv.leaseMu.Lock()
+			if d, ok := kv.leaseDeadlines[id]; ok {
+				d.revoking = false
+			}
+			kv.leaseMu.Unlock()
+			continue
+		}
+		fmt.Printf("⌛ Lease %d expired; deleted %d keys\n", id, len(info.Keys))
+	}
+}
+
+// forgetLeaseDeadlines drops the deadlines this node tracked while it was leader.
+func (kv *KVStore) forgetLeaseDeadlines() {
+	kv.leaseMu.Lock()
+	if len(kv.leaseDeadlines) > 0 {
+		kv.leaseDeadlines = make(map[uint64]*leaseDeadline)
+	}
+	kv.leaseMu.Unlock()
+}
+
+// applyLeaseGrant records a new lease whose ID is the granting entry's index.
+func applyLeaseGrant(b WriteBatch, entry consensus.LogEntry) (LeaseInfo, error) {
+	ttl, err := strconv.ParseInt(entry.Value, 10, 64)
+	if err != nil || ttl <= 0 {
+		fmt.Printf("⚠️ Skipping lease grant with invalid ttl %q at index %d\n", entry.Value, entry.Index)
+		return LeaseInfo{}, nil
+	}
+	err = b.PutLease(entry.Index, ttl)
+	return LeaseInfo{ID: entry.Index, TTL: ttl}, err
+}
+
+// applyLeaseRevoke deletes a lease and its keys. It returns ErrLeaseNotFound, as the
+// outcome rather than a failure, for a lease that does not exist.
+func applyLeaseRevoke(b WriteBatch, entry consensus.LogEntry) (interface{}, error) {
+	info := LeaseInfo{ID: entry.Lease}
+	ttl, found, err := b.Lease(entry.Lease)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return ErrLeaseNotFound, nil
+	}
+	info.TTL = ttl
+	if info.Keys, err = b.LeaseKeys(entry.Lease); err != nil {
+		return nil, err
+	}
+	for _, key := range info.Keys {
+		if _, err := deleteKey(b, key, entry.Index); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.DeleteLease(entry.Lease); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// applyLeasedPut writes a key owned by a lease, unless the lease is gone by the time the
+// entry is applied.
+func applyLeasedPut(b WriteBatch, entry consensus.LogEntry) (interface{}, error) {
+	_, found, err := b.Lease(entry.Lease)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return ErrLeaseNotFound, nil
+	}
+	return putKey(b, KeyValue{Key: entry.Key, Value: entry.Value, Lease: entry.Lease}, entry.Index)
+}
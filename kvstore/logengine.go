@@ -0,0 +1,293 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// logEngine serves everything from an in-memory engine and makes it durable by appending
+// each write batch to a log file as JSON lines, ending with a commit record, with one
+// fsync per batch. Opening the file replays it; a batch without its commit record was
+// torn by a crash and is cut off. Once the log has grown well past the live data, it is
+// compacted by rewriting the current state to a new file.
+type logEngine struct {
+	*memoryEngine
+	path string
+	f    *os.File
+	size int64
+	// compactedSize is the file's size after the last compaction.
+	compactedSize int64
+}
+
+// logBatch is a memory batch whose writes are also queued as log records.
+type logBatch struct {
+	*memoryBatch
+	engine *logEngine
+	buf    bytes.Buffer
+	enc    *json.Encoder
+}
+
+// logRecord is one line of the log.
+type logRecord struct {
+	Op      string        `json:"op"`
+	KV      *KeyValue     `json:"kv,omitempty"`
+	Key     string        `json:"key,omitempty"`
+	Version *HistoryEntry `json:"version,omitempty"`
+	ID      uint64        `json:"id,omitempty"`
+	TTL     int64         `json:"ttl,omitempty"`
+	Index   uint64        `json:"index,omitempty"`
+}
+
+// Log record operations.
+const (
+	logPut     = "put"
+	logDelete  = "delete"
+	logVersion = "version"
+	logPrune   = "prune"
+	logLease   = "lease"
+	logUnlease = "unlease"
+	logApplied = "applied"
+	logCommit  = "commit"
+)
+
+// minCompactSize is the smallest log worth compacting. Above it, the log is compacted
+// once it reaches twice its size after the last compaction.
+const minCompactSize = 16 << 20
+
+// NewLogEngine opens, creating if needed, the log at path and replays it into memory.
+func NewLogEngine(path string) (StorageEngine, error) {
+	fmt.Println("📂 Opening storage log at:", path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage log: %v", err)
+	}
+	e := &logEngine{memoryEngine: newMemoryEngine(), path: path, f: f}
+	if err := e.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	e.compactedSize = e.size
+	fmt.Printf("📜 Replayed %d bytes of storage log up to index %d\n", e.size, e.applied)
+	return e, nil
+}
+
+// replay applies every committed batch in the file and cuts off whatever follows the last
+// one.
+func (e *logEngine) replay() error {
+	r := bufio.NewReader(e.f)
+	var offset int64
+	var pending []logRecord
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read storage log: %v", err)
+		}
+		offset += int64(len(line))
+
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			break
+		}
+		if rec.Op != logCommit {
+			pending = append(pending, rec)
+			continue
+		}
+		for _, rec := range pending {
+			e.memState.replay(rec)
+		}
+		pending = pending[:0]
+		e.size = offset
+	}
+
+	if info, err := e.f.Stat(); err == nil && info.Size() > e.size {
+		fmt.Printf("✂️ Discarding %d bytes of uncommitted storage log\n", info.Size()-e.size)
+		if err := e.f.Truncate(e.size); err != nil {
+			return fmt.Errorf("failed to truncate storage log: %v", err)
+		}
+	}
+	return nil
+}
+
+// replay applies one log record to the state.
+func (s *memState) replay(rec logRecord) {
+	switch rec.Op {
+	case logPut:
+		s.put(*rec.KV)
+	case logDelete:
+		s.delete(rec.Key)
+	case logVersion:
+		s.addVersion(rec.Key, *rec.Version)
+	case logPrune:
+		s.pruneHistory(rec.Index)
+	case logLease:
+		s.leases[rec.ID] = rec.TTL
+	case logUnlease:
+		delete(s.leases, rec.ID)
+	case logApplied:
+		s.applied = rec.Index
+	}
+}
+
+func (e *logEngine) Begin() (WriteBatch, error) {
+	b := &logBatch{memoryBatch: e.begin(), engine: e}
+	b.enc = json.NewEncoder(&b.buf)
+	return b, nil
+}
+
+func (e *logEngine) Restore(index uint64, next func() (SnapshotRecord, error)) error {
+	s, err := restoreMemState(index, next)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.compact(s); err != nil {
+		return err
+	}
+	e.memState = s
+	return nil
+}
+
+func (e *logEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// compact replaces the log with one that holds only s. Caller holds e.mu.
+func (e *logEngine) compact(s *memState) error {
+	tmp := e.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted storage log: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	err = s.snapshot(func(rec SnapshotRecord) error {
+		switch {
+		case rec.LeaseRecord:
+			return enc.Encode(logRecord{Op: logLease, ID: rec.Lease, TTL: rec.TTL})
+		case rec.History:
+			h := HistoryEntry{Version: rec.Version, Value: rec.Value, CreateRevision: rec.CreateRevision, ModRevision: rec.ModRevision, Deleted: rec.Deleted}
+			return enc.Encode(logRecord{Op: logVersion, Key: rec.Key, Version: &h})
+		}
+		kv := KeyValue{Key: rec.Key, Value: rec.Value, Version: rec.Version, CreateRevision: rec.CreateRevision,
+			ModRevision: rec.ModRevision, ExpiresAt: rec.ExpiresAt, Lease: rec.Lease}
+		return enc.Encode(logRecord{Op: logPut, KV: &kv})
+	})
+	if err == nil {
+		err = enc.Encode(logRecord{Op: logApplied, Index: s.applied})
+	}
+	if err == nil {
+		err = enc.Encode(logRecord{Op: logCommit})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write compacted storage log: %v", err)
+	}
+
+	if err := os.Rename(tmp, e.path); err != nil {
+		return fmt.Errorf("failed to replace storage log: %v", err)
+	}
+	if dir, err := os.Open(filepath.Dir(e.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	nf, err := os.OpenFile(e.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen storage log: %v", err)
+	}
+	info, err := nf.Stat()
+	if err != nil {
+		nf.Close()
+		return fmt.Errorf("failed to reopen storage log: %v", err)
+	}
+	e.f.Close()
+	e.f, e.size, e.compactedSize = nf, info.Size(), info.Size()
+	fmt.Printf("🗜️ Compacted storage log to %d bytes at index %d\n", e.size, s.applied)
+	return nil
+}
+
+func (b *logBatch) Put(kv KeyValue) error {
+	b.memoryBatch.Put(kv)
+	return b.enc.Encode(logRecord{Op: logPut, KV: &kv})
+}
+
+func (b *logBatch) Delete(key string) error {
+	b.memoryBatch.Delete(key)
+	return b.enc.Encode(logRecord{Op: logDelete, Key: key})
+}
+
+func (b *logBatch) AddVersion(key string, h HistoryEntry) error {
+	b.memoryBatch.AddVersion(key, h)
+	return b.enc.Encode(logRecord{Op: logVersion, Key: key, Version: &h})
+}
+
+func (b *logBatch) PruneHistory(rev uint64) error {
+	b.memoryBatch.PruneHistory(rev)
+	return b.enc.Encode(logRecord{Op: logPrune, Index: rev})
+}
+
+func (b *logBatch) PutLease(id uint64, ttl int64) error {
+	b.memoryBatch.PutLease(id, ttl)
+	return b.enc.Encode(logRecord{Op: logLease, ID: id, TTL: ttl})
+}
+
+func (b *logBatch) DeleteLease(id uint64) error {
+	b.memoryBatch.DeleteLease(id)
+	return b.enc.Encode(logRecord{Op: logUnlease, ID: id})
+}
+
+func (b *logBatch) SetAppliedIndex(index uint64) error {
+	b.memoryBatch.SetAppliedIndex(index)
+	return b.enc.Encode(logRecord{Op: logApplied, Index: index})
+}
+
+// Commit appends the batch to the log and syncs it before its writes become visible. If
+// the log cannot take it, the batch is rolled back and the log cut back to where it was.
+func (b *logBatch) Commit() error {
+	if b.done {
+		return nil
+	}
+	e := b.engine
+	if err := b.enc.Encode(logRecord{Op: logCommit}); err != nil {
+		b.memoryBatch.Rollback()
+		return err
+	}
+	_, err := e.f.Write(b.buf.Bytes())
+	if err == nil {
+		err = e.f.Sync()
+	}
+	if err != nil {
+		e.f.Truncate(e.size)
+		b.memoryBatch.Rollback()
+		return fmt.Errorf("failed to append to storage log: %v", err)
+	}
+	e.size += int64(b.buf.Len())
+
+	if e.size > max(minCompactSize, 2*e.compactedSize) {
+		if err := e.compact(e.memState); err != nil {
+			// The batch is already durable; compaction is retried after the next one.
+			fmt.Printf("❌ %v\n", err)
+		}
+	}
+	return b.memoryBatch.Commit()
+}
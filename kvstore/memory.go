@@ -0,0 +1,527 @@
+package kvstore
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// memoryEngine keeps the whole store in memory and loses it on exit, which suits tests
+// and caches. A restarted node rebuilds it from its consensus snapshot and log.
+type memoryEngine struct {
+	mu sync.RWMutex
+	*memState
+}
+
+// memState is the engine's data. Its methods do no locking.
+type memState struct {
+	keys    []string // current keys, sorted
+	current map[string]KeyValue
+	history map[string][]*memVersion // each key's retained versions, oldest first
+	changes []*memVersion            // every retained version, in the order written
+	leases  map[uint64]int64
+	applied uint64
+
+	// The current keys with a deadline, soonest first, and each lease's keys, sorted. They
+	// play the part of the SQLite engine's kv_store_expiry and kv_store_lease indexes.
+	expiry []memExpiry
+	leased map[uint64][]string
+}
+
+// memExpiry is a current key's place in the expiry index.
+type memExpiry struct {
+	at  int64
+	key string
+}
+
+func (e memExpiry) before(o memExpiry) bool {
+	return e.at < o.at || (e.at == o.at && e.key < o.key)
+}
+
+// memVersion is one retained version of a key.
+type memVersion struct {
+	key string
+	HistoryEntry
+}
+
+// memoryBatch writes straight into the state, holding the engine's lock until it ends,
+// and keeps the steps that undo each write in case it is rolled back.
+type memoryBatch struct {
+	*memState
+	engine *memoryEngine
+	undo   []func()
+	done   bool
+}
+
+// NewMemoryEngine returns an empty in-memory engine.
+func NewMemoryEngine() StorageEngine {
+	return newMemoryEngine()
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{memState: newMemState()}
+}
+
+func newMemState() *memState {
+	return &memState{
+		current: make(map[string]KeyValue),
+		history: make(map[string][]*memVersion),
+		leases:  make(map[uint64]int64),
+		leased:  make(map[uint64][]string),
+	}
+}
+
+func (s *memState) Get(key string) (KeyValue, bool, error) {
+	kv, ok := s.current[key]
+	if !ok {
+		return KeyValue{Key: key}, false, nil
+	}
+	return kv, true, nil
+}
+
+func (s *memState) LastVersion(key string) (uint64, error) {
+	versions := s.history[key]
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[len(versions)-1].Version, nil
+}
+
+func (s *memState) Lease(id uint64) (int64, bool, error) {
+	ttl, ok := s.leases[id]
+	return ttl, ok, nil
+}
+
+func (s *memState) LeaseKeys(id uint64) ([]string, error) {
+	return append([]string{}, s.leased[id]...), nil
+}
+
+func (s *memState) Changes(start, end string, from, to uint64, fn func(WatchEvent) error) error {
+	i := sort.Search(len(s.changes), func(i int) bool { return s.changes[i].ModRevision >= from })
+	for ; i < len(s.changes) && s.changes[i].ModRevision <= to; i++ {
+		v := s.changes[i]
+		if v.key < start || (end != "" && v.key >= end) {
+			continue
+		}
+		ev := WatchEvent{Type: "PUT", Key: v.key, Value: v.Value, Version: v.Version, CreateRevision: v.CreateRevision, ModRevision: v.ModRevision}
+		if v.Deleted {
+			ev.Type, ev.Value = "DELETE", ""
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn with the current keys in [start, end) not expired at now, until fn
+// returns false.
+func (s *memState) scan(start, end string, now int64, fn func(KeyValue) bool) {
+	for i := sort.SearchStrings(s.keys, start); i < len(s.keys); i++ {
+		if end != "" && s.keys[i] >= end {
+			return
+		}
+		kv := s.current[s.keys[i]]
+		if now != 0 && kv.ExpiresAt != 0 && kv.ExpiresAt <= now {
+			continue
+		}
+		if !fn(kv) {
+			return
+		}
+	}
+}
+
+// put makes kv current, returning the step that undoes it.
+func (s *memState) put(kv KeyValue) func() {
+	prev, existed := s.current[kv.Key]
+	s.current[kv.Key] = kv
+	if existed {
+		s.unindex(prev)
+		s.index(kv)
+		return func() {
+			s.unindex(kv)
+			s.current[kv.Key] = prev
+			s.index(prev)
+		}
+	}
+	s.keys = insertSorted(s.keys, kv.Key)
+	s.index(kv)
+	return func() {
+		s.unindex(kv)
+		delete(s.current, kv.Key)
+		s.keys = removeSorted(s.keys, kv.Key)
+	}
+}
+
+// delete removes key, returning the step that undoes it.
+func (s *memState) delete(key string) func() {
+	prev, existed := s.current[key]
+	if !existed {
+		return func() {}
+	}
+	s.unindex(prev)
+	delete(s.current, key)
+	s.keys = removeSorted(s.keys, key)
+	return func() {
+		s.current[key] = prev
+		s.keys = insertSorted(s.keys, key)
+		s.index(prev)
+	}
+}
+
+// index adds a current key to the expiry and lease indexes.
+func (s *memState) index(kv KeyValue) {
+	if kv.ExpiresAt != 0 {
+		e := memExpiry{at: kv.ExpiresAt, key: kv.Key}
+		i := sort.Search(len(s.expiry), func(i int) bool { return !s.expiry[i].before(e) })
+		s.expiry = append(s.expiry, memExpiry{})
+		copy(s.expiry[i+1:], s.expiry[i:])
+		s.expiry[i] = e
+	}
+	if kv.Lease != 0 {
+		s.leased[kv.Lease] = insertSorted(s.leased[kv.Lease], kv.Key)
+	}
+}
+
+// unindex removes a current key from the expiry and lease indexes.
+func (s *memState) unindex(kv KeyValue) {
+	if kv.ExpiresAt != 0 {
+		e := memExpiry{at: kv.ExpiresAt, key: kv.Key}
+		i := sort.Search(len(s.expiry), func(i int) bool { return !s.expiry[i].before(e) })
+		if i < len(s.expiry) && s.expiry[i] == e {
+			s.expiry = append(s.expiry[:i], s.expiry[i+1:]...)
+		}
+	}
+	if kv.Lease != 0 {
+		if keys := removeSorted(s.leased[kv.Lease], kv.Key); len(keys) > 0 {
+			s.leased[kv.Lease] = keys
+		} else {
+			delete(s.leased, kv.Lease)
+		}
+	}
+}
+
+// addVersion records a version, returning the step that undoes it.
+func (s *memState) addVersion(key string, h HistoryEntry) func() {
+	v := &memVersion{key: key, HistoryEntry: h}
+	s.history[key] = append(s.history[key], v)
+	s.changes = append(s.changes, v)
+	return func() {
+		versions := s.history[key]
+		if len(versions) == 1 {
+			delete(s.history, key)
+		} else {
+			s.history[key] = versions[:len(versions)-1]
+		}
+		s.changes = s.changes[:len(s.changes)-1]
+	}
+}
+
+// pruneHistory drops superseded versions modified at or before rev, returning the step
+// that undoes it. Each key's newest version, current or tombstone, is kept.
+func (s *memState) pruneHistory(rev uint64) func() {
+	oldHistory, oldChanges := s.history, s.changes
+	keep := func(v *memVersion) bool {
+		versions := oldHistory[v.key]
+		return v.ModRevision > rev || versions[len(versions)-1] == v
+	}
+	s.history = make(map[string][]*memVersion, len(oldHistory))
+	s.changes = make([]*memVersion, 0, len(oldChanges))
+	for _, v := range oldChanges {
+		if keep(v) {
+			s.changes = append(s.changes, v)
+		}
+	}
+	for key, versions := range oldHistory {
+		var kept []*memVersion
+		for _, v := range versions {
+			if keep(v) {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) > 0 {
+			s.history[key] = kept
+		}
+	}
+	return func() { s.history, s.changes = oldHistory, oldChanges }
+}
+
+// insertSorted adds key to the sorted list keys.
+func insertSorted(keys []string, key string) []string {
+	i := sort.SearchStrings(keys, key)
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+// removeSorted removes key from the sorted list keys, if it is there.
+func removeSorted(keys []string, key string) []string {
+	if i := sort.SearchStrings(keys, key); i < len(keys) && keys[i] == key {
+		keys = append(keys[:i], keys[i+1:]...)
+	}
+	return keys
+}
+
+// snapshot hands fn every record of the state.
+func (s *memState) snapshot(fn func(SnapshotRecord) error) error {
+	for _, key := range s.keys {
+		kv := s.current[key]
+		rec := SnapshotRecord{Key: kv.Key, Value: kv.Value, Version: kv.Version, CreateRevision: kv.CreateRevision,
+			ModRevision: kv.ModRevision, ExpiresAt: kv.ExpiresAt, Lease: kv.Lease}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(s.history))
+	for key := range s.history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range s.history[key] {
+			rec := SnapshotRecord{Key: key, Value: v.Value, Version: v.Version, CreateRevision: v.CreateRevision,
+				ModRevision: v.ModRevision, History: true, Deleted: v.Deleted}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	ids := make([]uint64, 0, len(s.leases))
+	for id := range s.leases {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := fn(SnapshotRecord{LeaseRecord: true, Lease: id, TTL: s.leases[id]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore builds a state from snapshot records.
+func restoreMemState(index uint64, next func() (SnapshotRecord, error)) (*memState, error) {
+	s := newMemState()
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case rec.LeaseRecord:
+			s.leases[rec.Lease] = rec.TTL
+		case rec.History:
+			v := &memVersion{key: rec.Key, HistoryEntry: HistoryEntry{Version: rec.Version, Value: rec.Value,
+				CreateRevision: rec.CreateRevision, ModRevision: rec.ModRevision, Deleted: rec.Deleted}}
+			s.history[rec.Key] = append(s.history[rec.Key], v)
+			s.changes = append(s.changes, v)
+		default:
+			s.current[rec.Key] = KeyValue{Key: rec.Key, Value: rec.Value, Version: rec.Version, CreateRevision: rec.CreateRevision,
+				ModRevision: rec.ModRevision, ExpiresAt: rec.ExpiresAt, Lease: rec.Lease}
+			s.keys = append(s.keys, rec.Key)
+		}
+	}
+	sort.Strings(s.keys)
+	for _, key := range s.keys {
+		s.index(s.current[key])
+	}
+	for _, versions := range s.history {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	// Versions written at the same revision keep their snapshot order, by key.
+	sort.SliceStable(s.changes, func(i, j int) bool { return s.changes[i].ModRevision < s.changes[j].ModRevision })
+	s.applied = index
+	return s, nil
+}
+
+func (e *memoryEngine) Get(key string) (KeyValue, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memState.Get(key)
+}
+
+func (e *memoryEngine) LastVersion(key string) (uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memState.LastVersion(key)
+}
+
+func (e *memoryEngine) Lease(id uint64) (int64, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memState.Lease(id)
+}
+
+func (e *memoryEngine) LeaseKeys(id uint64) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memState.LeaseKeys(id)
+}
+
+func (e *memoryEngine) Changes(start, end string, from, to uint64, fn func(WatchEvent) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memState.Changes(start, end, from, to, fn)
+}
+
+func (e *memoryEngine) Range(start, end string, now int64, fn func(KeyValue) bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	e.scan(start, end, now, fn)
+	return nil
+}
+
+func (e *memoryEngine) Count(start, end string, now int64) (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	count := 0
+	e.scan(start, end, now, func(KeyValue) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+func (e *memoryEngine) History(key string) ([]HistoryEntry, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	history := []HistoryEntry{}
+	for _, v := range e.history[key] {
+		history = append(history, v.HistoryEntry)
+	}
+	return history, nil
+}
+
+func (e *memoryEngine) Expired(now int64, limit int) ([]KeyValue, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var due []KeyValue
+	for _, x := range e.expiry {
+		if x.at > now || len(due) >= limit {
+			break
+		}
+		due = append(due, e.current[x.key])
+	}
+	return due, nil
+}
+
+func (e *memoryEngine) Leases() (map[uint64]int64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ttls := make(map[uint64]int64, len(e.leases))
+	for id, ttl := range e.leases {
+		ttls[id] = ttl
+	}
+	return ttls, nil
+}
+
+func (e *memoryEngine) AppliedIndex() (uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.applied, nil
+}
+
+func (e *memoryEngine) Begin() (WriteBatch, error) {
+	return e.begin(), nil
+}
+
+func (e *memoryEngine) begin() *memoryBatch {
+	e.mu.Lock()
+	return &memoryBatch{memState: e.memState, engine: e}
+}
+
+func (e *memoryEngine) Snapshot(fn func(SnapshotRecord) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.snapshot(fn)
+}
+
+func (e *memoryEngine) Restore(index uint64, next func() (SnapshotRecord, error)) error {
+	s, err := restoreMemState(index, next)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.memState = s
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+func (b *memoryBatch) Put(kv KeyValue) error {
+	b.undo = append(b.undo, b.put(kv))
+	return nil
+}
+
+func (b *memoryBatch) Delete(key string) error {
+	b.undo = append(b.undo, b.delete(key))
+	return nil
+}
+
+func (b *memoryBatch) AddVersion(key string, h HistoryEntry) error {
+	b.undo = append(b.undo, b.addVersion(key, h))
+	return nil
+}
+
+func (b *memoryBatch) PruneHistory(rev uint64) error {
+	b.undo = append(b.undo, b.pruneHistory(rev))
+	return nil
+}
+
+func (b *memoryBatch) PutLease(id uint64, ttl int64) error {
+	prev, existed := b.leases[id]
+	b.leases[id] = ttl
+	b.undo = append(b.undo, func() {
+		if existed {
+			b.leases[id] = prev
+		} else {
+			delete(b.leases, id)
+		}
+	})
+	return nil
+}
+
+func (b *memoryBatch) DeleteLease(id uint64) error {
+	prev, existed := b.leases[id]
+	if !existed {
+		return nil
+	}
+	delete(b.leases, id)
+	b.undo = append(b.undo, func() { b.leases[id] = prev })
+	return nil
+}
+
+func (b *memoryBatch) SetAppliedIndex(index uint64) error {
+	prev := b.applied
+	b.applied = index
+	b.undo = append(b.undo, func() { b.applied = prev })
+	return nil
+}
+
+func (b *memoryBatch) Commit() error {
+	if !b.done {
+		b.done = true
+		b.engine.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *memoryBatch) Rollback() error {
+	if b.done {
+		return nil
+	}
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		b.undo[i]()
+	}
+	b.done = true
+	b.engine.mu.Unlock()
+	return nil
+}
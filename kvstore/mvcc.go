@@ -0,0 +1,147 @@
+package kvstore
+
+import "time"
+
+// Every write to a key gives it a new version. Revisions are the log indexes of the
+// entries that created or last modified a key, so they increase across the whole store.
+// The history keeps every version, including a tombstone version for each delete, which
+// means a key's version numbers are never reused even if it is deleted and recreated.
+
+// historyRetention is how many revisions of superseded versions the history keeps.
+// Each key's newest version, current or tombstone, is always kept.
+const historyRetention = 10000
+
+// historyPruneEvery is how often, in applied entries, old history is pruned.
+const historyPruneEvery = 1000
+
+// KeyValue is a key's value with its version metadata.
+type KeyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	Version        uint64 `json:"version"`
+	CreateRevision uint64 `json:"createRevision"`
+	ModRevision    uint64 `json:"modRevision"`
+	ExpiresAt      int64  `json:"expiresAt,omitempty"` // Unix milliseconds; 0 never expires
+	Lease          uint64 `json:"lease,omitempty"`     // owning lease; 0 for none
+}
+
+// HistoryEntry is one version of a key. Deleted marks the tombstone left by a delete.
+type HistoryEntry struct {
+	Version        uint64 `json:"version"`
+	Value          string `json:"value"`
+	CreateRevision uint64 `json:"createRevision,omitempty"`
+	ModRevision    uint64 `json:"modRevision"`
+	Deleted        bool   `json:"deleted,omitempty"`
+}
+
+// lastVersion returns the newest version a key has had, live or deleted, and its current
+// version if it exists.
+func lastVersion(r Reader, key string) (uint64, *KeyValue, error) {
+	kv, found, err := r.Get(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if found {
+		return kv.Version, &kv, nil
+	}
+	version, err := r.LastVersion(key)
+	return version, nil, err
+}
+
+// putKey writes a new version of kv.Key with kv's value, expiry and lease at revision rev,
+// and returns it. A zero ExpiresAt or Lease clears any earlier expiry or lease.
+func putKey(b WriteBatch, kv KeyValue, rev uint64) (KeyValue, error) {
+	prev, current, err := lastVersion(b, kv.Key)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	kv.Version, kv.CreateRevision, kv.ModRevision = prev+1, rev, rev
+	if current != nil {
+		kv.CreateRevision = current.CreateRevision
+	}
+
+	if err := b.Put(kv); err != nil {
+		return KeyValue{}, err
+	}
+	err = b.AddVersion(kv.Key, HistoryEntry{Version: kv.Version, Value: kv.Value, CreateRevision: kv.CreateRevision, ModRevision: kv.ModRevision})
+	return kv, err
+}
+
+// deleteKey removes key at revision rev, leaving a tombstone version in its history.
+// It reports whether the key existed.
+func deleteKey(b WriteBatch, key string, rev uint64) (bool, error) {
+	_, current, err := lastVersion(b, key)
+	if err != nil || current == nil {
+		return false, err
+	}
+	if err := b.Delete(key); err != nil {
+		return false, err
+	}
+	err = b.AddVersion(key, HistoryEntry{Version: current.Version + 1, CreateRevision: current.CreateRevision, ModRevision: rev, Deleted: true})
+	return true, err
+}
+
+// pruneHistory drops superseded versions more than historyRetention revisions old.
+func pruneHistory(b WriteBatch, rev uint64) error {
+	if rev <= historyRetention {
+		return nil
+	}
+	return b.PruneHistory(rev - historyRetention)
+}
+
+// getKeyLocked reads a key's current version, treating an expired key as missing.
+// Caller holds kv.mu.
+func (kv *KVStore) getKeyLocked(key string) (KeyValue, bool, error) {
+	out, found, err := kv.engine.Get(key)
+	if err != nil || !found || expired(out.ExpiresAt, time.Now()) {
+		return KeyValue{Key: key}, false, err
+	}
+	return out, true, nil
+}
+
+// ConsistentGetVersion reads one historical version of key at the requested consistency.
+// A version that was a delete, or that has been pruned, is reported as not found.
+func (kv *KVStore) ConsistentGetVersion(key string, version uint64, rc ReadConsistency) (KeyValue, bool, ReadInfo, error) {
+	staleness, err := kv.prepareRead(rc)
+	if err != nil {
+		return KeyValue{}, false, ReadInfo{Consistency: rc.String()}, err
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	info, err := kv.readInfoLocked(rc, staleness)
+	if err != nil {
+		return KeyValue{}, false, info, err
+	}
+
+	out := KeyValue{Key: key, Version: version}
+	history, err := kv.engine.History(key)
+	if err != nil {
+		return out, false, info, err
+	}
+	for _, h := range history {
+		if h.Version == version && !h.Deleted {
+			out.Value, out.CreateRevision, out.ModRevision = h.Value, h.CreateRevision, h.ModRevision
+			return out, true, info, nil
+		}
+	}
+	return out, false, info, nil
+}
+
+// ConsistentHistory lists every retained version of key, oldest first.
+func (kv *KVStore) ConsistentHistory(key string, rc ReadConsistency) ([]HistoryEntry, ReadInfo, error) {
+	staleness, err := kv.prepareRead(rc)
+	if err != nil {
+		return nil, ReadInfo{Consistency: rc.String()}, err
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	info, err := kv.readInfoLocked(rc, staleness)
+	if err != nil {
+		return nil, info, err
+	}
+
+	history, err := kv.engine.History(key)
+	return history, info, err
+}
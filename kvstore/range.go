@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Range pages are bounded by defaultRangeLimit unless the caller asks for another size,
+// up to maxRangeLimit.
+const (
+	defaultRangeLimit = 100
+	maxRangeLimit     = 10000
+)
+
+// RangeOptions selects keys in [Start, End) that begin with Prefix; an empty End or Prefix
+// leaves that side open. Cursor continues a previous page.
+type RangeOptions struct {
+	Start  string
+	End    string
+	Prefix string
+	Limit  int
+	Cursor string
+}
+
+// RangeResult is one page of a range in key order. Count is the number of live keys in
+// the whole range; Cursor, set when More is, fetches the next page.
+type RangeResult struct {
+	KVs    []KeyValue
+	Count  int
+	More   bool
+	Cursor string
+}
+
+// EncodeCursor makes an opaque cursor that continues after key.
+func EncodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("k:" + key))
+}
+
+// DecodeCursor returns the key a cursor continues after.
+func DecodeCursor(cursor string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), "k:") {
+		return "", fmt.Errorf("invalid cursor")
+	}
+	return string(data[2:]), nil
+}
+
+// Bounds narrows [Start, End) to the prefix; "" as end means unbounded.
+func (opts RangeOptions) Bounds() (start, end string) {
+	start, end = opts.Start, opts.End
+	if opts.Prefix != "" {
+		start = max(start, opts.Prefix)
+		if pe := prefixEnd(opts.Prefix); pe != "" && (end == "" || pe < end) {
+			end = pe
+		}
+	}
+	return start, end
+}
+
+// Range returns one page of live keys, in key order, at the requested consistency.
+func (kv *KVStore) Range(opts RangeOptions, rc ReadConsistency) (RangeResult, ReadInfo, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultRangeLimit
+	}
+	limit = min(limit, maxRangeLimit)
+
+	var after string
+	hasAfter := opts.Cursor != ""
+	if hasAfter {
+		var err error
+		if after, err = DecodeCursor(opts.Cursor); err != nil {
+			return RangeResult{}, ReadInfo{Consistency: rc.String()}, err
+		}
+	}
+
+	start, end := opts.Bounds()
+
+	staleness, err := kv.prepareRead(rc)
+	if err != nil {
+		return RangeResult{}, ReadInfo{Consistency: rc.String()}, err
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	info, err := kv.readInfoLocked(rc, staleness)
+	if err != nil {
+		return RangeResult{}, info, err
+	}
+
+	now := time.Now().UnixMilli()
+	var result RangeResult
+	if result.Count, err = kv.engine.Count(start, end, now); err != nil {
+		return RangeResult{}, info, err
+	}
+
+	pageStart := start
+	if hasAfter {
+		pageStart = max(start, after+"\x00")
+	}
+	// One extra key tells us whether there is another page.
+	result.KVs = []KeyValue{}
+	err = kv.engine.Range(pageStart, end, now, func(k KeyValue) bool {
+		if len(result.KVs) == limit {
+			result.More = true
+			return false
+		}
+		result.KVs = append(result.KVs, k)
+		return true
+	})
+	if err != nil {
+		return RangeResult{}, info, err
+	}
+	if result.More {
+		result.Cursor = EncodeCursor(result.KVs[len(result.KVs)-1].Key)
+	}
+	return result, info, nil
+}
@@ -0,0 +1,164 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Read consistency levels accepted by the read paths.
+const (
+	ConsistencyLinearizable     = "linearizable"
+	ConsistencyLeaderLease      = "leader-lease"
+	ConsistencyBoundedStaleness = "bounded-staleness"
+	ConsistencyAny              = "any"
+)
+
+// ReadConsistency says how fresh a read must be. MaxStaleness applies to bounded-staleness.
+type ReadConsistency struct {
+	Level        string
+	MaxStaleness time.Duration
+}
+
+// ReadInfo describes the state a read was served at.
+type ReadInfo struct {
+	Consistency  string `json:"consistency"`
+	AppliedIndex uint64 `json:"appliedIndex"`
+	Staleness    string `json:"staleness,omitempty"`
+}
+
+// ParseReadConsistency parses "linearizable", "leader-lease", "bounded-staleness=<duration>"
+// or "any".
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	level, arg, hasArg := strings.Cut(s, "=")
+	switch level {
+	case ConsistencyLinearizable, ConsistencyLeaderLease, ConsistencyAny:
+		if hasArg {
+			return ReadConsistency{}, fmt.Errorf("%s takes no argument", level)
+		}
+		return ReadConsistency{Level: level}, nil
+	case ConsistencyBoundedStaleness:
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return ReadConsistency{}, fmt.Errorf("bounded-staleness needs a positive duration, e.g. bounded-staleness=500ms")
+		}
+		return ReadConsistency{Level: level, MaxStaleness: d}, nil
+	}
+	return ReadConsistency{}, fmt.Errorf("unknown consistency %q", s)
+}
+
+// String formats rc the way ParseReadConsistency accepts it.
+func (rc ReadConsistency) String() string {
+	if rc.Level == ConsistencyBoundedStaleness {
+		return rc.Level + "=" + rc.MaxStaleness.String()
+	}
+	return rc.Level
+}
+
+// prepareRead waits until local state satisfies rc and returns the staleness the read
+// is served at, or -1 if it is unknown.
+func (kv *KVStore) prepareRead(rc ReadConsistency) (time.Duration, error) {
+	switch rc.Level {
+	case ConsistencyLinearizable, ConsistencyLeaderLease:
+		var index uint64
+		var err error
+		if rc.Level == ConsistencyLinearizable {
+			index, err = kv.consensus.ReadIndex()
+		} else {
+			index, err = kv.consensus.LeaseReadIndex()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, kv.waitForApplied(index)
+
+	case ConsistencyBoundedStaleness:
+		index, at := kv.consensus.Freshness()
+		if at.IsZero() {
+			return 0, fmt.Errorf("no recent contact with a quorum")
+		}
+		if staleness := time.Since(at); staleness > rc.MaxStaleness {
+			return 0, fmt.Errorf("replica is %v stale, more than %v", staleness.Round(time.Millisecond), rc.MaxStaleness)
+		}
+		if err := kv.waitForApplied(index); err != nil {
+			return 0, err
+		}
+		return time.Since(at), nil
+	}
+	return -1, nil
+}
+
+// readInfoLocked records the applied index the read sees. Caller holds kv.mu.
+func (kv *KVStore) readInfoLocked(rc ReadConsistency, staleness time.Duration) (ReadInfo, error) {
+	info := ReadInfo{Consistency: rc.String()}
+	// Read the index from the engine so it matches the data, as WriteSnapshot does.
+	var err error
+	if info.AppliedIndex, err = kv.engine.AppliedIndex(); err != nil {
+		return info, err
+	}
+	if staleness >= 0 {
+		info.Staleness = staleness.Round(time.Millisecond).String()
+	}
+	return info, nil
+}
+
+// ConsistentGet reads key, with its version metadata, at the requested consistency.
+func (kv *KVStore) ConsistentGet(key string, rc ReadConsistency) (KeyValue, bool, ReadInfo, error) {
+	staleness, err := kv.prepareRead(rc)
+	if err != nil {
+		return KeyValue{}, false, ReadInfo{Consistency: rc.String()}, err
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	info, err := kv.readInfoLocked(rc, staleness)
+	if err != nil {
+		return KeyValue{}, false, info, err
+	}
+	value, exists, err := kv.getKeyLocked(key)
+	return value, exists, info, err
+}
+
+// ConsistentGetAll returns one page of keys and the total key count at the requested
+// consistency. Expired keys are left out of both, as are keys visible rejects if it is
+// not nil.
+func (kv *KVStore) ConsistentGetAll(limit, offset int, rc ReadConsistency, visible func(key string) bool) ([]KeyValue, int, ReadInfo, error) {
+	staleness, err := kv.prepareRead(rc)
+	if err != nil {
+		return nil, 0, ReadInfo{Consistency: rc.String()}, err
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	info, err := kv.readInfoLocked(rc, staleness)
+	if err != nil {
+		return nil, 0, info, err
+	}
+
+	// Without a filter the engine counts the keys; with one, every key has to be visited.
+	now := time.Now().UnixMilli()
+	var data []KeyValue
+	seen := 0
+	err = kv.engine.Range("", "", now, func(k KeyValue) bool {
+		if visible != nil && !visible(k.Key) {
+			return true
+		}
+		if seen >= offset && len(data) < limit {
+			data = append(data, k)
+		}
+		seen++
+		return visible != nil || len(data) < limit
+	})
+	if err != nil {
+		return nil, 0, info, err
+	}
+	if visible != nil {
+		return data, seen, info, nil
+	}
+
+	total, err := kv.engine.Count("", "", now)
+	if err != nil {
+		return nil, 0, info, err
+	}
+	return data, total, info, nil
+}
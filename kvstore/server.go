@@ -2,21 +2,175 @@ package kvstore
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"kvstore/consensus"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Server represents an HTTP server for the key-value store.
 type Server struct {
-	store *KVStore
+	store           *KVStore
+	readConsistency ReadConsistency
+
+	// tlsConfig secures the listener, if set; see UseTLS. peerClient and peerScheme
+	// reach other nodes when forwarding requests to the leader.
+	tlsConfig  *tls.Config
+	peerClient *http.Client
+	peerScheme string
+}
+
+// NewServer initializes an HTTP server for the store. readConsistency is used for reads
+// that do not ask for a consistency level of their own.
+func NewServer(store *KVStore, readConsistency ReadConsistency) *Server {
+	return &Server{store: store, readConsistency: readConsistency, peerClient: http.DefaultClient, peerScheme: "http"}
+}
+
+// UseTLS makes Start serve HTTPS with serverTLS and forward requests to the leader over
+// HTTPS with peerTLS. Internal routes then only accept callers that present a node
+// certificate; serverTLS must check that certificate against the cluster.
+func (s *Server) UseTLS(serverTLS, peerTLS *tls.Config) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = peerTLS
+	s.tlsConfig = serverTLS
+	s.peerClient = &http.Client{Transport: tr}
+	s.peerScheme = "https"
+}
+
+// peerURL returns the address of path on another node.
+func (s *Server) peerURL(node, path string) string {
+	return s.peerScheme + "://" + node + path
+}
+
+// peerOnly guards a route that only other nodes may call. Under TLS the caller must have
+// presented a node certificate, which the handshake has already checked.
+func (s *Server) peerOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tlsConfig != nil && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			http.Error(w, "Node certificate required", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// requestConsistency returns the read consistency asked for by the request's
+// "consistency" query parameter, or the server default.
+func (s *Server) requestConsistency(r *http.Request) (ReadConsistency, error) {
+	param := r.URL.Query().Get("consistency")
+	if param == "" {
+		return s.readConsistency, nil
+	}
+	return ParseReadConsistency(param)
+}
+
+// authenticate identifies the caller from a bearer token or basic auth. While
+// authentication is off it returns a nil user, which may access every key. If the caller
+// cannot be identified, it answers 401 and returns false; if its credentials could not be
+// checked, it answers 503.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*AuthUser, bool) {
+	enabled, err := s.store.AuthEnabled()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read auth settings: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !enabled {
+		return nil, true
+	}
+
+	var user *AuthUser
+	if token, ok := bearerToken(r); ok {
+		user, err = s.store.AuthenticateToken(token)
+	} else if name, password, ok := r.BasicAuth(); ok {
+		user, err = s.store.AuthenticatePassword(name, password)
+	} else {
+		err = ErrUnauthenticated
+	}
+	if err != nil && err != ErrUnauthenticated {
+		fmt.Printf("❌ Authentication failed: %v\n", err)
+		http.Error(w, fmt.Sprintf("Authentication unavailable: %v", err), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kvstore"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil, false
+	}
+	return user, true
+}
+
+// authorize authenticates the caller and checks that it may access every key in keys; with
+// no keys it only authenticates. If the check fails, it answers the request and returns
+// false.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, a Access, keys ...string) bool {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	return permit(w, user, a, keys)
 }
 
-// NewServer initializes an HTTP server for the store.
-func NewServer(store *KVStore) *Server {
-	return &Server{store: store}
+// authorizeKeys is authorize for a request that reads some keys and writes others.
+func (s *Server) authorizeKeys(w http.ResponseWriter, r *http.Request, reads, writes []string) bool {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	return permit(w, user, AccessRead, reads) && permit(w, user, AccessWrite, writes)
+}
+
+// authorizeRange is authorize for every key in [start, end).
+func (s *Server) authorizeRange(w http.ResponseWriter, r *http.Request, a Access, start, end string) bool {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if !user.CanRange(a, start, end) {
+		forbidden(w, user, fmt.Sprintf("%s keys in [%q, %q)", a, start, end))
+		return false
+	}
+	return true
+}
+
+// authorizeRoot lets through callers in the root role, or anyone while authentication is off.
+func (s *Server) authorizeRoot(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if !user.IsRoot() {
+		forbidden(w, user, "manage users and roles")
+		return false
+	}
+	return true
+}
+
+// permit checks that user may access every key in keys, answering 403 if not.
+func permit(w http.ResponseWriter, user *AuthUser, a Access, keys []string) bool {
+	for _, key := range keys {
+		if !user.Can(a, key) {
+			forbidden(w, user, fmt.Sprintf("%s %q", a, key))
+			return false
+		}
+	}
+	return true
+}
+
+// forbidden answers 403 for a user that may not do what.
+func forbidden(w http.ResponseWriter, user *AuthUser, what string) {
+	http.Error(w, fmt.Sprintf("User %s may not %s", user.Name, what), http.StatusForbidden)
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
 }
 
 // ServeStatic serves static files (HTML, JS, CSS).
@@ -36,6 +190,8 @@ func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Key   string `json:"key"`
 		Value string `json:"value"`
+		TTL   int64  `json:"ttl,omitempty"`   // seconds; 0 never expires
+		Lease uint64 `json:"lease,omitempty"` // owning lease; 0 for none
 	}
 
 	fmt.Println("📥 Received PUT request...")
@@ -44,6 +200,18 @@ func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.TTL < 0 {
+		http.Error(w, "ttl must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.TTL > 0 && req.Lease != 0 {
+		http.Error(w, "ttl and lease cannot be combined", http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, AccessWrite, req.Key) {
+		return
+	}
+	ttl := time.Duration(req.TTL) * time.Second
 
 	fmt.Printf("🔹 Storing key=%s, value=%s...\n", req.Key, req.Value)
 	var err error
@@ -57,9 +225,12 @@ func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
 
 			// 🔁 Forward to leader
 			fmt.Printf("🔀 Forwarding PUT to leader %s\n", leader)
-			proxyURL := fmt.Sprintf("http://%s/api/put", leader)
+			proxyURL := s.peerURL(leader, "/api/put")
 			reqBody, _ := json.Marshal(req)
-			resp, err := http.Post(proxyURL, "application/json", bytes.NewReader(reqBody))
+			fwd, _ := http.NewRequest(http.MethodPost, proxyURL, bytes.NewReader(reqBody))
+			fwd.Header.Set("Content-Type", "application/json")
+			copyCredentials(fwd, r)
+			resp, err := s.peerClient.Do(fwd)
 			if err != nil {
 				fmt.Printf("❌ Forwarding failed: %v\n", err)
 				http.Error(w, "Failed to forward to leader", http.StatusBadGateway)
@@ -72,17 +243,21 @@ func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// ✅ This node is the leader — handle normally
-		err = s.store.Put(req.Key, req.Value)
+		err = s.putRequest(req.Key, req.Value, ttl, req.Lease)
 	} else if s.store.consensus.Mode == "cabinet++" {
-		err = s.store.Put(req.Key, req.Value)
+		err = s.putRequest(req.Key, req.Value, ttl, req.Lease)
 	} else {
 		http.Error(w, "Unknown consensus mode", http.StatusInternalServerError)
 		return
 	}
 
+	if err == ErrLeaseNotFound {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		fmt.Printf("Consensus failed for PUT key=%s: %v\n", req.Key, err)
-		http.Error(w, fmt.Sprintf("Consensus not reached: %v", err), http.StatusConflict)
+		consensusFailed(w, err)
 		return
 	}
 
@@ -90,6 +265,319 @@ func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// putRequest stores a key with an optional TTL or owning lease.
+func (s *Server) putRequest(key, value string, ttl time.Duration, lease uint64) error {
+	if lease != 0 {
+		return s.store.PutWithLease(key, value, lease)
+	}
+	return s.store.PutWithTTL(key, value, ttl)
+}
+
+// CASHandler handles conditional writes: compare-and-swap by default, put-if-absent with
+// "ifAbsent", or delete-if-value-matches with "delete". A failed condition returns 412
+// with the key's current state.
+func (s *Server) CASHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Key      string `json:"key"`
+		Expected string `json:"expected"`
+		Value    string `json:"value"`
+		IfAbsent bool   `json:"ifAbsent"`
+		Delete   bool   `json:"delete"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Key == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.IfAbsent && req.Delete {
+		http.Error(w, "ifAbsent and delete cannot be combined", http.StatusBadRequest)
+		return
+	}
+	// A failed condition reports the current value, so CAS needs read access as well.
+	if !s.authorizeKeys(w, r, []string{req.Key}, []string{req.Key}) {
+		return
+	}
+	if s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+
+	var result CASResult
+	switch {
+	case req.IfAbsent:
+		result, err = s.store.PutIfAbsent(req.Key, req.Value)
+	case req.Delete:
+		result, err = s.store.DeleteIfValue(req.Key, req.Expected)
+	default:
+		result, err = s.store.CompareAndSwap(req.Key, req.Expected, req.Value)
+	}
+	if err != nil {
+		fmt.Printf("Consensus failed for CAS key=%s: %v\n", req.Key, err)
+		consensusFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Succeeded {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// TxnHandler applies an etcd-style transaction: the success operations if every compare
+// holds, otherwise the failure operations, all in one replicated entry.
+func (s *Server) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req TxnRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid transaction: %v", err), http.StatusBadRequest)
+		return
+	}
+	if reads, writes := req.Keys(); !s.authorizeKeys(w, r, reads, writes) {
+		return
+	}
+	if s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+
+	resp, err := s.store.Txn(req)
+	if err != nil {
+		fmt.Printf("Consensus failed for transaction: %v\n", err)
+		consensusFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BatchHandler commits many puts and deletes as one proposal and reports each outcome.
+func (s *Server) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Ops []TxnOp `json:"ops"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBatch(req.Ops); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	keys := make([]string, len(req.Ops))
+	for i, op := range req.Ops {
+		keys[i] = op.Key
+	}
+	if !s.authorize(w, r, AccessWrite, keys...) {
+		return
+	}
+	if s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+
+	resp, err := s.store.Batch(req.Ops)
+	if err != nil {
+		fmt.Printf("Consensus failed for batch of %d operations: %v\n", len(req.Ops), err)
+		consensusFailed(w, err)
+		return
+	}
+	fmt.Printf("📦 Batch of %d operations applied at index %d\n", len(req.Ops), resp.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// forwardWriteToLeader relays a write to the leader in Cabinet mode, where only the leader
+// may propose (Cabinet++ followers forward proposals themselves). It reports whether the
+// request was relayed.
+func (s *Server) forwardWriteToLeader(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if s.store.consensus.Mode != "cabinet" {
+		return false
+	}
+	return s.forwardToLeader(w, r, body)
+}
+
+// forwardToLeader relays a request that only the leader can serve, in either mode. It
+// reports whether the request was relayed.
+func (s *Server) forwardToLeader(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if s.store.consensus.State.IsLeader() {
+		return false
+	}
+	leader := s.store.consensus.State.GetLeader()
+	if leader == "" {
+		http.Error(w, "Leader unknown", http.StatusServiceUnavailable)
+		return true
+	}
+
+	fmt.Printf("🔀 Forwarding %s to leader %s\n", r.URL.Path, leader)
+	req, err := http.NewRequest(r.Method, s.peerURL(leader, r.URL.RequestURI()), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Failed to forward to leader", http.StatusInternalServerError)
+		return true
+	}
+	req.Header.Set("Content-Type", "application/json")
+	copyCredentials(req, r)
+	resp, err := s.peerClient.Do(req)
+	if err != nil {
+		fmt.Printf("❌ Forwarding failed: %v\n", err)
+		http.Error(w, "Failed to forward to leader", http.StatusBadGateway)
+		return true
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// consensusFailed answers a write that did not commit. One whose outcome is unknown gets
+// 504: it may still be applied, so the client should read before retrying.
+func consensusFailed(w http.ResponseWriter, err error) {
+	if err == consensus.ErrProposalInDoubt {
+		http.Error(w, fmt.Sprintf("Outcome unknown: %v", err), http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Consensus not reached: %v", err), http.StatusConflict)
+}
+
+// copyCredentials passes the caller's credentials on with a forwarded request, so the
+// leader authorizes it as the caller.
+func copyCredentials(fwd, r *http.Request) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fwd.Header.Set("Authorization", auth)
+	}
+}
+
+// LeaseGrantHandler grants a lease with a TTL in seconds.
+func (s *Server) LeaseGrantHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		TTL int64 `json:"ttl"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.TTL <= 0 {
+		http.Error(w, "Invalid request body: ttl must be a positive number of seconds", http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, AccessWrite) {
+		return
+	}
+	if s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+
+	info, err := s.store.GrantLease(time.Duration(req.TTL) * time.Second)
+	if err != nil {
+		consensusFailed(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// LeaseKeepAliveHandler restarts a lease's TTL. Deadlines live on the leader, so other
+// nodes forward the request there.
+func (s *Server) LeaseKeepAliveHandler(w http.ResponseWriter, r *http.Request) {
+	body, id, ok := leaseRequest(w, r)
+	if !ok || !s.authorize(w, r, AccessWrite) || s.forwardToLeader(w, r, body) {
+		return
+	}
+	info, err := s.store.KeepAliveLease(id)
+	writeLease(w, info, err)
+}
+
+// LeaseRevokeHandler revokes a lease, deleting every key attached to it. The caller needs
+// write access to those keys, which the leader checks against its own copy of the lease.
+func (s *Server) LeaseRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	body, id, ok := leaseRequest(w, r)
+	if !ok || s.forwardToLeader(w, r, body) {
+		return
+	}
+	lease, err := s.store.readLease(id, true)
+	if err != nil && err != ErrLeaseNotFound {
+		http.Error(w, fmt.Sprintf("Failed to read lease: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !s.authorize(w, r, AccessWrite, lease.Keys...) {
+		return
+	}
+	info, err := s.store.RevokeLease(id)
+	writeLease(w, info, err)
+}
+
+// LeaseHandler describes a lease: its TTL, the time left and those of its keys the caller
+// may read.
+func (s *Server) LeaseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id == 0 {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	user, ok := s.authenticate(w, r)
+	if !ok || s.forwardToLeader(w, r, nil) {
+		return
+	}
+	info, err := s.store.LeaseTimeToLive(id)
+	visible := info.Keys[:0]
+	for _, key := range info.Keys {
+		if user.Can(AccessRead, key) {
+			visible = append(visible, key)
+		}
+	}
+	info.Keys = visible
+	writeLease(w, info, err)
+}
+
+// leaseRequest decodes a {"id": N} body.
+func leaseRequest(w http.ResponseWriter, r *http.Request) ([]byte, uint64, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	var req struct {
+		ID uint64 `json:"id"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.ID == 0 {
+		http.Error(w, "Invalid request body: missing lease id", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	return body, req.ID, true
+}
+
+// writeLease writes a lease, or the error from looking it up.
+func writeLease(w http.ResponseWriter, info LeaseInfo, err error) {
+	switch {
+	case err == ErrLeaseNotFound:
+		http.Error(w, "Lease not found", http.StatusNotFound)
+	case err == consensus.ErrNotLeader:
+		http.Error(w, "Not leader", http.StatusMisdirectedRequest)
+	case err != nil:
+		consensusFailed(w, err)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
 // GetHandler handles GET requests.
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
@@ -97,10 +585,30 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing key parameter", http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, AccessRead, key) {
+		return
+	}
+	rc, err := s.requestConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	value, exists, err := s.store.Get(key)
+	var value KeyValue
+	var exists bool
+	var info ReadInfo
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, perr := strconv.ParseUint(v, 10, 64)
+		if perr != nil || version == 0 {
+			http.Error(w, "Invalid version parameter", http.StatusBadRequest)
+			return
+		}
+		value, exists, info, err = s.store.ConsistentGetVersion(key, version, rc)
+	} else {
+		value, exists, info, err = s.store.ConsistentGet(key, rc)
+	}
 	if err != nil {
-		http.Error(w, "Failed to retrieve value", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Read at %s consistency failed: %v", rc, err), http.StatusServiceUnavailable)
 		return
 	}
 	if !exists {
@@ -108,58 +616,237 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"value": value})
+	json.NewEncoder(w).Encode(GetResponse{
+		Value:          value.Value,
+		Version:        value.Version,
+		CreateRevision: value.CreateRevision,
+		ModRevision:    value.ModRevision,
+		TTL:            remainingTTL(value.ExpiresAt, time.Now()),
+		Lease:          value.Lease,
+		ReadInfo:       info,
+	})
 }
 
-// DeleteHandler handles distributed DELETE requests.
-func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+// RangeHandler returns keys in [start, end) under an optional prefix, in key order, one
+// page at a time. A response with "more" set carries a cursor; pass it back as "after"
+// for the next page.
+func (s *Server) RangeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := RangeOptions{
+		Start:  q.Get("start"),
+		End:    q.Get("end"),
+		Prefix: q.Get("prefix"),
+		Cursor: q.Get("after"),
+	}
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = l
+	}
+	if opts.Cursor != "" {
+		if _, err := DecodeCursor(opts.Cursor); err != nil {
+			http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	rc, err := s.requestConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if start, end := opts.Bounds(); !s.authorizeRange(w, r, AccessRead, start, end) {
+		return
+	}
+
+	result, info, err := s.store.Range(opts, rc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Read at %s consistency failed: %v", rc, err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RangeResponse{
+		KVs:      result.KVs,
+		Count:    result.Count,
+		More:     result.More,
+		Cursor:   result.Cursor,
+		ReadInfo: info,
+	})
+}
+
+// RangeResponse is the body of /api/range.
+type RangeResponse struct {
+	KVs    []KeyValue `json:"kvs"`
+	Count  int        `json:"count"`
+	More   bool       `json:"more"`
+	Cursor string     `json:"cursor,omitempty"`
+	ReadInfo
+}
+
+// HistoryHandler lists the retained versions of a key, including deletes.
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		http.Error(w, "Missing key parameter", http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, AccessRead, key) {
+		return
+	}
+	rc, err := s.requestConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if err := s.store.Delete(key); err != nil {
-		http.Error(w, "Consensus not reached", http.StatusConflict)
+	history, info, err := s.store.ConsistentHistory(key, rc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Read at %s consistency failed: %v", rc, err), http.StatusServiceUnavailable)
 		return
 	}
+	json.NewEncoder(w).Encode(HistoryResponse{Key: key, History: history, ReadInfo: info})
+}
 
-	w.WriteHeader(http.StatusOK)
+// WatchHandler streams changes to a key (?key=) or to every key under a prefix (?prefix=)
+// as Server-Sent Events. Each event's id is the revision it was applied at, set on the
+// last event of that revision, so a client that reconnects with Last-Event-ID, or asks
+// for ?revision=N, continues without gaps.
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key, prefix := q.Get("key"), q.Has("prefix")
+	if prefix {
+		key = q.Get("prefix")
+	}
+	if key == "" && !prefix {
+		http.Error(w, "Missing key or prefix parameter", http.StatusBadRequest)
+		return
+	}
+	if prefix && !s.authorizeRange(w, r, AccessRead, key, prefixEnd(key)) {
+		return
+	}
+	if !prefix && !s.authorize(w, r, AccessRead, key) {
+		return
+	}
+
+	var start uint64
+	if v := q.Get("revision"); v != "" {
+		rev, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid revision parameter", http.StatusBadRequest)
+			return
+		}
+		start = rev
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		last, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		start = last + 1
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	started := false
+	err := s.store.Watch(r.Context(), key, prefix, start, func(events []WatchEvent) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			started = true
+		}
+		if len(events) == 0 {
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+		}
+		for i, ev := range events {
+			data, _ := json.Marshal(ev)
+			if i == len(events)-1 || events[i+1].ModRevision != ev.ModRevision {
+				fmt.Fprintf(w, "id: %d\n", ev.ModRevision)
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", strings.ToLower(ev.Type), data); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	})
+
+	var compacted *CompactedError
+	if errors.As(err, &compacted) && !started {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "compactRevision": compacted.Revision})
+		return
+	}
+	if errors.As(err, &compacted) {
+		// The history this watcher still needed was pruned while it streamed: tell it
+		// where it can resume from before closing, so it re-reads instead of missing events.
+		data, _ := json.Marshal(map[string]interface{}{"error": err.Error(), "compactRevision": compacted.Revision})
+		fmt.Fprintf(w, "event: compacted\ndata: %s\n\n", data)
+		flusher.Flush()
+		fmt.Printf("⚠️ Watch on %q fell behind compaction: %v\n", key, err)
+		return
+	}
+	if err != nil && r.Context().Err() == nil {
+		fmt.Printf("❌ Watch on %q ended: %v\n", key, err)
+	}
 }
 
-// ApproveHandler allows followers to approve leader proposals.
-func (s *Server) ApproveHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("📥 Received approval request...")
+// HistoryResponse is the body of /api/history.
+type HistoryResponse struct {
+	Key     string         `json:"key"`
+	History []HistoryEntry `json:"history"`
+	ReadInfo
+}
 
-	// ✅ Sanity check: only followers approve
-	if s.store.consensus.State.IsLeader() {
-		fmt.Println("❌ This node is a leader and cannot approve its own requests.")
-		http.Error(w, "Leaders cannot approve their own requests", http.StatusForbidden)
+// DeleteHandler handles distributed DELETE requests.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key parameter", http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, AccessWrite, key) {
 		return
 	}
 
-	// 🛡️ Optional: decode and log approval payload for debugging
-	var req map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
-		fmt.Println("❌ Malformed approval request.")
+	if err := s.store.Delete(key); err != nil {
+		consensusFailed(w, err)
 		return
 	}
-	key := req["key"]
-	value := req["value"]
-	opType := req["opType"]
-	fmt.Printf("✅ Approval granted: %s %s = %s\n", opType, key, value)
 
-	// 🟢 Always approve for now (could add failure simulation later)
 	w.WriteHeader(http.StatusOK)
 }
 
 type PaginatedResponse struct {
 	Data       map[string]string `json:"data"`
+	TTLs       map[string]int64  `json:"ttls,omitempty"` // seconds left, for keys that expire
 	Page       int               `json:"page"`
 	Limit      int               `json:"limit"`
 	TotalItems int               `json:"totalItems"`
 	TotalPages int               `json:"totalPages"`
+	ReadInfo
+}
+
+// GetResponse is the body of a successful /api/get.
+type GetResponse struct {
+	Value          string `json:"value"`
+	Version        uint64 `json:"version"`
+	CreateRevision uint64 `json:"createRevision"`
+	ModRevision    uint64 `json:"modRevision"`
+	TTL            int64  `json:"ttl,omitempty"`   // seconds until the key expires
+	Lease          uint64 `json:"lease,omitempty"` // owning lease
+	ReadInfo
 }
 
 // GetAllHandler handles GET requests to retrieve paginated key-value pairs.
@@ -184,85 +871,420 @@ func (s *Server) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Calculate the offset
-	offset := (page - 1) * limit
-
-	// Query the database for paginated results
-	rows, err := s.store.db.Query("SELECT key, value FROM kv_store LIMIT ? OFFSET ?", limit, offset)
+	rc, err := s.requestConsistency(r)
 	if err != nil {
-		http.Error(w, "Failed to retrieve key-value pairs", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	// Create a map to store key-value pairs
-	data := make(map[string]string)
 
-	// Iterate through the rows and populate the map
-	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
-			http.Error(w, "Failed to scan row", http.StatusInternalServerError)
-			return
-		}
-		data[key] = value
+	// List only the keys the caller may read.
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var visible func(string) bool
+	if !user.CanRange(AccessRead, "", "") {
+		visible = func(key string) bool { return user.Can(AccessRead, key) }
 	}
 
-	// Get the total number of items
-	var totalItems int
-	err = s.store.db.QueryRow("SELECT COUNT(*) FROM kv_store").Scan(&totalItems)
+	// Calculate the offset
+	offset := (page - 1) * limit
+
+	kvs, totalItems, info, err := s.store.ConsistentGetAll(limit, offset, rc, visible)
 	if err != nil {
-		http.Error(w, "Failed to count key-value pairs", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to retrieve key-value pairs at %s consistency: %v", rc, err), http.StatusServiceUnavailable)
 		return
 	}
 
+	data := make(map[string]string, len(kvs))
+	ttls := make(map[string]int64)
+	now := time.Now()
+	for _, k := range kvs {
+		data[k.Key] = k.Value
+		if ttl := remainingTTL(k.ExpiresAt, now); ttl > 0 {
+			ttls[k.Key] = ttl
+		}
+	}
+
 	// Calculate the total number of pages
 	totalPages := (totalItems + limit - 1) / limit
 
 	// Return the data and metadata as JSON
 	response := PaginatedResponse{
 		Data:       data,
+		TTLs:       ttls,
 		Page:       page,
 		Limit:      limit,
 		TotalItems: totalItems,
 		TotalPages: totalPages,
+		ReadInfo:   info,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// ReplicationRequest is the body sent to followers
-type ReplicationRequest struct {
-	OpType string `json:"opType"` // "PUT" or "DELETE"
-	Key    string `json:"key"`
-	Value  string `json:"value"` // only used for PUT
+// LoginHandler checks a name and password, sent as basic auth or as {"name", "password"},
+// and returns a bearer token that lasts TokenTTL.
+func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		req.Name, req.Password = name, password
+	} else if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	if s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+
+	token, err := s.store.Login(req.Name, req.Password)
+	var unavailable *AuthUnavailableError
+	if err == ErrUnauthenticated {
+		http.Error(w, "Invalid name or password", http.StatusUnauthorized)
+		return
+	}
+	if errors.As(err, &unavailable) {
+		http.Error(w, fmt.Sprintf("Authentication unavailable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		consensusFailed(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "ttl": int64(TokenTTL / time.Second)})
+}
+
+// LogoutHandler revokes the bearer token the request carries.
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		http.Error(w, "Missing bearer token", http.StatusBadRequest)
+		return
+	}
+	if s.forwardWriteToLeader(w, r, nil) {
+		return
+	}
+	if err := s.store.Logout(token); err != nil {
+		consensusFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// AuthStatusHandler reports whether authentication is on and, if so, who the caller is.
+func (s *Server) AuthStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	status := map[string]interface{}{"enabled": user != nil}
+	if user != nil {
+		status["user"] = user.Name
+		status["roles"] = user.Roles
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
 }
 
-func (s *Server) ReplicationHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("📥 Received REPLICATION request!")
+// AuthEnableHandler turns authentication on. A user in the root role must exist.
+func (s *Server) AuthEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, nil) {
+		return
+	}
+	err := s.store.EnableAuth()
+	if err == nil {
+		fmt.Println("🔐 Authentication enabled")
+	}
+	writeAuthResult(w, nil, err)
+}
 
-	var req ReplicationRequest
+// AuthDisableHandler turns authentication off.
+func (s *Server) AuthDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, nil) {
+		return
+	}
+	err := s.store.DisableAuth()
+	if err == nil {
+		fmt.Println("🔓 Authentication disabled")
+	}
+	writeAuthResult(w, nil, err)
+}
+
+// UserHandler lists users, or describes the one named by ?name=.
+func (s *Server) UserHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeRoot(w, r) {
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		user, err := s.store.GetUser(name)
+		writeAuthResult(w, user, err)
+		return
+	}
+	users, err := s.store.Users()
+	writeAuthResult(w, users, err)
+}
+
+// UserPutHandler creates or updates a user from {"name", "password", "roles"}. Leaving out
+// the password keeps an existing user's.
+func (s *Server) UserPutHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name     string   `json:"name"`
+		Password string   `json:"password"`
+		Roles    []string `json:"roles"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := ValidateAuthName(req.Name); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid user: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Roles == nil {
+		req.Roles = []string{}
+	}
+	if !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+	writeAuthResult(w, nil, s.store.PutUser(req.Name, req.Password, req.Roles))
+}
+
+// UserDeleteHandler removes the user named by {"name"}.
+func (s *Server) UserDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	body, name, ok := authNameRequest(w, r)
+	if !ok || !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+	writeAuthResult(w, nil, s.store.DeleteUser(name))
+}
+
+// RoleHandler lists roles, or describes the one named by ?name=.
+func (s *Server) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeRoot(w, r) {
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		role, err := s.store.GetRole(name)
+		writeAuthResult(w, role, err)
+		return
+	}
+	roles, err := s.store.Roles()
+	writeAuthResult(w, roles, err)
+}
+
+// RolePutHandler creates or replaces a role from {"name", "permissions"}.
+func (s *Server) RolePutHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var role Role
+	if err := json.Unmarshal(body, &role); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := ValidateAuthName(role.Name); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid role: %v", err), http.StatusBadRequest)
+		return
+	}
+	if role.Name == RootRole {
+		http.Error(w, "Invalid role: root is built in", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+	writeAuthResult(w, nil, s.store.PutRole(role))
+}
+
+// RoleDeleteHandler removes the role named by {"name"}.
+func (s *Server) RoleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	body, name, ok := authNameRequest(w, r)
+	if !ok || !s.authorizeRoot(w, r) || s.forwardWriteToLeader(w, r, body) {
+		return
+	}
+	writeAuthResult(w, nil, s.store.DeleteRole(name))
+}
+
+// authNameRequest decodes a {"name": "..."} body.
+func authNameRequest(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, "", false
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Name == "" {
+		http.Error(w, "Invalid request body: missing name", http.StatusBadRequest)
+		return nil, "", false
+	}
+	return body, req.Name, true
+}
+
+// writeAuthResult writes result, or 200 if it is nil, or the error from managing users
+// and roles.
+func writeAuthResult(w http.ResponseWriter, result interface{}, err error) {
+	switch {
+	case err == ErrUserNotFound || err == ErrRoleNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == ErrUnknownRole || err == ErrPasswordRequired || err == ErrNoRootUser || err == ErrLastRootUser:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		consensusFailed(w, err)
+	case result == nil:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// AppendEntriesHandler receives replicated log entries (and heartbeats) from the leader.
+func (s *Server) AppendEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	var req consensus.AppendEntriesRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	fmt.Printf("📦 Replicating %s: %s = %s\n", req.OpType, req.Key, req.Value)
+	resp := s.store.consensus.HandleAppendEntries(req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if req.OpType == "PUT" {
-		s.store.ReplicatedPut(req.Key, req.Value)
-	} else if req.OpType == "DELETE" {
-		s.store.ReplicatedDelete(req.Key)
-	} else {
-		http.Error(w, "Unknown operation", http.StatusBadRequest)
+// ProposeHandler lets Cabinet++ followers hand their writes to the leader for ordering.
+func (s *Server) ProposeHandler(w http.ResponseWriter, r *http.Request) {
+	var op consensus.LogEntry
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	index, committed, err := s.store.consensus.HandlePropose(op)
+	if err == consensus.ErrNotLeader {
+		http.Error(w, "Not leader", http.StatusMisdirectedRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"index": index, "committed": committed, "inDoubt": err == consensus.ErrProposalInDoubt})
+}
+
+// LogStatusHandler reports this node's term and log positions so followers can tell how far behind they are.
+func (s *Server) LogStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.store.consensus.GetLogStatus())
+}
+
+// LogEntriesHandler serves a batch of log entries to a follower that is catching up.
+func (s *Server) LogEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil || from == 0 {
+		http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+
+	batch, err := s.store.consensus.EntriesFrom(from)
+	if err == consensus.ErrSnapshotRequired {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// ReadIndexHandler confirms leadership and returns the index a linearizable read on a
+// follower must wait for. With lease=true a valid leader lease stands in for the confirmation.
+func (s *Server) ReadIndexHandler(w http.ResponseWriter, r *http.Request) {
+	index, err := s.store.consensus.HandleReadIndex(r.URL.Query().Get("lease") == "true")
+	if err == consensus.ErrNotLeader {
+		http.Error(w, "Not leader", http.StatusMisdirectedRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{"readIndex": index})
+}
+
+// SnapshotHandler streams the newest snapshot to a follower that is too far behind to replay the log.
+// The metadata travels in the X-Snapshot header and the data in the response body.
+func (s *Server) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.store.consensus.State.IsLeader() {
+		http.Error(w, "Not leader", http.StatusMisdirectedRequest)
+		return
+	}
+
+	err := s.store.consensus.ServeSnapshot(w, func(snap *consensus.Snapshot) {
+		meta, _ := json.Marshal(snap)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Snapshot", string(meta))
+	})
+	if err != nil {
+		fmt.Printf("❌ Failed to serve snapshot: %v\n", err)
+		http.Error(w, "Failed to serve snapshot", http.StatusInternalServerError)
+	}
+}
+
+// InstallSnapshotHandler receives a snapshot streamed by the leader. The metadata travels
+// in the X-Install-Snapshot header and the data in the request body.
+func (s *Server) InstallSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var req consensus.InstallSnapshotRequest
+	if err := json.Unmarshal([]byte(r.Header.Get("X-Install-Snapshot")), &req); err != nil {
+		http.Error(w, "Invalid snapshot metadata", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("📥 Receiving snapshot through index %d from %s\n", req.Snapshot.LastIndex, req.LeaderID)
+	resp, err := s.store.consensus.HandleInstallSnapshot(req, r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		fmt.Printf("❌ Failed to install snapshot: %v\n", err)
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 // Leader status
+func (s *Server) RequestVoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req consensus.RequestVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.store.consensus.HandleRequestVote(req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (s *Server) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -274,50 +1296,48 @@ func (s *Server) PriorityHandler(w http.ResponseWriter, r *http.Request) {
 
 // set leader
 func (s *Server) SetLeaderHandler(w http.ResponseWriter, r *http.Request) {
-	var payload map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	var payload struct {
+		Leader string `json:"leader"`
+		Term   uint64 `json:"term"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Leader == "" {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	leader, ok := payload["leader"]
-	if ok && leader != "" {
-		s.store.consensus.State.SetLeader(leader)
-		fmt.Printf("🔄 Leader updated to: %s\n", leader)
-		// if isAlive {
-		// 	s.store.consensus.State.SetLeader(leader)
-		// 	fmt.Printf("🔄 Leader updated to: %s\n", leader)
-		// } else {
-		// 	fmt.Printf("⚠️ Rejected set-leader: %s is not alive\n", leader)
-		// }
+	if !s.store.consensus.HandleSetLeader(payload.Leader, payload.Term) {
+		http.Error(w, "Stale term", http.StatusConflict)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// LeaderHandler returns the current leader's address.
 func (s *Server) LeaderHandler(w http.ResponseWriter, r *http.Request) {
 	leader := s.store.consensus.State.GetLeader()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"leader": leader})
 }
 
-// ProxyHandler forwards unknown requests to the current leader
+// ProxyHandler forwards unknown requests to the current leader. The leader has nowhere
+// to forward them, so it answers 404.
 func (s *Server) ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.store.consensus.State.IsLeader() {
+		http.NotFound(w, r)
+		return
+	}
 	leader := s.store.consensus.State.GetLeader()
 	if leader == "" {
 		http.Error(w, "No leader available", http.StatusServiceUnavailable)
 		return
 	}
 
-	url := fmt.Sprintf("http://%s%s", leader, r.URL.Path)
-	req, err := http.NewRequest(r.Method, url, r.Body)
+	req, err := http.NewRequest(r.Method, s.peerURL(leader, r.URL.Path), r.Body)
 	if err != nil {
 		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
 		return
 	}
 
 	req.Header = r.Header
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := s.peerClient.Do(req)
 	if err != nil {
 		http.Error(w, "Leader not reachable", http.StatusBadGateway)
 		return
@@ -339,7 +1359,11 @@ func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "No leader available", http.StatusServiceUnavailable)
 			return
 		}
-		resp, err := http.Get("http://" + leader + "/api/status")
+		url := s.peerURL(leader, "/api/status")
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+		resp, err := s.peerClient.Get(url)
 		if err != nil {
 			http.Error(w, "Failed to proxy status to leader", http.StatusBadGateway)
 			return
@@ -354,8 +1378,27 @@ func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	status := s.store.consensus.GetNodeStatus()
 	fmt.Printf("📤 Serving /api/status: %+v\n", status)
 	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("detail") == "true" {
+		json.NewEncoder(w).Encode(StatusDetail{
+			Leader: s.store.consensus.State.GetLeader(),
+			Term:   s.store.consensus.State.GetTerm(),
+			Nodes:  status,
+			Lease:  s.store.consensus.GetLeaseStatus(),
+		})
+		return
+	}
 	json.NewEncoder(w).Encode(status)
 }
+
+// StatusDetail is the body of /api/status?detail=true: node liveness plus the leader's
+// term and lease.
+type StatusDetail struct {
+	Leader string                `json:"leader"`
+	Term   uint64                `json:"term"`
+	Nodes  map[string]bool       `json:"nodes"`
+	Lease  consensus.LeaseStatus `json:"lease"`
+}
+
 func (s *Server) WeightsHandler(w http.ResponseWriter, r *http.Request) {
 	if !s.store.consensus.State.IsLeader() {
 		leader := s.store.consensus.State.GetLeader()
@@ -363,7 +1406,7 @@ func (s *Server) WeightsHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "No leader available", http.StatusServiceUnavailable)
 			return
 		}
-		resp, err := http.Get("http://" + leader + "/api/weights")
+		resp, err := s.peerClient.Get(s.peerURL(leader, "/api/weights"))
 		if err != nil {
 			http.Error(w, "Failed to proxy weights to leader", http.StatusBadGateway)
 			return
@@ -394,8 +1437,8 @@ func (s *Server) NotifyConsensusHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	fmt.Printf("🔔 Received consensus notification from %s\n", payload.Sender)
+	// Weights only change after a committed round; here the sender is just marked alive.
 	s.store.consensus.MarkNodeAlive(payload.Sender)
-	s.store.consensus.UpdateCabinetWeights(s.store.consensus.GetPeers())
 	w.WriteHeader(http.StatusOK)
 }
 func (s *Server) ModeHandler(w http.ResponseWriter, r *http.Request) {
@@ -403,26 +1446,119 @@ func (s *Server) ModeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"mode": mode})
 }
 
-// Start initializes the HTTP server.
-func (s *Server) Start(addr string) error {
+// peerRoutes are the internal routes that only other nodes call.
+func (s *Server) peerRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/append-entries":   s.AppendEntriesHandler,
+		"/api/propose":          s.ProposeHandler,
+		"/api/log-status":       s.LogStatusHandler,
+		"/api/log-entries":      s.LogEntriesHandler,
+		"/api/read-index":       s.ReadIndexHandler,
+		"/api/snapshot":         s.SnapshotHandler,
+		"/api/install-snapshot": s.InstallSnapshotHandler,
+		"/api/request-vote":     s.RequestVoteHandler,
+		"/api/set-leader":       s.SetLeaderHandler,
+		"/api/notify-consensus": s.NotifyConsensusHandler,
+	}
+}
+
+// sharedRoutes are called by other nodes and by clients alike.
+func (s *Server) sharedRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/heartbeat": s.HeartbeatHandler,
+		"/api/leader":    s.LeaderHandler,
+		"/api/weights":   s.WeightsHandler,
+		"/api/status":    s.StatusHandler,
+	}
+}
+
+// refusePeerRoute answers an internal route called on the client address.
+func refusePeerRoute(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Internal route; not served on the client address", http.StatusForbidden)
+}
+
+// Start serves clients on addr and the internal routes on peerAddr, refusing them on addr.
+// If peerAddr is empty or addr, one listener serves both, as before peer addresses existed.
+func (s *Server) Start(addr, peerAddr string) error {
+	separate := peerAddr != "" && peerAddr != addr
+	mux := http.NewServeMux()
+	peerMux := mux
+	if separate {
+		peerMux = http.NewServeMux()
+	}
+
 	fmt.Println("Starting HTTP server on", addr)
-	http.Handle("/", http.HandlerFunc(s.ServeStatic))
-	http.HandleFunc("/api/put", s.PutHandler)
-	http.HandleFunc("/api/get", s.GetHandler)
-	http.HandleFunc("/api/get-all", s.GetAllHandler)
-	http.HandleFunc("/api/delete", s.DeleteHandler)
-	http.HandleFunc("/api/approve", s.ApproveHandler)
-	http.HandleFunc("/api/replicate", s.ReplicationHandler)
-	http.HandleFunc("/api/heartbeat", s.HeartbeatHandler)
-	http.HandleFunc("/api/priority", s.PriorityHandler)
-	http.HandleFunc("/api/set-leader", s.SetLeaderHandler)
-	http.HandleFunc("/api/leader", s.LeaderHandler)
-	http.HandleFunc("/api/weights", s.WeightsHandler)
-	http.HandleFunc("/api/status", s.StatusHandler)
-	http.HandleFunc("/api/notify-consensus", s.NotifyConsensusHandler)
-	http.HandleFunc("/api/mode", s.ModeHandler)
-
-	http.HandleFunc("/api/", s.ProxyHandler) // Catch-all fallback
-
-	return http.ListenAndServe(addr, nil)
+	mux.Handle("/", http.HandlerFunc(s.ServeStatic))
+	mux.HandleFunc("/api/put", s.PutHandler)
+	mux.HandleFunc("/api/get", s.GetHandler)
+	mux.HandleFunc("/api/get-all", s.GetAllHandler)
+	mux.HandleFunc("/api/history", s.HistoryHandler)
+	mux.HandleFunc("/api/range", s.RangeHandler)
+	mux.HandleFunc("/api/watch", s.WatchHandler)
+	mux.HandleFunc("/api/delete", s.DeleteHandler)
+	mux.HandleFunc("/api/cas", s.CASHandler)
+	mux.HandleFunc("/api/txn", s.TxnHandler)
+	mux.HandleFunc("/api/batch", s.BatchHandler)
+	mux.HandleFunc("/api/lease", s.LeaseHandler)
+	mux.HandleFunc("/api/lease/grant", s.LeaseGrantHandler)
+	mux.HandleFunc("/api/lease/keepalive", s.LeaseKeepAliveHandler)
+	mux.HandleFunc("/api/lease/revoke", s.LeaseRevokeHandler)
+	mux.HandleFunc("/api/auth/login", s.LoginHandler)
+	mux.HandleFunc("/api/auth/logout", s.LogoutHandler)
+	mux.HandleFunc("/api/auth/status", s.AuthStatusHandler)
+	mux.HandleFunc("/api/auth/enable", s.AuthEnableHandler)
+	mux.HandleFunc("/api/auth/disable", s.AuthDisableHandler)
+	mux.HandleFunc("/api/auth/user", s.UserHandler)
+	mux.HandleFunc("/api/auth/user/put", s.UserPutHandler)
+	mux.HandleFunc("/api/auth/user/delete", s.UserDeleteHandler)
+	mux.HandleFunc("/api/auth/role", s.RoleHandler)
+	mux.HandleFunc("/api/auth/role/put", s.RolePutHandler)
+	mux.HandleFunc("/api/auth/role/delete", s.RoleDeleteHandler)
+	mux.HandleFunc("/api/priority", s.PriorityHandler)
+	mux.HandleFunc("/api/mode", s.ModeHandler)
+
+	for path, handler := range s.peerRoutes() {
+		peerMux.HandleFunc(path, s.peerOnly(handler))
+		// Paths below an internal route would otherwise reach the catch-all proxy, which
+		// forwards them to the leader with this node's credentials.
+		peerMux.HandleFunc(path+"/", s.peerOnly(http.NotFound))
+		if separate {
+			mux.HandleFunc(path, refusePeerRoute)
+			mux.HandleFunc(path+"/", refusePeerRoute)
+		}
+	}
+	for path, handler := range s.sharedRoutes() {
+		mux.HandleFunc(path, handler)
+		if separate {
+			peerMux.HandleFunc(path, handler)
+		}
+	}
+
+	mux.HandleFunc("/api/", s.ProxyHandler) // Catch-all fallback
+
+	if separate {
+		fmt.Println("Starting peer HTTP server on", peerAddr)
+		if s.tlsConfig == nil {
+			fmt.Println("⚠️ Peer listener has no TLS: anyone who can reach", peerAddr, "can call the internal routes")
+		}
+		peerTLS := s.tlsConfig
+		if peerTLS != nil {
+			peerTLS = peerTLS.Clone()
+			peerTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		errs := make(chan error, 2)
+		go func() { errs <- listen(peerAddr, peerMux, peerTLS) }()
+		go func() { errs <- listen(addr, mux, s.tlsConfig) }()
+		return <-errs
+	}
+	return listen(addr, mux, s.tlsConfig)
+}
+
+// listen serves handler on addr, over TLS if tlsConfig is set.
+func listen(addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
 }
@@ -0,0 +1,519 @@
+package kvstore
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteEngine keeps the store in SQLite: current keys in kv_store, their history in
+// kv_history, leases in kv_leases and the applied index in kv_meta.
+type sqliteEngine struct {
+	sqliteReader
+	db *sql.DB
+}
+
+// sqlConn is satisfied by both *sql.DB and *sql.Tx.
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteReader implements Reader on the database or on an open transaction.
+type sqliteReader struct {
+	q sqlConn
+}
+
+// sqliteBatch is a WriteBatch in one SQLite transaction.
+type sqliteBatch struct {
+	sqliteReader
+	tx *sql.Tx
+}
+
+// NewSQLiteEngine opens, creating or migrating as needed, the SQLite database at path.
+func NewSQLiteEngine(path string) (StorageEngine, error) {
+	db, err := sql.Open("sqlite", path)
+	fmt.Println("📂 Opening database at:", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS kv_store (
+            key TEXT PRIMARY KEY,
+            value TEXT,
+            version INTEGER NOT NULL DEFAULT 1,
+            create_revision INTEGER NOT NULL DEFAULT 0,
+            mod_revision INTEGER NOT NULL DEFAULT 0,
+            expires_at INTEGER NOT NULL DEFAULT 0,
+            lease INTEGER NOT NULL DEFAULT 0
+        )
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create table: %v", err)
+	}
+	if err := migrateMVCC(db); err != nil {
+		return nil, err
+	}
+	if err := migrateExpiry(db); err != nil {
+		return nil, err
+	}
+	if err := migrateLeases(db); err != nil {
+		return nil, err
+	}
+	if err := migrateRange(db); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS kv_meta (
+            name TEXT PRIMARY KEY,
+            value INTEGER
+        )
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create meta table: %v", err)
+	}
+	return &sqliteEngine{sqliteReader: sqliteReader{q: db}, db: db}, nil
+}
+
+// migrateMVCC adds the version columns and history table to a store created before they
+// existed, recording each existing key as version 1.
+func migrateMVCC(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS kv_history (
+            key TEXT NOT NULL,
+            version INTEGER NOT NULL,
+            create_revision INTEGER NOT NULL,
+            mod_revision INTEGER NOT NULL,
+            value TEXT NOT NULL,
+            deleted INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (key, version)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create history table: %v", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS kv_history_revision ON kv_history (mod_revision)`); err != nil {
+		return fmt.Errorf("failed to index history table: %v", err)
+	}
+
+	var hasVersion int
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('kv_store') WHERE name = 'version'`).Scan(&hasVersion)
+	if err != nil {
+		return fmt.Errorf("failed to inspect kv_store: %v", err)
+	}
+	if hasVersion > 0 {
+		return nil
+	}
+
+	fmt.Println("🔧 Adding version columns to kv_store")
+	for _, stmt := range []string{
+		`ALTER TABLE kv_store ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE kv_store ADD COLUMN create_revision INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE kv_store ADD COLUMN mod_revision INTEGER NOT NULL DEFAULT 0`,
+		`INSERT OR IGNORE INTO kv_history (key, version, create_revision, mod_revision, value)
+            SELECT key, version, create_revision, mod_revision, value FROM kv_store`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to migrate kv_store: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateExpiry adds the expiry column to a store created before keys could expire.
+func migrateExpiry(db *sql.DB) error {
+	if err := ensureColumn(db, "expires_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS kv_store_expiry ON kv_store (expires_at) WHERE expires_at > 0`); err != nil {
+		return fmt.Errorf("failed to index kv_store expiry: %v", err)
+	}
+	return nil
+}
+
+// migrateLeases creates the lease table and adds the owning-lease column to kv_store.
+func migrateLeases(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS kv_leases (
+            id INTEGER PRIMARY KEY,
+            ttl INTEGER NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create lease table: %v", err)
+	}
+	if err := ensureColumn(db, "lease", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS kv_store_lease ON kv_store (lease) WHERE lease > 0`); err != nil {
+		return fmt.Errorf("failed to index kv_store leases: %v", err)
+	}
+	return nil
+}
+
+// migrateRange adds an index that covers both the key order and the expiry filter, so
+// counting a range never has to visit the rows.
+func migrateRange(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS kv_store_key_expiry ON kv_store (key, expires_at)`); err != nil {
+		return fmt.Errorf("failed to index kv_store range: %v", err)
+	}
+	return nil
+}
+
+// ensureColumn adds a column to kv_store if it does not have it yet.
+func ensureColumn(db *sql.DB, name, decl string) error {
+	var has int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('kv_store') WHERE name = ?`, name).Scan(&has)
+	if err != nil {
+		return fmt.Errorf("failed to inspect kv_store: %v", err)
+	}
+	if has > 0 {
+		return nil
+	}
+	fmt.Printf("🔧 Adding column %s to kv_store\n", name)
+	if _, err := db.Exec(`ALTER TABLE kv_store ADD COLUMN ` + name + ` ` + decl); err != nil {
+		return fmt.Errorf("failed to migrate kv_store: %v", err)
+	}
+	return nil
+}
+
+const kvColumns = `key, value, version, create_revision, mod_revision, expires_at, lease`
+
+// scanKeyValue reads a row selected with kvColumns.
+func scanKeyValue(scan func(dest ...interface{}) error) (KeyValue, error) {
+	var kv KeyValue
+	err := scan(&kv.Key, &kv.Value, &kv.Version, &kv.CreateRevision, &kv.ModRevision, &kv.ExpiresAt, &kv.Lease)
+	return kv, err
+}
+
+func (r sqliteReader) Get(key string) (KeyValue, bool, error) {
+	kv, err := scanKeyValue(r.q.QueryRow(`SELECT `+kvColumns+` FROM kv_store WHERE key = ?`, key).Scan)
+	if err == sql.ErrNoRows {
+		return KeyValue{Key: key}, false, nil
+	}
+	return kv, err == nil, err
+}
+
+func (r sqliteReader) LastVersion(key string) (uint64, error) {
+	var version sql.NullInt64
+	err := r.q.QueryRow(`SELECT MAX(version) FROM kv_history WHERE key = ?`, key).Scan(&version)
+	return uint64(version.Int64), err
+}
+
+func (r sqliteReader) Lease(id uint64) (int64, bool, error) {
+	var ttl int64
+	err := r.q.QueryRow(`SELECT ttl FROM kv_leases WHERE id = ?`, id).Scan(&ttl)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return ttl, err == nil, err
+}
+
+func (r sqliteReader) LeaseKeys(id uint64) ([]string, error) {
+	rows, err := r.q.Query(`SELECT key FROM kv_store WHERE lease = ? ORDER BY key`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r sqliteReader) Changes(start, end string, from, to uint64, fn func(WatchEvent) error) error {
+	query := `SELECT key, value, version, create_revision, mod_revision, deleted FROM kv_history
+        WHERE key >= ? AND mod_revision BETWEEN ? AND ?`
+	args := []interface{}{start, from, to}
+	if end != "" {
+		query += ` AND key < ?`
+		args = append(args, end)
+	}
+	rows, err := r.q.Query(query+` ORDER BY mod_revision, rowid`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev WatchEvent
+		var deleted bool
+		if err := rows.Scan(&ev.Key, &ev.Value, &ev.Version, &ev.CreateRevision, &ev.ModRevision, &deleted); err != nil {
+			return err
+		}
+		ev.Type = "PUT"
+		if deleted {
+			ev.Type = "DELETE"
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// rangeWhere builds the condition selecting the keys of a range.
+func rangeWhere(start, end string, now int64) (string, []interface{}) {
+	where := `key >= ?`
+	args := []interface{}{start}
+	if end != "" {
+		where += ` AND key < ?`
+		args = append(args, end)
+	}
+	if now != 0 {
+		where += ` AND (expires_at = 0 OR expires_at > ?)`
+		args = append(args, now)
+	}
+	return where, args
+}
+
+func (e *sqliteEngine) Range(start, end string, now int64, fn func(KeyValue) bool) error {
+	where, args := rangeWhere(start, end, now)
+	rows, err := e.db.Query(`SELECT `+kvColumns+` FROM kv_store WHERE `+where+` ORDER BY key`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		kv, err := scanKeyValue(rows.Scan)
+		if err != nil {
+			return err
+		}
+		if !fn(kv) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (e *sqliteEngine) Count(start, end string, now int64) (int, error) {
+	where, args := rangeWhere(start, end, now)
+	var count int
+	err := e.db.QueryRow(`SELECT COUNT(*) FROM kv_store WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+func (e *sqliteEngine) History(key string) ([]HistoryEntry, error) {
+	rows, err := e.db.Query(`SELECT version, value, create_revision, mod_revision, deleted FROM kv_history WHERE key = ? ORDER BY version`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var h HistoryEntry
+		if err := rows.Scan(&h.Version, &h.Value, &h.CreateRevision, &h.ModRevision, &h.Deleted); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func (e *sqliteEngine) Expired(now int64, limit int) ([]KeyValue, error) {
+	rows, err := e.db.Query(`SELECT `+kvColumns+` FROM kv_store WHERE expires_at > 0 AND expires_at <= ? ORDER BY expires_at, key LIMIT ?`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []KeyValue
+	for rows.Next() {
+		kv, err := scanKeyValue(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, kv)
+	}
+	return due, rows.Err()
+}
+
+func (e *sqliteEngine) Leases() (map[uint64]int64, error) {
+	rows, err := e.db.Query(`SELECT id, ttl FROM kv_leases`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ttls := make(map[uint64]int64)
+	for rows.Next() {
+		var id uint64
+		var ttl int64
+		if err := rows.Scan(&id, &ttl); err != nil {
+			return nil, err
+		}
+		ttls[id] = ttl
+	}
+	return ttls, rows.Err()
+}
+
+func (e *sqliteEngine) AppliedIndex() (uint64, error) {
+	var index uint64
+	err := e.db.QueryRow(`SELECT value FROM kv_meta WHERE name = 'applied_index'`).Scan(&index)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return index, err
+}
+
+func (e *sqliteEngine) Begin() (WriteBatch, error) {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBatch{sqliteReader: sqliteReader{q: tx}, tx: tx}, nil
+}
+
+func (e *sqliteEngine) Snapshot(fn func(SnapshotRecord) error) error {
+	queries := []struct {
+		sql     string
+		history bool
+	}{
+		{`SELECT key, value, version, create_revision, mod_revision, expires_at, lease, 0 FROM kv_store ORDER BY key`, false},
+		{`SELECT key, value, version, create_revision, mod_revision, 0, 0, deleted FROM kv_history ORDER BY key, version`, true},
+	}
+	for _, q := range queries {
+		if err := e.snapshotRows(q.sql, q.history, fn); err != nil {
+			return err
+		}
+	}
+
+	rows, err := e.db.Query(`SELECT id, ttl FROM kv_leases ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec := SnapshotRecord{LeaseRecord: true}
+		if err := rows.Scan(&rec.Lease, &rec.TTL); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// snapshotRows hands fn the rows of one snapshot query.
+func (e *sqliteEngine) snapshotRows(query string, history bool, fn func(SnapshotRecord) error) error {
+	rows, err := e.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec := SnapshotRecord{History: history}
+		if err := rows.Scan(&rec.Key, &rec.Value, &rec.Version, &rec.CreateRevision, &rec.ModRevision, &rec.ExpiresAt, &rec.Lease, &rec.Deleted); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (e *sqliteEngine) Restore(index uint64, next func() (SnapshotRecord, error)) error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"kv_store", "kv_history", "kv_leases"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if rec.LeaseRecord {
+			_, err = tx.Exec(`INSERT INTO kv_leases (id, ttl) VALUES (?, ?)`, rec.Lease, rec.TTL)
+		} else if rec.History {
+			_, err = tx.Exec(`INSERT INTO kv_history (key, version, create_revision, mod_revision, value, deleted) VALUES (?, ?, ?, ?, ?, ?)`,
+				rec.Key, rec.Version, rec.CreateRevision, rec.ModRevision, rec.Value, rec.Deleted)
+		} else {
+			_, err = tx.Exec(`INSERT INTO kv_store (key, value, version, create_revision, mod_revision, expires_at, lease) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				rec.Key, rec.Value, rec.Version, rec.CreateRevision, rec.ModRevision, rec.ExpiresAt, rec.Lease)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO kv_meta (name, value) VALUES ('applied_index', ?)`, index); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (e *sqliteEngine) Close() error {
+	return e.db.Close()
+}
+
+func (b *sqliteBatch) Put(kv KeyValue) error {
+	_, err := b.tx.Exec(`INSERT OR REPLACE INTO kv_store (key, value, version, create_revision, mod_revision, expires_at, lease) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		kv.Key, kv.Value, kv.Version, kv.CreateRevision, kv.ModRevision, kv.ExpiresAt, kv.Lease)
+	return err
+}
+
+func (b *sqliteBatch) Delete(key string) error {
+	_, err := b.tx.Exec(`DELETE FROM kv_store WHERE key = ?`, key)
+	return err
+}
+
+func (b *sqliteBatch) AddVersion(key string, h HistoryEntry) error {
+	_, err := b.tx.Exec(`INSERT OR REPLACE INTO kv_history (key, version, create_revision, mod_revision, value, deleted) VALUES (?, ?, ?, ?, ?, ?)`,
+		key, h.Version, h.CreateRevision, h.ModRevision, h.Value, h.Deleted)
+	return err
+}
+
+func (b *sqliteBatch) PruneHistory(rev uint64) error {
+	_, err := b.tx.Exec(`
+        DELETE FROM kv_history
+        WHERE mod_revision <= ?
+          AND version < (SELECT MAX(h.version) FROM kv_history h WHERE h.key = kv_history.key)
+    `, rev)
+	return err
+}
+
+func (b *sqliteBatch) PutLease(id uint64, ttl int64) error {
+	_, err := b.tx.Exec(`INSERT OR REPLACE INTO kv_leases (id, ttl) VALUES (?, ?)`, id, ttl)
+	return err
+}
+
+func (b *sqliteBatch) DeleteLease(id uint64) error {
+	_, err := b.tx.Exec(`DELETE FROM kv_leases WHERE id = ?`, id)
+	return err
+}
+
+func (b *sqliteBatch) SetAppliedIndex(index uint64) error {
+	_, err := b.tx.Exec(`INSERT OR REPLACE INTO kv_meta (name, value) VALUES ('applied_index', ?)`, index)
+	return err
+}
+
+func (b *sqliteBatch) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *sqliteBatch) Rollback() error {
+	err := b.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
@@ -1,61 +1,361 @@
 package kvstore
 
 import (
-	"database/sql"
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"kvstore/cdc"
 	"kvstore/consensus"
 	"sync"
-
-	_ "modernc.org/sqlite"
+	"time"
 )
 
-// KVStore represents a key-value store backed by SQLite.
+// applyTimeout bounds how long a write waits for its committed entry to be applied locally.
+const applyTimeout = 5 * time.Second
+
+// KVStore represents a key-value store backed by a StorageEngine.
 type KVStore struct {
 	mu        sync.RWMutex
-	db        *sql.DB
+	engine    StorageEngine
 	consensus *consensus.Consensus
+
+	// appliedIndex is the last log index written to the engine by the apply loop.
+	applyMu      sync.Mutex
+	appliedIndex uint64
+	waiters      []applyWaiter
+	appliedCh    chan struct{}          // closed, and replaced, whenever appliedIndex moves
+	results      map[uint64]interface{} // outcomes of conditional operations and transactions, by index
+
+	// leaseDeadlines is tracked by the leader only; see lease.go.
+	leaseMu        sync.Mutex
+	leaseDeadlines map[uint64]*leaseDeadline
+
+	cdc *cdc.Writer // optional change-data-capture sink
+}
+
+// applyWaiter is released once the apply loop reaches index.
+type applyWaiter struct {
+	index uint64
+	done  chan struct{}
 }
 
-// NewKVStore initializes the store with consensus.
+// InMemory, passed as the database path, keeps the store in memory instead of SQLite.
+const InMemory = ":memory:"
+
+// NewKVStore initializes the store with consensus, in the SQLite database at dbPath or,
+// if dbPath is InMemory, in memory.
 func NewKVStore(dbPath string, consensus *consensus.Consensus) (*KVStore, error) {
-	db, err := sql.Open("sqlite", dbPath)
-	fmt.Println("📂 Opening database at:", dbPath)
+	return NewKVStoreWithCDC(dbPath, consensus, nil)
+}
+
+// NewKVStoreWithCDC is NewKVStore with every applied entry also written to sink.
+func NewKVStoreWithCDC(dbPath string, consensus *consensus.Consensus, sink *cdc.Writer) (*KVStore, error) {
+	if dbPath == InMemory {
+		return NewKVStoreWithEngine(NewMemoryEngine(), consensus, sink)
+	}
+	engine, err := NewSQLiteEngine(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
+	}
+	return NewKVStoreWithEngine(engine, consensus, sink)
+}
+
+// NewKVStoreWithEngine initializes the store on an open engine. sink may be nil.
+func NewKVStoreWithEngine(engine StorageEngine, consensus *consensus.Consensus, sink *cdc.Writer) (*KVStore, error) {
+	kv := &KVStore{engine: engine, consensus: consensus, appliedCh: make(chan struct{}), results: make(map[uint64]interface{}), leaseDeadlines: make(map[uint64]*leaseDeadline), cdc: sink}
+	var err error
+	if kv.appliedIndex, err = engine.AppliedIndex(); err != nil {
+		return nil, fmt.Errorf("failed to read applied index: %v", err)
 	}
+	fmt.Printf("📌 Resuming apply loop after index %d\n", kv.appliedIndex)
+
+	go kv.applyLoop(consensus.AttachStateMachine(kv, kv.appliedIndex))
+	go kv.expireLoop()
+	return kv, nil
+}
+
+// maxApplyBatch bounds how many queued entries the apply loop commits in one write batch.
+const maxApplyBatch = 256
+
+// applyLoop is the only writer to the engine: it applies committed log entries, and
+// snapshots received during catch-up, in order. Entries already queued when it gets to
+// them are applied together, in one write batch.
+func (kv *KVStore) applyLoop(msgs <-chan consensus.ApplyMsg) {
+	var held *consensus.ApplyMsg
+	for {
+		var msg consensus.ApplyMsg
+		if held != nil {
+			msg, held = *held, nil
+		} else {
+			var ok bool
+			if msg, ok = <-msgs; !ok {
+				return
+			}
+		}
+
+		if msg.Snapshot != nil {
+			// Entries must not be skipped, so keep retrying until the engine accepts the write.
+			for {
+				err := kv.restoreSnapshot(msg.Snapshot)
+				if err == nil {
+					break
+				}
+				fmt.Printf("❌ Failed to apply snapshot at index %d: %v\n", msg.Snapshot.LastIndex, err)
+				time.Sleep(100 * time.Millisecond)
+			}
+			kv.markApplied(msg.Snapshot.LastIndex, nil, nil)
+			continue
+		}
+
+		entries := []consensus.LogEntry{msg.Entry}
+	drain:
+		for len(entries) < maxApplyBatch {
+			select {
+			case next, ok := <-msgs:
+				if !ok {
+					break drain
+				}
+				if next.Snapshot != nil {
+					held = &next
+					break drain
+				}
+				entries = append(entries, next.Entry)
+			default:
+				break drain
+			}
+		}
+
+		var results []interface{}
+		for {
+			var err error
+			if results, err = kv.applyEntries(entries); err == nil {
+				break
+			}
+			fmt.Printf("❌ Failed to apply indexes %d..%d: %v\n", entries[0].Index, entries[len(entries)-1].Index, err)
+			time.Sleep(100 * time.Millisecond)
+		}
+		kv.markApplied(entries[len(entries)-1].Index, entries, results)
+	}
+}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS kv_store (
-            key TEXT PRIMARY KEY,
-            value TEXT
-        )
-    `)
+// markApplied advances the applied index, records the outcomes of entries and releases
+// everyone waiting for them.
+func (kv *KVStore) markApplied(index uint64, entries []consensus.LogEntry, results []interface{}) {
+	kv.applyMu.Lock()
+	defer kv.applyMu.Unlock()
+	kv.appliedIndex = index
+	close(kv.appliedCh)
+	kv.appliedCh = make(chan struct{})
+	for i, result := range results {
+		if result != nil {
+			kv.recordResultLocked(entries[i].Index, result)
+		}
+	}
+	remaining := kv.waiters[:0]
+	for _, w := range kv.waiters {
+		if w.index <= index {
+			close(w.done)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	kv.waiters = remaining
+}
+
+// WriteSnapshot streams every key-value pair, then the retained history and the granted
+// leases, to w, one JSON record per line, and returns the applied index the records reflect.
+func (kv *KVStore) WriteSnapshot(w io.Writer) (uint64, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	// Read the index from the engine rather than appliedIndex, which is bumped only after
+	// the apply batch commits and could lag the records we are about to read.
+	lastIndex, err := kv.engine.AppliedIndex()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+		return 0, err
 	}
 
-	return &KVStore{db: db, consensus: consensus}, nil
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	if err := kv.engine.Snapshot(func(rec SnapshotRecord) error { return enc.Encode(rec) }); err != nil {
+		return 0, err
+	}
+	return lastIndex, buf.Flush()
+}
+
+// restoreSnapshot replaces the whole keyspace, its history and the leases with the
+// snapshot's contents.
+func (kv *KVStore) restoreSnapshot(snap *consensus.Snapshot) error {
+	data, err := snap.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	defer data.Close()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	dec := json.NewDecoder(bufio.NewReader(data))
+	count := 0
+	next := func() (SnapshotRecord, error) {
+		var rec SnapshotRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return rec, err
+		} else if err != nil {
+			return rec, fmt.Errorf("invalid snapshot data: %v", err)
+		}
+		if !rec.LeaseRecord && !rec.History {
+			// Snapshots taken before keys were versioned carry no version.
+			if rec.Version == 0 {
+				rec.Version = 1
+			}
+			count++
+		}
+		return rec, nil
+	}
+	if err := kv.engine.Restore(snap.LastIndex, next); err != nil {
+		return err
+	}
+	if kv.cdc != nil {
+		rec := cdc.Record{Index: snap.LastIndex, Term: snap.LastTerm, Op: cdc.OpSnapshot, Timestamp: time.Now()}
+		if err := kv.cdc.Write(rec); err != nil {
+			return fmt.Errorf("CDC write failed at index %d: %v", snap.LastIndex, err)
+		}
+	}
+	fmt.Printf("📦 Restored %d keys from snapshot at index %d\n", count, snap.LastIndex)
+	return nil
+}
+
+// applyEntries writes committed entries and the new applied index in a single write
+// batch. Conditional operations and transactions also return their outcome, at
+// the same position as their entry.
+func (kv *KVStore) applyEntries(entries []consensus.LogEntry) ([]interface{}, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	b, err := kv.engine.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer b.Rollback()
+
+	results := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		if results[i], err = applyEntry(b, entry); err != nil {
+			return nil, err
+		}
+		if kv.cdc != nil {
+			if err := kv.writeCDC(b, entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := b.SetAppliedIndex(entries[len(entries)-1].Index); err != nil {
+		return nil, err
+	}
+	return results, b.Commit()
+}
+
+// applyEntry applies one committed entry in b.
+func applyEntry(b WriteBatch, entry consensus.LogEntry) (interface{}, error) {
+	var result interface{}
+	var err error
+	switch entry.OpType {
+	case "PUT":
+		if entry.Lease != 0 {
+			result, err = applyLeasedPut(b, entry)
+			break
+		}
+		_, err = putKey(b, KeyValue{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt}, entry.Index)
+	case "DELETE":
+		_, err = deleteKey(b, entry.Key, entry.Index)
+	case opExpire:
+		err = applyExpire(b, entry)
+	case opCAS, opPutIfAbsent, opDeleteIf:
+		result, err = applyConditional(b, entry)
+	case opTxn:
+		result, err = applyTxn(b, entry)
+	case opBatch:
+		result, err = applyBatch(b, entry)
+	case opLeaseGrant:
+		result, err = applyLeaseGrant(b, entry)
+	case opLeaseRevoke:
+		result, err = applyLeaseRevoke(b, entry)
+	default:
+		fmt.Printf("⚠️ Skipping unknown operation %q at index %d\n", entry.OpType, entry.Index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.Index%historyPruneEvery == 0 {
+		if err := pruneHistory(b, entry.Index); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// appliedSignal returns the applied index and a channel closed once it moves on.
+func (kv *KVStore) appliedSignal() (uint64, <-chan struct{}) {
+	kv.applyMu.Lock()
+	defer kv.applyMu.Unlock()
+	return kv.appliedIndex, kv.appliedCh
+}
+
+// waitForApplied blocks until the apply loop has applied index.
+func (kv *KVStore) waitForApplied(index uint64) error {
+	kv.applyMu.Lock()
+	if kv.appliedIndex >= index {
+		kv.applyMu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	kv.waiters = append(kv.waiters, applyWaiter{index: index, done: done})
+	kv.applyMu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(applyTimeout):
+		return fmt.Errorf("timed out waiting for index %d to be applied", index)
+	}
+}
+
+// AppliedIndex returns the last log index applied to the engine.
+func (kv *KVStore) AppliedIndex() uint64 {
+	kv.applyMu.Lock()
+	defer kv.applyMu.Unlock()
+	return kv.appliedIndex
 }
 
 // Put stores a key-value pair in the store after reaching consensus.
 func (kv *KVStore) Put(key, value string) error {
-	fmt.Printf("Attempting consensus for key=%s, value=%s\n", key, value)
+	return kv.PutWithTTL(key, value, 0)
+}
 
-	if kv.consensus.ProposeChange("PUT", key, value) {
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
+// PutWithTTL stores a key-value pair that expires ttl from now, or never if ttl is zero.
+func (kv *KVStore) PutWithTTL(key, value string, ttl time.Duration) error {
+	fmt.Printf("Attempting consensus for key=%s, value=%s\n", key, value)
 
-		_, err := kv.db.Exec(`INSERT OR REPLACE INTO kv_store (key, value) VALUES (?, ?)`, key, value)
-		if err != nil {
-			fmt.Printf("SQLite write failed for key=%s: %v\n", key, err)
-		} else {
-			fmt.Printf("SQLite write successful for key=%s\n", key)
-		}
+	op := consensus.LogEntry{OpType: "PUT", Key: key, Value: value}
+	if ttl > 0 {
+		// The deadline is fixed here, by the proposer, so every replica records the same one.
+		op.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+	}
+	index, err := kv.propose(op)
+	if err != nil {
+		fmt.Printf("Consensus rejected PUT request for key=%s: %v\n", key, err)
 		return err
 	}
 
-	fmt.Printf("Consensus rejected PUT request for key=%s\n", key)
-	return fmt.Errorf("consensus not reached for key=%s", key)
+	if err := kv.waitForApplied(index); err != nil {
+		fmt.Printf("Storage write failed for key=%s: %v\n", key, err)
+		return err
+	}
+	fmt.Printf("Storage write successful for key=%s (index %d)\n", key, index)
+	return nil
 }
 
 // Get retrieves the value for a key (reads do not require consensus).
@@ -63,38 +363,58 @@ func (kv *KVStore) Get(key string) (string, bool, error) {
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
-	var value string
-	err := kv.db.QueryRow(`SELECT value FROM kv_store WHERE key = ?`, key).Scan(&value)
-	if err == sql.ErrNoRows {
-		return "", false, nil
-	}
-	return value, true, err
+	out, found, err := kv.engine.Get(key)
+	return out.Value, found, err
 }
 
 // Delete removes a key-value pair after reaching consensus.
 func (kv *KVStore) Delete(key string) error {
-	if kv.consensus.ProposeChange("DELETE", key, "") {
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-
-		_, err := kv.db.Exec(`DELETE FROM kv_store WHERE key = ?`, key)
+	index, err := kv.propose(consensus.LogEntry{OpType: "DELETE", Key: key})
+	if err != nil {
 		return err
 	}
-	return fmt.Errorf("consensus not reached")
-}
-func (kv *KVStore) ReplicatedPut(key, value string) {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	kv.db.Exec(`INSERT OR REPLACE INTO kv_store (key, value) VALUES (?, ?)`, key, value)
+	return kv.waitForApplied(index)
 }
 
-func (kv *KVStore) ReplicatedDelete(key string) {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	kv.db.Exec(`DELETE FROM kv_store WHERE key = ?`, key)
+// propose replicates op. It passes consensus.ErrProposalInDoubt through unchanged, so
+// callers can tell a write that may still apply from one that failed.
+func (kv *KVStore) propose(op consensus.LogEntry) (uint64, error) {
+	index, err := kv.consensus.Propose(op)
+	if err != nil && err != consensus.ErrProposalInDoubt {
+		return 0, fmt.Errorf("consensus not reached for %s key=%s: %v", op.OpType, op.Key, err)
+	}
+	return index, err
 }
 
-// Close closes the database connection.
+// Close closes the storage engine.
 func (kv *KVStore) Close() error {
-	return kv.db.Close()
+	if kv.cdc != nil {
+		kv.cdc.Close()
+	}
+	return kv.engine.Close()
+}
+
+// writeCDC records an entry and the writes it made in the change feed. It runs before the
+// apply batch commits, and a failure fails the batch so the apply loop retries both: an
+// entry may appear twice, with the same index, but never goes missing.
+func (kv *KVStore) writeCDC(r Reader, entry consensus.LogEntry) error {
+	rec := cdc.Record{
+		Index:     entry.Index,
+		Term:      entry.Term,
+		Op:        entry.OpType,
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: time.Now(),
+	}
+	err := r.Changes("", "", entry.Index, entry.Index, func(ev WatchEvent) error {
+		rec.Changes = append(rec.Changes, cdc.Change{Type: ev.Type, Key: ev.Key, Value: ev.Value, Version: ev.Version})
+		return nil
+	})
+	if err == nil {
+		err = kv.cdc.Write(rec)
+	}
+	if err != nil {
+		return fmt.Errorf("CDC write failed at index %d: %v", entry.Index, err)
+	}
+	return nil
 }
@@ -0,0 +1,104 @@
+package kvstore
+
+import (
+	"fmt"
+	"kvstore/consensus"
+	"strconv"
+	"time"
+)
+
+// A key put with a TTL carries an absolute deadline chosen by its proposer. Replicas never
+// delete it on their own clocks: the leader notices expired keys and proposes an EXPIRE
+// entry for each, so every replica removes the key at the same log index. Until that entry
+// is applied, reads hide the key, but conditional writes and transactions, which must
+// decide the same way on every replica, still see it.
+const opExpire = "EXPIRE"
+
+// expiryCheckInterval is how often the leader looks for expired keys, and expiryBatch
+// how many it expires per check.
+const (
+	expiryCheckInterval = 500 * time.Millisecond
+	expiryBatch         = 100
+)
+
+// expired reports whether a key with the given deadline has expired at now.
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt > 0 && expiresAt <= now.UnixMilli()
+}
+
+// remainingTTL returns the whole seconds, rounded up, until a key expires, or 0 if it
+// never does.
+func remainingTTL(expiresAt int64, now time.Time) int64 {
+	if expiresAt == 0 {
+		return 0
+	}
+	ms := expiresAt - now.UnixMilli()
+	if ms <= 0 {
+		return 0
+	}
+	return (ms + 999) / 1000
+}
+
+// expireLoop proposes EXPIRE entries for keys past their deadline, and revokes expired
+// leases, while this node leads.
+func (kv *KVStore) expireLoop() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !kv.consensus.State.IsLeader() {
+			kv.forgetLeaseDeadlines()
+			continue
+		}
+		kv.expireLeases(time.Now())
+
+		due, err := kv.expiredKeys(time.Now())
+		if err != nil {
+			fmt.Printf("❌ Failed to scan for expired keys: %v\n", err)
+			continue
+		}
+		for _, k := range due {
+			if !kv.consensus.State.IsLeader() {
+				break
+			}
+			fmt.Printf("⏳ Expiring key=%s\n", k.Key)
+			// The entry names the version that expired, so a key rewritten in the
+			// meantime is left alone.
+			index, err := kv.consensus.Propose(consensus.LogEntry{
+				OpType:   opExpire,
+				Key:      k.Key,
+				Expected: strconv.FormatUint(k.ModRevision, 10),
+			})
+			if err != nil {
+				fmt.Printf("❌ Consensus not reached expiring key=%s: %v\n", k.Key, err)
+				break
+			}
+			// Wait so the next scan does not see the key again.
+			if err := kv.waitForApplied(index); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// expiredKeys lists keys whose deadline has passed.
+func (kv *KVStore) expiredKeys(now time.Time) ([]KeyValue, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.engine.Expired(now.UnixMilli(), expiryBatch)
+}
+
+// applyExpire deletes the key named by an EXPIRE entry if it is still the version that
+// expired.
+func applyExpire(b WriteBatch, entry consensus.LogEntry) error {
+	_, current, err := lastVersion(b, entry.Key)
+	if err != nil || current == nil {
+		return err
+	}
+	if strconv.FormatUint(current.ModRevision, 10) != entry.Expected {
+		return nil
+	}
+	_, err = deleteKey(b, entry.Key, entry.Index)
+	return err
+}
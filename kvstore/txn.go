@@ -0,0 +1,248 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/consensus"
+)
+
+// opTxn replicates a whole transaction as one log entry; the TxnRequest is carried as
+// JSON in the entry's value. Its compares are evaluated at apply time, in the same write
+// batch as its operations, so every replica takes the same branch.
+const opTxn = "TXN"
+
+// Compare targets.
+const (
+	CompareValue   = "value"
+	CompareVersion = "version"
+	CompareExists  = "exists"
+)
+
+// Compare is one condition of a transaction. Op is "=", "!=", "<" or ">" ("=" if empty);
+// values compare as strings, and a missing key has version 0. An exists compare accepts
+// only "=" and "!=".
+type Compare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Op      string `json:"op,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Exists  bool   `json:"exists,omitempty"`
+}
+
+// TxnOp is one operation of a transaction: "put", "delete" or "get".
+type TxnOp struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxnRequest runs Success if every compare holds and Failure otherwise.
+type TxnRequest struct {
+	Compare []Compare `json:"compare"`
+	Success []TxnOp   `json:"success"`
+	Failure []TxnOp   `json:"failure"`
+}
+
+// TxnOpResult is the outcome of one operation. Exists reports whether the key existed
+// after a put or get, or before a delete.
+type TxnOpResult struct {
+	Type           string `json:"type"`
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	Version        uint64 `json:"version,omitempty"`
+	CreateRevision uint64 `json:"createRevision,omitempty"`
+	ModRevision    uint64 `json:"modRevision,omitempty"`
+	Exists         bool   `json:"exists"`
+}
+
+// TxnResponse reports which branch ran and the outcome of each of its operations.
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Revision  uint64        `json:"revision"`
+	Responses []TxnOpResult `json:"responses"`
+}
+
+// Validate checks the request before it is proposed, so that malformed transactions
+// never reach the log.
+func (req TxnRequest) Validate() error {
+	for i, c := range req.Compare {
+		if c.Key == "" {
+			return fmt.Errorf("compare %d: missing key", i)
+		}
+		switch c.Op {
+		case "", "=", "!=":
+		case "<", ">":
+			if c.Target == CompareExists {
+				return fmt.Errorf("compare %d: %s does not support %q", i, c.Target, c.Op)
+			}
+		default:
+			return fmt.Errorf("compare %d: unknown op %q", i, c.Op)
+		}
+		switch c.Target {
+		case CompareValue, CompareVersion, CompareExists:
+		default:
+			return fmt.Errorf("compare %d: unknown target %q", i, c.Target)
+		}
+	}
+	for _, ops := range [][]TxnOp{req.Success, req.Failure} {
+		for i, op := range ops {
+			if op.Key == "" {
+				return fmt.Errorf("operation %d: missing key", i)
+			}
+			switch op.Type {
+			case "put", "delete", "get":
+			default:
+				return fmt.Errorf("operation %d: unknown type %q", i, op.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Txn atomically applies req's success or failure operations, depending on its compares.
+func (kv *KVStore) Txn(req TxnRequest) (TxnResponse, error) {
+	if err := req.Validate(); err != nil {
+		return TxnResponse{}, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	result, err := kv.proposeForResult(consensus.LogEntry{OpType: opTxn, Value: string(data)})
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	return result.(TxnResponse), nil
+}
+
+// applyTxn evaluates and applies a transaction in b.
+func applyTxn(b WriteBatch, entry consensus.LogEntry) (TxnResponse, error) {
+	resp := TxnResponse{Revision: entry.Index, Responses: []TxnOpResult{}}
+	var req TxnRequest
+	if err := json.Unmarshal([]byte(entry.Value), &req); err != nil {
+		// Retrying cannot fix a malformed entry, and every replica sees the same bytes.
+		fmt.Printf("⚠️ Skipping malformed transaction at index %d: %v\n", entry.Index, err)
+		return resp, nil
+	}
+
+	resp.Succeeded = true
+	for _, c := range req.Compare {
+		ok, err := evalCompare(b, c)
+		if err != nil {
+			return TxnResponse{}, err
+		}
+		if !ok {
+			resp.Succeeded = false
+			break
+		}
+	}
+
+	ops := req.Success
+	if !resp.Succeeded {
+		ops = req.Failure
+	}
+	var err error
+	resp.Responses, err = applyOps(b, ops, entry.Index)
+	return resp, err
+}
+
+// applyOps runs operations in order in b at revision rev.
+func applyOps(b WriteBatch, ops []TxnOp, rev uint64) ([]TxnOpResult, error) {
+	results := make([]TxnOpResult, 0, len(ops))
+	for _, op := range ops {
+		out := TxnOpResult{Type: op.Type, Key: op.Key}
+		switch op.Type {
+		case "put":
+			kv, err := putKey(b, KeyValue{Key: op.Key, Value: op.Value}, rev)
+			if err != nil {
+				return nil, err
+			}
+			out.Value, out.Version, out.CreateRevision, out.ModRevision, out.Exists = kv.Value, kv.Version, kv.CreateRevision, kv.ModRevision, true
+		case "delete":
+			existed, err := deleteKey(b, op.Key, rev)
+			if err != nil {
+				return nil, err
+			}
+			out.Exists = existed
+		case "get":
+			_, current, err := lastVersion(b, op.Key)
+			if err != nil {
+				return nil, err
+			}
+			if current != nil {
+				out.Value, out.Version, out.CreateRevision, out.ModRevision, out.Exists = current.Value, current.Version, current.CreateRevision, current.ModRevision, true
+			}
+		}
+		results = append(results, out)
+	}
+	return results, nil
+}
+
+// evalCompare checks one compare against the key's current state in r.
+func evalCompare(r Reader, c Compare) (bool, error) {
+	_, current, err := lastVersion(r, c.Key)
+	if err != nil {
+		return false, err
+	}
+
+	var cmp int
+	switch c.Target {
+	case CompareExists:
+		if (current != nil) == c.Exists {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	case CompareVersion:
+		var version uint64
+		if current != nil {
+			version = current.Version
+		}
+		switch {
+		case version < c.Version:
+			cmp = -1
+		case version > c.Version:
+			cmp = 1
+		}
+	case CompareValue:
+		// A missing key has no value, so no value compare holds for it.
+		if current == nil {
+			return false, nil
+		}
+		switch {
+		case current.Value < c.Value:
+			cmp = -1
+		case current.Value > c.Value:
+			cmp = 1
+		}
+	}
+
+	switch c.Op {
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp == 0, nil
+}
+
+// Keys returns the keys the request may read, through its compares and gets, and the keys
+// it may write, in either branch.
+func (req TxnRequest) Keys() (reads, writes []string) {
+	for _, c := range req.Compare {
+		reads = append(reads, c.Key)
+	}
+	for _, ops := range [][]TxnOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if op.Type == "get" {
+				reads = append(reads, op.Key)
+			} else {
+				writes = append(writes, op.Key)
+			}
+		}
+	}
+	return reads, writes
+}
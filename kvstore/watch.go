@@ -0,0 +1,141 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Watches are served from the key history, which records every put and delete at the
+// revision (log index) that applied it. A watcher remembers the next revision it has to
+// deliver and, each time the apply loop moves on, replays the history from there. The same query
+// resumes a watch after a disconnect, and catches up after a snapshot was installed, as
+// long as the revisions it needs have not been pruned.
+
+// watchKeepAlive is how long a watch may be idle before the handler is asked to send a
+// keep-alive.
+const watchKeepAlive = 15 * time.Second
+
+// watchBatchRevisions bounds how many revisions one history query covers.
+const watchBatchRevisions = 1000
+
+// WatchEvent is one change to a key. Deletes carry no value.
+type WatchEvent struct {
+	Type           string `json:"type"` // "PUT" or "DELETE"
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	Version        uint64 `json:"version"`
+	CreateRevision uint64 `json:"createRevision"`
+	ModRevision    uint64 `json:"modRevision"`
+}
+
+// CompactedError means a watch asked for revisions whose history has been pruned.
+type CompactedError struct {
+	Revision uint64 // the oldest revision that can still be watched from
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("revisions before %d have been compacted", e.Revision)
+}
+
+// compactedBefore returns the oldest revision whose history is still complete once
+// index has been applied. Pruning runs at the same indexes on every replica, so this
+// holds on any node, including one restored from a snapshot.
+func compactedBefore(index uint64) uint64 {
+	pruned := index - index%historyPruneEvery
+	if pruned <= historyRetention {
+		return 1
+	}
+	return pruned - historyRetention + 1
+}
+
+// Watch calls fn with the changes to key, or to every key under it if prefix is set, from
+// revision start onwards, or from the next revision if start is 0. fn is called with no
+// events once the watch is established and after each watchKeepAlive of inactivity.
+// Watch returns when ctx is done or fn fails, or with a CompactedError if the revisions
+// it still has to deliver are pruned, before or after the watch is established.
+func (kv *KVStore) Watch(ctx context.Context, key string, prefix bool, start uint64, fn func([]WatchEvent) error) error {
+	applied, changed := kv.appliedSignal()
+	if start == 0 {
+		start = applied + 1
+	}
+	if oldest := compactedBefore(applied); start < oldest {
+		return &CompactedError{Revision: oldest}
+	}
+	if err := fn(nil); err != nil {
+		return err
+	}
+
+	idle := time.NewTimer(watchKeepAlive)
+	defer idle.Stop()
+	for {
+		for start <= applied {
+			end := min(applied, start+watchBatchRevisions-1)
+			events, err := kv.historyEvents(key, prefix, start, end)
+			if err != nil {
+				return err
+			}
+			if len(events) > 0 {
+				if err := fn(events); err != nil {
+					return err
+				}
+				idle.Reset(watchKeepAlive)
+			}
+			start = end + 1
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+			applied, changed = kv.appliedSignal()
+		case <-idle.C:
+			if err := fn(nil); err != nil {
+				return err
+			}
+			idle.Reset(watchKeepAlive)
+		}
+	}
+}
+
+// historyEvents reads the changes to matching keys in revisions [from, to], in the order
+// they were applied. It returns a CompactedError if the history from revision from on has
+// been pruned since the watch started, which a slow watcher or an installed snapshot can do.
+func (kv *KVStore) historyEvents(key string, prefix bool, from, to uint64) ([]WatchEvent, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	// Check against what the engine holds now, not the applied index the watch last saw.
+	applied, err := kv.engine.AppliedIndex()
+	if err != nil {
+		return nil, err
+	}
+	if oldest := compactedBefore(applied); from < oldest {
+		return nil, &CompactedError{Revision: oldest}
+	}
+
+	// An exact key is the range [key, key+"\x00").
+	end := key + "\x00"
+	if prefix {
+		end = prefixEnd(key)
+	}
+	var events []WatchEvent
+	err = kv.engine.Changes(key, end, from, to, func(ev WatchEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	return events, err
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, or ""
+// if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"kvstore/cdc"
 	"kvstore/config"
 	"kvstore/consensus"
 	"kvstore/kvstore"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+// clusterConfigPath is where the cluster's nodes and TLS settings are configured.
+const clusterConfigPath = "/app/config/cluster.conf"
+
 // Load cluster configuration
 func loadClusterConfig() ([]config.NodeConfig, int) {
-	nodes, err := config.LoadClusterConfig("/app/config/cluster.conf")
+	nodes, err := config.LoadClusterConfig(clusterConfigPath)
 	if err != nil {
 		fmt.Println("Error loading config:", err)
 		os.Exit(1)
@@ -26,15 +36,227 @@ func loadClusterConfig() ([]config.NodeConfig, int) {
 	return nodes, serverID
 }
 
+// loadLeaseConfig reads LEADER_LEASE and LEASE_CLOCK_DRIFT (Go durations such as "1s").
+func loadLeaseConfig() (time.Duration, time.Duration, error) {
+	duration, drift := time.Second, 100*time.Millisecond
+	if env := os.Getenv("LEADER_LEASE"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, 0, fmt.Errorf("LEADER_LEASE: %v", err)
+		}
+		duration = d
+	}
+	if env := os.Getenv("LEASE_CLOCK_DRIFT"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, 0, fmt.Errorf("LEASE_CLOCK_DRIFT: %v", err)
+		}
+		drift = d
+	}
+	return duration, drift, nil
+}
+
+// loadPipelineConfig reads PROPOSAL_BATCH_WINDOW (a Go duration, default 2ms) and
+// PROPOSAL_PIPELINE_DEPTH (default 4).
+func loadPipelineConfig() (time.Duration, int, error) {
+	window, depth := 2*time.Millisecond, 4
+	if env := os.Getenv("PROPOSAL_BATCH_WINDOW"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, 0, fmt.Errorf("PROPOSAL_BATCH_WINDOW: %v", err)
+		}
+		window = d
+	}
+	if env := os.Getenv("PROPOSAL_PIPELINE_DEPTH"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return 0, 0, fmt.Errorf("PROPOSAL_PIPELINE_DEPTH: %v", err)
+		}
+		depth = n
+	}
+	return window, depth, nil
+}
+
+// loadCDCWriter opens the change-data-capture sink if CDC_DIR is set. CDC_MAX_BYTES
+// (default 64 MiB) bounds each file and CDC_MAX_FILES (default 0, keep all) how many are kept.
+func loadCDCWriter() (*cdc.Writer, error) {
+	dir := os.Getenv("CDC_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	maxBytes := int64(64 << 20)
+	if env := os.Getenv("CDC_MAX_BYTES"); env != "" {
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("CDC_MAX_BYTES: %v", err)
+		}
+		maxBytes = n
+	}
+	maxFiles := 0
+	if env := os.Getenv("CDC_MAX_FILES"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("CDC_MAX_FILES: %v", err)
+		}
+		maxFiles = n
+	}
+	return cdc.NewWriter(dir, maxBytes, maxFiles)
+}
+
+// envOr returns the environment variable name, or def if it is unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// loadStorageEngine opens the named engine: sqlite, memory or log. A memory engine is
+// restored from snapshotPath, if set and the file exists.
+func loadStorageEngine(name, snapshotPath string) (kvstore.StorageEngine, error) {
+	path := "/data/kvstore.db"
+	if name == kvstore.EngineLog {
+		path = "/data/kvstore.log"
+	}
+	fmt.Println("💾 Using storage engine:", name)
+	engine, err := kvstore.OpenStorageEngine(name, path)
+	if err != nil || name != kvstore.EngineMemory || snapshotPath == "" {
+		return engine, err
+	}
+	index, found, err := kvstore.LoadSnapshotFile(engine, snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		fmt.Printf("📦 Loaded in-memory store from %s at index %d\n", snapshotPath, index)
+	}
+	return engine, nil
+}
+
+// loadTLSConfig reads the TLS settings from cluster.conf and, if TLS is on, returns the
+// configurations for this node's listeners and for its connections to other nodes.
+func loadTLSConfig(nodes []config.NodeConfig, myNode config.NodeConfig) (*tls.Config, *tls.Config, error) {
+	cfg, err := config.LoadTLSConfig(clusterConfigPath)
+	if err != nil || !cfg.Enabled() {
+		return nil, nil, err
+	}
+	return config.BuildTLS(cfg, nodes, myNode)
+}
+
+// loadPeerTransport picks how this node reaches its peers from PEER_PROTOCOL: http (the
+// default) or binary. HTTP RPCs go to each node's cluster.conf peer address. With binary,
+// every node also listens on PEER_BINARY_PORT (default 9081) at its cluster.conf host; the
+// returned listener is served once consensus runs. If serverTLS is set, peers are reached
+// with peerTLS and the binary listener only accepts nodes of the cluster.
+func loadPeerTransport(nodes []config.NodeConfig, myNode config.NodeConfig, serverTLS, peerTLS *tls.Config) (consensus.Transport, net.Listener, error) {
+	peerAddrs := make(map[string]string)
+	for _, node := range nodes {
+		peerAddrs[node.Address()] = node.PeerAddress()
+	}
+
+	protocol := envOr("PEER_PROTOCOL", "http")
+	switch protocol {
+	case "http":
+		transport := consensus.NewHTTPTransport()
+		if serverTLS != nil {
+			transport = consensus.NewHTTPTransportWithTLS(peerTLS)
+		}
+		transport.UsePeerAddresses(peerAddrs)
+		return transport, nil, nil
+	case "binary":
+	default:
+		return nil, nil, fmt.Errorf("PEER_PROTOCOL: unknown protocol %q", protocol)
+	}
+
+	port := envOr("PEER_BINARY_PORT", "9081")
+	addrs := make(map[string]string)
+	for _, node := range nodes {
+		addrs[node.Address()] = node.IP + ":" + port
+	}
+	listener, err := net.Listen("tcp", myNode.IP+":"+port)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen for binary peer RPCs: %v", err)
+	}
+	fmt.Println("🔌 Serving binary peer RPCs on", listener.Addr())
+	transport := consensus.NewBinaryTransport(addrs)
+	if serverTLS != nil {
+		binaryTLS := serverTLS.Clone()
+		binaryTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		listener = tls.NewListener(listener, binaryTLS)
+		transport = consensus.NewBinaryTransportWithTLS(addrs, peerTLS)
+	}
+	transport.UsePeerAddresses(peerAddrs)
+	return transport, listener, nil
+}
+
+// loadConsensusDir returns the directory consensus keeps its log, election state and
+// snapshots in: /data or, if ephemeral, a new temporary directory that cleanup removes.
+func loadConsensusDir(ephemeral bool) (string, func(), error) {
+	if !ephemeral {
+		return "/data", func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "kvstore-consensus-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create consensus directory: %v", err)
+	}
+	fmt.Println("🫥 Keeping consensus state in", dir, "until shutdown")
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// shutdownOnSignal closes the store on SIGINT or SIGTERM, saving it to snapshotPath first
+// if set, runs cleanup and exits.
+func shutdownOnSignal(store *kvstore.KVStore, snapshotPath string, cleanup func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Printf("🛑 Received %v, shutting down\n", sig)
+	if snapshotPath != "" {
+		if index, err := store.SaveSnapshotFile(snapshotPath); err != nil {
+			fmt.Println("❌ Failed to save in-memory store:", err)
+		} else {
+			fmt.Printf("💾 Saved in-memory store to %s at index %d\n", snapshotPath, index)
+		}
+	}
+	store.Close()
+	cleanup()
+	os.Exit(0)
+}
+
 func main() {
+	storageEngine := flag.String("storage", envOr("STORAGE_ENGINE", kvstore.EngineSQLite), "storage engine: sqlite, memory or log")
+	memorySnapshot := flag.String("memory-snapshot", os.Getenv("MEMORY_SNAPSHOT"), "with -storage=memory, load the store from this file on start and save it there on shutdown")
+	ephemeralConsensus := flag.Bool("ephemeral-consensus", os.Getenv("EPHEMERAL_CONSENSUS") == "true", "with -storage=memory, keep the consensus log and state in a temporary directory removed on shutdown")
+	flag.Parse()
+	if *memorySnapshot != "" && *storageEngine != kvstore.EngineMemory {
+		fmt.Println("⚠️ -memory-snapshot only applies to the memory engine; ignoring it")
+		*memorySnapshot = ""
+	}
+	if *ephemeralConsensus && *storageEngine != kvstore.EngineMemory {
+		fmt.Println("⚠️ -ephemeral-consensus only applies to the memory engine; ignoring it")
+		*ephemeralConsensus = false
+	}
+	// A saved store would be ahead of the empty log the next start begins with.
+	if *ephemeralConsensus && *memorySnapshot != "" {
+		fmt.Println("⚠️ -memory-snapshot cannot be used with -ephemeral-consensus; ignoring it")
+		*memorySnapshot = ""
+	}
+
 	mode := os.Getenv("CONSENSUS_MODE")
 	if mode != "cabinet" && mode != "cabinet++" {
 		fmt.Println("⚠️ Invalid CONSENSUS_MODE, defaulting to cabinet++")
 		mode = "cabinet++"
 	}
+	readConsistency := kvstore.ReadConsistency{Level: kvstore.ConsistencyAny}
+	if env := os.Getenv("READ_CONSISTENCY"); env != "" {
+		rc, err := kvstore.ParseReadConsistency(env)
+		if err != nil {
+			fmt.Printf("⚠️ Invalid READ_CONSISTENCY (%v), defaulting to any\n", err)
+		} else {
+			readConsistency = rc
+		}
+	}
 	cwd, _ := os.Getwd()
 	//peers := []string{"8081", "8082", "8083", "8084", "8085"} // or loaded from config
-	//consensus.InitCabinetWeights(peers)
 	fmt.Println("🔍 Current working directory:", cwd)
 	nodes, serverID := loadClusterConfig()
 	myNode := nodes[serverID]
@@ -42,27 +264,87 @@ func main() {
 	// Extract list of node addresses from config
 	var nodeAddresses []string
 	for _, node := range nodes {
-		nodeAddresses = append(nodeAddresses, node.IP+":"+node.Port)
+		nodeAddresses = append(nodeAddresses, node.Address())
 	}
+	serverTLS, peerTLS, err := loadTLSConfig(nodes, myNode)
+	if err != nil {
+		fmt.Println("Failed to load TLS settings:", err)
+		return
+	}
+	if serverTLS != nil {
+		fmt.Println("🔒 TLS enabled for clients and peers")
+	}
+	transport, binaryListener, err := loadPeerTransport(nodes, myNode, serverTLS, peerTLS)
+	if err != nil {
+		fmt.Println("Failed to set up peer transport:", err)
+		return
+	}
+	consensusDir, cleanup, err := loadConsensusDir(*ephemeralConsensus)
+	if err != nil {
+		fmt.Println("Failed to set up consensus directory:", err)
+		return
+	}
+	defer cleanup()
 	// Initialize consensus
-	consensusModule := consensus.NewConsensus(myNode.IP+":"+myNode.Port, nodeAddresses, mode)
+	consensusModule, err := consensus.NewConsensusWithTransport(myNode.Address(), nodeAddresses, mode, consensusDir, transport)
+	if err != nil {
+		fmt.Println("Failed to initialize consensus:", err)
+		return
+	}
+	if binaryListener != nil {
+		go consensus.ServeBinary(binaryListener, consensusModule)
+	}
+
+	leaseDuration, leaseDrift, err := loadLeaseConfig()
+	if err == nil {
+		err = consensusModule.ConfigureLease(leaseDuration, leaseDrift)
+	}
+	if err != nil {
+		fmt.Println("⚠️ Invalid leader lease settings, using defaults:", err)
+	}
+	batchWindow, pipelineDepth, err := loadPipelineConfig()
+	if err == nil {
+		err = consensusModule.ConfigurePipeline(batchWindow, pipelineDepth)
+	}
+	if err != nil {
+		fmt.Println("⚠️ Invalid proposal pipeline settings, using defaults:", err)
+	}
 
 	if consensusModule.State.IsLeader() {
 		go consensusModule.StartHeartbeatBroadcast() // ✅ manually start it at launch
 	}
+	cdcWriter, err := loadCDCWriter()
+	if err != nil {
+		fmt.Println("Failed to open CDC sink:", err)
+		return
+	}
+	if cdcWriter != nil {
+		fmt.Println("🗂️ Writing change data capture to", os.Getenv("CDC_DIR"))
+	}
+
+	engine, err := loadStorageEngine(*storageEngine, *memorySnapshot)
+	if err != nil {
+		fmt.Println("Failed to open storage engine:", err)
+		return
+	}
+
 	// Initialize KV Store with consensus
-	store, err := kvstore.NewKVStore("/data/kvstore.db", consensusModule)
+	store, err := kvstore.NewKVStoreWithEngine(engine, consensusModule, cdcWriter)
 	if err != nil {
 		fmt.Println("Failed to initialize database:", err)
 		return
 	}
 	defer store.Close()
+	go shutdownOnSignal(store, *memorySnapshot, cleanup)
 
-	server := kvstore.NewServer(store)
+	server := kvstore.NewServer(store, readConsistency)
+	if serverTLS != nil {
+		server.UseTLS(serverTLS, peerTLS)
+	}
 
 	// Start HTTP server
 	fmt.Printf("Starting node %d at %s:%s\n", myNode.ID, myNode.IP, myNode.Port)
-	if err := server.Start(myNode.IP + ":" + myNode.Port); err != nil {
+	if err := server.Start(myNode.Address(), myNode.PeerAddress()); err != nil {
 		fmt.Println("Error starting server:", err)
 	}
 }